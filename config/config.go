@@ -0,0 +1,59 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+// Package config reads the line oriented configuration files used by the
+// server and the admin tool.
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Line is a line in a configuration file.
+type Line struct {
+	// White space separated fields of the line.
+	Fields []string
+
+	// Name of the file and line number for error messages.
+	Name string
+	Num  int
+}
+
+// Errorf returns an error prefixed with the file name and line number.
+func (l *Line) Errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", l.Name, l.Num, fmt.Sprintf(format, args...))
+}
+
+// Read calls f for each line in r that is not blank or a comment starting
+// with #. The name is used in error messages. Read stops at the first error
+// returned by f.
+func Read(r io.Reader, name string, f func(l *Line) error) error {
+	s := bufio.NewScanner(r)
+	for num := 1; s.Scan(); num++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if err := f(&Line{Fields: fields, Name: name, Num: num}); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+// ReadFile calls f for each line in the named file as described for Read.
+func ReadFile(name string, f func(l *Line) error) error {
+	r, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return Read(r, name, f)
+}
@@ -0,0 +1,53 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package config
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	const text = "# comment\n\n  a b\tc\n  #indented comment\nd\n"
+	var lines []Line
+	err := Read(strings.NewReader(text), "test", func(l *Line) error {
+		lines = append(lines, *l)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Line{
+		{Fields: []string{"a", "b", "c"}, Name: "test", Num: 3},
+		{Fields: []string{"d"}, Name: "test", Num: 5},
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines = %+v, want %+v", lines, want)
+	}
+}
+
+func TestReadError(t *testing.T) {
+	n := 0
+	err := Read(strings.NewReader("a\nb\nc\n"), "test", func(l *Line) error {
+		n++
+		if l.Fields[0] == "b" {
+			return l.Errorf("bad %s", l.Fields[0])
+		}
+		return nil
+	})
+	if err == nil || err.Error() != "test:2: bad b" {
+		t.Errorf("err = %v, want test:2: bad b", err)
+	}
+	if n != 2 {
+		t.Errorf("called %d times, want 2", n)
+	}
+	if err := Read(strings.NewReader("a\n"), "test", func(l *Line) error { return errors.New("x") }); err == nil || err.Error() != "x" {
+		t.Errorf("err = %v, want x", err)
+	}
+}
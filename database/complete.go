@@ -0,0 +1,288 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package database
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// bigrams returns the bigrams for vocabulary word w. The word is padded with
+// ^ and $ so that the first and last letters are weighted more than the
+// letters in the middle of the word. This function must match the bigrams
+// computed by updateWord in searchIndexLua.
+func bigrams(w string) []string {
+	s := "^" + w + "$"
+	grams := make([]string, 0, len(s)-1)
+	seen := make(map[string]bool)
+	for i := 0; i < len(s)-1; i++ {
+		g := s[i : i+2]
+		if !seen[g] {
+			seen[g] = true
+			grams = append(grams, g)
+		}
+	}
+	return grams
+}
+
+// editDistance returns the optimal string alignment distance between a and
+// b. The distance is the number of insertions, deletions, substitutions and
+// transpositions of adjacent bytes needed to change a into b.
+func editDistance(a, b string) int {
+	// d[i][j] is the distance between a[:i] and b[:j]. Only the last three
+	// rows are needed.
+	d0 := make([]int, len(b)+1)
+	d1 := make([]int, len(b)+1)
+	d2 := make([]int, len(b)+1)
+	for j := range d2 {
+		d2[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		d0, d1, d2 = d1, d2, d0
+		d2[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d := d1[j-1] + cost
+			if x := d1[j] + 1; x < d {
+				d = x
+			}
+			if x := d2[j-1] + 1; x < d {
+				d = x
+			}
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				if x := d0[j-2] + 1; x < d {
+					d = x
+				}
+			}
+			d2[j] = d
+		}
+	}
+	return d2[len(b)]
+}
+
+// maxEdits returns the maximum edit distance for corrections of word w.
+func maxEdits(w string) int {
+	if len(w) <= 4 {
+		return 1
+	}
+	return 2
+}
+
+// Maximum number of candidates checked for a fuzzy match.
+const maxFuzzyCandidates = 200
+
+// Maximum number of words in a bigram set used to find fuzzy match
+// candidates. Larger sets are for bigrams common to many words. The sets are
+// skipped because they are expensive to combine and do not discriminate
+// between candidates.
+const maxGramWords = 5000
+
+// suggestScript returns whether a word is in the vocabulary, the words with
+// the word as a prefix ordered by use and the words sharing the most
+// bigrams with the word. Candidates with the same number of shared bigrams
+// are ordered by use. Bigram sets with more than maxGramWords words are not
+// used.
+var suggestScript = redis.NewScript(0, `
+    local key = ARGV[1]
+    local word = ARGV[2]
+    local limit = tonumber(ARGV[3])
+    local maxGramWords = tonumber(ARGV[4])
+
+    if redis.call('ZSCORE', 'vocab', word) then
+        return {1, {}, {}}
+    end
+
+    local prefixed = {}
+    for _, w in ipairs(redis.call('ZRANGEBYLEX', 'vocab:lex', '[' .. word, '[' .. word .. '\255', 'LIMIT', 0, limit)) do
+        prefixed[#prefixed+1] = {w, tonumber(redis.call('ZSCORE', 'vocab', w) or '0')}
+    end
+    table.sort(prefixed, function(a, b) return a[2] > b[2] end)
+    for i=1,#prefixed do
+        prefixed[i] = prefixed[i][1]
+    end
+
+    local grams = {}
+    for i=5,#ARGV do
+        local gram = 'gram:' .. ARGV[i]
+        if redis.call('SCARD', gram) <= maxGramWords then
+            grams[#grams+1] = gram
+        end
+    end
+    if #grams == 0 then
+        return {0, prefixed, {}}
+    end
+    redis.call('ZUNIONSTORE', key, #grams, unpack(grams))
+    redis.call('ZINTERSTORE', key, 2, key, 'vocab', 'WEIGHTS', 1, 0.000001)
+    local candidates = redis.call('ZREVRANGE', key, 0, limit - 1)
+    redis.call('DEL', key)
+
+    return {0, prefixed, candidates}
+`)
+
+// suggest returns vocabulary words similar to word w. If w is in the
+// vocabulary, then no words are returned. Words with w as a prefix are
+// returned first, followed by words within the maximum edit distance of w
+// ordered by distance.
+func (db *Database) suggest(c redis.Conn, w string) ([]string, error) {
+	n, err := redis.Int(c.Do("INCR", "maxQueryId"))
+	if err != nil {
+		return nil, err
+	}
+	args := []interface{}{"tmp:suggest-" + strconv.Itoa(n), w, maxFuzzyCandidates, maxGramWords}
+	for _, g := range bigrams(w) {
+		args = append(args, g)
+	}
+	values, err := redis.Values(suggestScript.Do(c, args...))
+	if err != nil {
+		return nil, err
+	}
+	var (
+		known      int
+		prefixed   []string
+		candidates []string
+	)
+	if _, err := redis.Scan(values, &known, &prefixed, &candidates); err != nil {
+		return nil, err
+	}
+	if known != 0 {
+		return nil, nil
+	}
+
+	words := prefixed
+	max := maxEdits(w)
+	for d := 1; d <= max; d++ {
+		for _, candidate := range candidates {
+			if strings.HasPrefix(candidate, w) {
+				continue
+			}
+			if editDistance(w, candidate) == d {
+				words = append(words, candidate)
+			}
+		}
+	}
+	return words, nil
+}
+
+// correctQuery returns query q with the words that are not in the
+// vocabulary replaced by the best suggestion. Filters and excluded words are
+// not changed.
+func (db *Database) correctQuery(c redis.Conn, q string) (string, error) {
+	fields := strings.Fields(q)
+	for i, f := range fields {
+		if strings.Contains(f, ":") || strings.HasPrefix(f, "-") {
+			continue
+		}
+		w := strings.ToLower(f)
+		if !isVocabularyWord(w) {
+			continue
+		}
+		words, err := db.suggest(c, w)
+		if err != nil {
+			return "", err
+		}
+		if len(words) > 0 {
+			fields[i] = words[0]
+		}
+	}
+	return strings.Join(fields, " "), nil
+}
+
+// completeScript returns the path, synopsis and kind for the highest ranked
+// packages with a lowercase name or import path starting with one of the
+// prefixes. Packages with a name equal to the prefix are boosted.
+var completeScript = redis.NewScript(0, `
+    local limit = tonumber(ARGV[1])
+
+    local ranked = {}
+    local seen = {}
+    for i=2,#ARGV do
+        local prefix = ARGV[i]
+        for _, key in ipairs({'complete:name', 'complete:path'}) do
+            for _, m in ipairs(redis.call('ZRANGEBYLEX', key, '[' .. prefix, '[' .. prefix .. '\255', 'LIMIT', 0, 200)) do
+                local name, id = string.match(m, '^(.*) (%d+)$')
+                if id and not seen[id] then
+                    seen[id] = true
+                    local score = tonumber(redis.call('ZSCORE', 'rank', id) or '0')
+                    if name == prefix then
+                        score = score * 10
+                    end
+                    ranked[#ranked+1] = {id, score}
+                end
+            end
+        end
+    end
+    table.sort(ranked, function(a, b) return a[2] > b[2] end)
+
+    local result = {}
+    for i=1,math.min(limit, #ranked) do
+        local values = redis.call('HMGET', 'pkg:' .. ranked[i][1], 'path', 'synopsis', 'kind')
+        result[#result+1] = values[1]
+        result[#result+1] = values[2]
+        result[#result+1] = values[3]
+    end
+    return result
+`)
+
+// Complete returns up to limit packages with a name or import path starting
+// with q. If there are fewer than limit matches, then packages with names
+// starting with words similar to q are also returned.
+func (db *Database) Complete(q string, limit int) ([]Package, error) {
+	q = strings.ToLower(strings.TrimSpace(q))
+	if q == "" || limit <= 0 || strings.ContainsAny(q, " \t") {
+		return nil, nil
+	}
+
+	c := db.Pool.Get()
+	defer c.Close()
+
+	reply, err := completeScript.Do(c, limit, q)
+	if err != nil {
+		return nil, err
+	}
+	pkgs, err := packages(reply, false)
+	if err != nil || len(pkgs) >= limit || !isVocabularyWord(q) {
+		return pkgs, err
+	}
+
+	words, err := db.suggest(c, q)
+	if err != nil || len(words) == 0 {
+		return pkgs, err
+	}
+	if len(words) > 3 {
+		words = words[:3]
+	}
+	args := []interface{}{limit}
+	for _, w := range words {
+		args = append(args, w)
+	}
+	reply, err = completeScript.Do(c, args...)
+	if err != nil {
+		return nil, err
+	}
+	more, err := packages(reply, false)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, pkg := range pkgs {
+		seen[pkg.Path] = true
+	}
+	for _, pkg := range more {
+		if len(pkgs) >= limit {
+			break
+		}
+		if !seen[pkg.Path] {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	return pkgs, nil
+}
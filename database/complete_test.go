@@ -0,0 +1,49 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+var editDistanceTests = []struct {
+	a, b string
+	d    int
+}{
+	{"", "", 0},
+	{"json", "json", 0},
+	{"jsno", "json", 1},
+	{"jsn", "json", 1},
+	{"jsonn", "json", 1},
+	{"yaml", "toml", 2},
+	{"websock", "websocket", 2},
+	{"", "abc", 3},
+	{"ca", "abc", 3},
+}
+
+func TestEditDistance(t *testing.T) {
+	for _, tt := range editDistanceTests {
+		if d := editDistance(tt.a, tt.b); d != tt.d {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, d, tt.d)
+		}
+		if d := editDistance(tt.b, tt.a); d != tt.d {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.b, tt.a, d, tt.d)
+		}
+	}
+}
+
+func TestBigrams(t *testing.T) {
+	expected := []string{"^j", "js", "so", "on", "n$"}
+	if grams := bigrams("json"); !reflect.DeepEqual(grams, expected) {
+		t.Errorf("bigrams(json) = %q, want %q", grams, expected)
+	}
+	expected = []string{"^a", "aa", "a$"}
+	if grams := bigrams("aaa"); !reflect.DeepEqual(grams, expected) {
+		t.Errorf("bigrams(aaa) = %q, want %q", grams, expected)
+	}
+}
@@ -16,12 +16,36 @@
 //      score: document search score
 //      etag:
 //      kind: p=package, c=command, d=directory with no go files
+//      license: SPDX identifier of the package license
+//      words: space separated vocabulary words
+//      name: package name
+//      snippets: excerpt of the documentation used for search result snippets
 // index:<term> set: package ids for given search term
 // index:import:<path> set: packages with import path
 // index:project:<root> set: packages in project with root
+// index:host:<host> set: packages with import path on host
+// index:kind:<kind> set: packages with kind package, cmd or directory
+// index:has:examples set: packages with examples
+// index:license:<id> set: packages with license
+// index:is:private set: packages in private repositories
+// index:name:<name> set: packages with last import path element name
+// rank zset: package id, search score scaled by number of importers
+// rank:init string: set after InitSearchRanks finishes computing the ranks
+// importers zset: package id, number of importers
+// pagerank zset: package id, effective number of importers from the PageRank of the import graph
+// facet:host zset: host, number of packages on host
+// facet:license zset: license, number of packages with license
+// vocab zset: word, number of packages with word
+// vocab:lex zset: words with score 0 for lexicographical range queries
+// gram:<bigram> set: words containing bigram. Words are padded with ^ and $.
+// complete:name zset: "<lowercase name> <id>" for ranked public packages, score 0
+// complete:path zset: "<lowercase path> <id>" for ranked public packages, score 0
 // block set: packages to block
+// gob:searchDict string: version of the search dictionary used to build the index
 // popular zset: package id, score
 // popular:0 string: scaled base time for popular scores
+// counter:<key> string: JSON encoded decaying counter value and scaled time
+// page:<path> hash: cache key "name generation", snappy compressed rendered page for import path
 // nextCrawl zset: package id, Unix time for next crawl
 // newCrawl set: new paths to crawl
 // badCrawl set: paths that returned error when crawling.
@@ -32,6 +56,7 @@ package database
 import (
 	"bytes"
 	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -39,7 +64,6 @@ import (
 	"math"
 	"net/url"
 	"os"
-	"path"
 	"sort"
 	"strconv"
 	"strings"
@@ -72,6 +96,7 @@ var (
 	redisServer      = flag.String("db-server", "redis://127.0.0.1:6379", "URI of Redis server.")
 	redisIdleTimeout = flag.Duration("db-idle-timeout", 250*time.Second, "Close Redis connections after remaining idle for this duration.")
 	redisLog         = flag.Bool("db-log", false, "Log database commands")
+	searchDictFile   = flag.String("db-search-dict", "", "Search synonym and stemming dictionary file. The built-in dictionary is used if not set.")
 )
 
 func dialDb() (c redis.Conn, err error) {
@@ -108,6 +133,12 @@ func dialDb() (c redis.Conn, err error) {
 
 // New creates a database configured from command line flags.
 func New() (*Database, error) {
+	if *searchDictFile != "" {
+		if err := loadSearchDict(*searchDictFile); err != nil {
+			return nil, err
+		}
+	}
+
 	pool := &redis.Pool{
 		Dial:        dialDb,
 		MaxIdle:     10,
@@ -130,7 +161,149 @@ func (db *Database) Exists(path string) (bool, error) {
 	return redis.Bool(c.Do("HEXISTS", "ids", path))
 }
 
-var putScript = redis.NewScript(0, `
+// searchIndexLua defines the Lua functions used by scripts that update the
+// search index.
+//
+// updateTerm adds or removes a package from the set for a term and updates
+// the facet counts. The import path is appended to the changed table for
+// import terms.
+//
+// updateRank sets the package rank to the search score scaled by the
+// effective number of importers from the import graph PageRank. Packages
+// without a PageRank are ranked as packages with no importers until the
+// PageRank is recomputed. The rank is removed for packages with a zero
+// search score.
+//
+// updateRanks updates the rank for the packages with the given import paths.
+//
+// updateWord adds or removes a package use of a vocabulary word. The bigrams
+// for a word are indexed when the word is first used and removed when the
+// word is no longer used.
+//
+// updateComplete adds or removes a package from the completion index.
+//
+// updateIndex replaces the search terms and vocabulary words for a package
+// and returns the import paths of the packages with changed importer counts.
+const searchIndexLua = `
+    local function updateWord(word, delta)
+        local n = tonumber(redis.call('ZINCRBY', 'vocab', delta, word))
+        local cmd
+        if n <= 0 then
+            redis.call('ZREM', 'vocab', word)
+            redis.call('ZREM', 'vocab:lex', word)
+            cmd = 'SREM'
+        elseif n == delta then
+            redis.call('ZADD', 'vocab:lex', 0, word)
+            cmd = 'SADD'
+        else
+            return
+        end
+        local s = '^' .. word .. '$'
+        for i=1,#s-1 do
+            redis.call(cmd, 'gram:' .. string.sub(s, i, i+1), word)
+        end
+    end
+
+    local function updateComplete(id, path, add)
+        local p = string.lower(path)
+        local name = string.match(p, '([^/]+)$') or p
+        if add then
+            redis.call('ZADD', 'complete:name', 0, name .. ' ' .. id)
+            redis.call('ZADD', 'complete:path', 0, p .. ' ' .. id)
+        else
+            redis.call('ZREM', 'complete:name', name .. ' ' .. id)
+            redis.call('ZREM', 'complete:path', p .. ' ' .. id)
+        end
+    end
+
+    local function updateTerm(id, term, delta, changed)
+        if delta > 0 then
+            redis.call('SADD', 'index:' .. term, id)
+        else
+            redis.call('SREM', 'index:' .. term, id)
+        end
+        local facet, value = string.match(term, '^(%a+):(.+)$')
+        if facet == 'host' or facet == 'license' then
+            if tonumber(redis.call('ZINCRBY', 'facet:' .. facet, delta, value)) <= 0 then
+                redis.call('ZREM', 'facet:' .. facet, value)
+            end
+        elseif facet == 'import' then
+            changed[#changed+1] = value
+        end
+    end
+
+    local function updateRank(id)
+        local values = redis.call('HMGET', 'pkg:' .. id, 'path', 'score')
+        local score = tonumber(values[2] or '0') or 0
+        if not values[1] or score <= 0 then
+            redis.call('ZREM', 'rank', id)
+            redis.call('ZREM', 'importers', id)
+            if values[1] then
+                updateComplete(id, values[1], false)
+            end
+            return
+        end
+        local n = redis.call('SCARD', 'index:import:' .. values[1])
+        if not string.find(values[1], '.', 1, true) then
+            score = score * 1.2
+        end
+        redis.call('ZADD', 'importers', n, id)
+        local importRank = tonumber(redis.call('ZSCORE', 'pagerank', id) or '0')
+        redis.call('ZADD', 'rank', score * math.log(10 + importRank), id)
+        updateComplete(id, values[1], redis.call('SISMEMBER', 'index:is:private', id) == 0)
+    end
+
+    local function updateRanks(paths)
+        for i=1,#paths do
+            local id = redis.call('HGET', 'ids', paths[i])
+            if id then
+                updateRank(id)
+            end
+        end
+    end
+
+    local function updateIndex(id, terms, words)
+        local update = {}
+        for term in string.gmatch(redis.call('HGET', 'pkg:' .. id, 'terms') or '', '([^ ]+)') do
+            update[term] = 1
+        end
+
+        for term in string.gmatch(terms, '([^ ]+)') do
+            update[term] = (update[term] or 0) + 2
+        end
+
+        local changed = {}
+        for term, x in pairs(update) do
+            if x == 1 then
+                updateTerm(id, term, -1, changed)
+            elseif x == 2 then
+                updateTerm(id, term, 1, changed)
+            end
+        end
+
+        update = {}
+        for word in string.gmatch(redis.call('HGET', 'pkg:' .. id, 'words') or '', '([^ ]+)') do
+            update[word] = 1
+        end
+
+        for word in string.gmatch(words, '([^ ]+)') do
+            update[word] = (update[word] or 0) + 2
+        end
+
+        for word, x in pairs(update) do
+            if x == 1 then
+                updateWord(word, -1)
+            elseif x == 2 then
+                updateWord(word, 1)
+            end
+        end
+
+        redis.call('HMSET', 'pkg:' .. id, 'terms', terms, 'words', words)
+        return changed
+    end
+`
+
+var putScript = redis.NewScript(0, searchIndexLua+`
     local path = ARGV[1]
     local synopsis = ARGV[2]
     local score = ARGV[3]
@@ -139,6 +312,12 @@ var putScript = redis.NewScript(0, `
     local etag = ARGV[6]
     local kind = ARGV[7]
     local nextCrawl = ARGV[8]
+    local license = ARGV[9]
+    local words = ARGV[10]
+    local name = ARGV[11]
+    local snippets = ARGV[12]
+
+    redis.call('DEL', 'page:' .. path)
 
     local id = redis.call('HGET', 'ids', path)
     if not id then
@@ -148,25 +327,11 @@ var putScript = redis.NewScript(0, `
 
     if etag ~= '' and etag == redis.call('HGET', 'pkg:' .. id, 'clone') then
         terms = ''
+        words = ''
         score = 0
     end
 
-    local update = {}
-    for term in string.gmatch(redis.call('HGET', 'pkg:' .. id, 'terms') or '', '([^ ]+)') do
-        update[term] = 1
-    end
-
-    for term in string.gmatch(terms, '([^ ]+)') do
-        update[term] = (update[term] or 0) + 2
-    end
-
-    for term, x in pairs(update) do
-        if x == 1 then
-            redis.call('SREM', 'index:' .. term, id)
-        elseif x == 2 then 
-            redis.call('SADD', 'index:' .. term, id)
-        end
-    end
+    local changed = updateIndex(id, terms, words)
 
     redis.call('SREM', 'badCrawl', path)
     redis.call('SREM', 'newCrawl', path)
@@ -176,7 +341,10 @@ var putScript = redis.NewScript(0, `
         redis.call('HSET', 'pkg:' .. id, 'crawl', nextCrawl)
     end
 
-    return redis.call('HMSET', 'pkg:' .. id, 'path', path, 'synopsis', synopsis, 'score', score, 'gob', gob, 'terms', terms, 'etag', etag, 'kind', kind)
+    redis.call('HMSET', 'pkg:' .. id, 'path', path, 'synopsis', synopsis, 'score', score, 'gob', gob, 'etag', etag, 'kind', kind, 'license', license, 'name', name, 'snippets', snippets)
+    updateRank(id)
+    updateRanks(changed)
+    return true
 `)
 
 var addCrawlScript = redis.NewScript(0, `
@@ -208,12 +376,25 @@ func (db *Database) Put(pdoc *doc.Package, nextCrawl time.Time, hide bool) error
 		score = documentScore(pdoc)
 	}
 	terms := documentTerms(pdoc, score)
+	words := documentWords(pdoc, score)
 
 	var gobBuf bytes.Buffer
 	if err := gob.NewEncoder(&gobBuf).Encode(pdoc); err != nil {
 		return err
 	}
 
+	// Drop the source for large documents.
+	if gobBuf.Len() > 200000 && pdoc.Source != nil {
+		pdocNew := *pdoc
+		pdoc = &pdocNew
+		pdoc.Source = nil
+		pdoc.Decls = nil
+		gobBuf.Reset()
+		if err := gob.NewEncoder(&gobBuf).Encode(pdoc); err != nil {
+			return err
+		}
+	}
+
 	// Truncate large documents.
 	if gobBuf.Len() > 200000 {
 		pdocNew := *pdoc
@@ -248,7 +429,12 @@ func (db *Database) Put(pdoc *doc.Package, nextCrawl time.Time, hide bool) error
 		t = nextCrawl.Unix()
 	}
 
-	_, err = putScript.Do(c, pdoc.ImportPath, pdoc.Synopsis, score, gobBytes, strings.Join(terms, " "), pdoc.Etag, kind, t)
+	license := ""
+	if pdoc.License != nil {
+		license = pdoc.License.ID
+	}
+
+	_, err = putScript.Do(c, pdoc.ImportPath, pdoc.Synopsis, score, gobBytes, strings.Join(terms, " "), pdoc.Etag, kind, t, license, strings.Join(words, " "), pdoc.Name, snippetText(pdoc))
 	if err != nil {
 		return err
 	}
@@ -388,13 +574,8 @@ func (db *Database) getDoc(c redis.Conn, path string) (*doc.Package, time.Time,
 		return nil, time.Time{}, err
 	}
 
-	p, err = snappy.Decode(nil, p)
-	if err != nil {
-		return nil, time.Time{}, err
-	}
-
 	var pdoc doc.Package
-	if err := gob.NewDecoder(bytes.NewReader(p)).Decode(&pdoc); err != nil {
+	if err := decodeDoc(p, &pdoc); err != nil {
 		return nil, time.Time{}, err
 	}
 
@@ -406,6 +587,16 @@ func (db *Database) getDoc(c redis.Conn, path string) (*doc.Package, time.Time,
 	return &pdoc, nextCrawl, err
 }
 
+// decodeDoc decodes snappy compressed gob encoded documentation stored in
+// the gob field of a package.
+func decodeDoc(p []byte, v interface{}) error {
+	p, err := snappy.Decode(nil, p)
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(p)).Decode(v)
+}
+
 var getSubdirsScript = redis.NewScript(0, `
     local reply
     for i = 1,#ARGV do
@@ -492,23 +683,55 @@ func (db *Database) GetDoc(path string) (*doc.Package, time.Time, error) {
 	return db.getDoc(c, path)
 }
 
-var deleteScript = redis.NewScript(0, `
+var packageNameScript = redis.NewScript(0, `
+    local id = redis.call('HGET', 'ids', ARGV[1])
+    if not id then
+        return false
+    end
+    return redis.call('HGET', 'pkg:' .. id, 'name')
+`)
+
+// PackageName returns the name of the package with the given import path or
+// the empty string if the package is not in the database.
+func (db *Database) PackageName(path string) (string, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	name, err := redis.String(packageNameScript.Do(c, path))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return name, err
+}
+
+var deleteScript = redis.NewScript(0, searchIndexLua+`
     local path = ARGV[1]
 
+    redis.call('DEL', 'page:' .. path)
+
     local id = redis.call('HGET', 'ids', path)
     if not id then
         return false
     end
 
+    local changed = {}
     for term in string.gmatch(redis.call('HGET', 'pkg:' .. id, 'terms') or '', '([^ ]+)') do
-        redis.call('SREM', 'index:' .. term, id)
+        updateTerm(id, term, -1, changed)
     end
+    for word in string.gmatch(redis.call('HGET', 'pkg:' .. id, 'words') or '', '([^ ]+)') do
+        updateWord(word, -1)
+    end
+    updateComplete(id, path, false)
 
     redis.call('ZREM', 'nextCrawl', id)
     redis.call('SREM', 'newCrawl', path)
     redis.call('ZREM', 'popular', id)
+    redis.call('ZREM', 'rank', id)
+    redis.call('ZREM', 'importers', id)
+    redis.call('ZREM', 'pagerank', id)
     redis.call('DEL', 'pkg:' .. id)
-    return redis.call('HDEL', 'ids', path)
+    local result = redis.call('HDEL', 'ids', path)
+    updateRanks(changed)
+    return result
 `)
 
 // Delete deletes the documenation for the given import path.
@@ -561,8 +784,25 @@ func (db *Database) GoSubrepoIndex() ([]Package, error) {
 	return db.getPackages("index:project:subrepo", false)
 }
 
+// getPublicPackages returns the packages in the set with the given key
+// excluding packages in private repositories.
+func (db *Database) getPublicPackages(key string) ([]Package, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	n, err := redis.Int(c.Do("INCR", "maxQueryId"))
+	if err != nil {
+		return nil, err
+	}
+	tmp := "tmp:public-" + strconv.Itoa(n)
+	if _, err := c.Do("SDIFFSTORE", tmp, key, "index:is:private"); err != nil {
+		return nil, err
+	}
+	defer c.Do("DEL", tmp)
+	return db.getPackages(tmp, false)
+}
+
 func (db *Database) Index() ([]Package, error) {
-	return db.getPackages("index:all:", false)
+	return db.getPublicPackages("index:all:")
 }
 
 func (db *Database) Project(projectRoot string) ([]Package, error) {
@@ -633,7 +873,7 @@ func (db *Database) ImporterCount(path string) (int, error) {
 }
 
 func (db *Database) Importers(path string) ([]Package, error) {
-	return db.getPackages("index:import:"+path, false)
+	return db.getPublicPackages("index:import:" + path)
 }
 
 func (db *Database) Block(root string) error {
@@ -674,87 +914,509 @@ func (db *Database) IsBlocked(path string) (bool, error) {
 	return redis.Bool(isBlockedScript.Do(c, path))
 }
 
-type queryResult struct {
-	Path     string
-	Synopsis string
-	Score    float64
+// SearchResult is a package matching a search query.
+type SearchResult struct {
+	Path          string   `json:"path"`
+	Synopsis      string   `json:"synopsis,omitempty"`
+	License       string   `json:"license,omitempty"`
+	Score         float64  `json:"score"`
+	ImporterCount int      `json:"importerCount"`
+	Reasons       []string `json:"reasons,omitempty"`
+	Snippet       *Snippet `json:"snippet,omitempty"`
 }
 
-type byScore []*queryResult
+// SearchResults is a page of search results.
+type SearchResults struct {
+	// Total number of results for the query.
+	Total int
 
-func (p byScore) Len() int           { return len(p) }
-func (p byScore) Less(i, j int) bool { return p[j].Score < p[i].Score }
-func (p byScore) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+	// Results in the page, ordered by score.
+	Results []SearchResult
 
-func (db *Database) Query(q string) ([]Package, error) {
-	terms := parseQuery(q)
-	if len(terms) == 0 {
-		return nil, nil
+	// Result counts for filters on the results.
+	Facets []Facet
+
+	// Corrected query if the results are for a corrected query.
+	Corrected string
+}
+
+// Facet is the number of search results for the values of a search filter.
+type Facet struct {
+	Name   string       `json:"name"`
+	Values []FacetValue `json:"values"`
+}
+
+// FacetValue is the number of search results matching a filter.
+type FacetValue struct {
+	Value  string `json:"value"`
+	Filter string `json:"filter"`
+	Count  int    `json:"count"`
+}
+
+type byFacetCount []FacetValue
+
+func (p byFacetCount) Len() int      { return len(p) }
+func (p byFacetCount) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byFacetCount) Less(i, j int) bool {
+	if p[i].Count != p[j].Count {
+		return p[i].Count > p[j].Count
+	}
+	return p[i].Value < p[j].Value
+}
+
+// Maximum number of values returned for a facet.
+const maxFacetValues = 10
+
+var facetNames = []string{"kind", "host", "license", "has"}
+
+// newFacets returns the facets for the filter counts returned by
+// queryScript. The counts are a list of filter terms and counts.
+func newFacets(counts []interface{}) ([]Facet, error) {
+	m := make(map[string]*Facet)
+	for len(counts) > 0 {
+		var term string
+		var n int
+		var err error
+		counts, err = redis.Scan(counts, &term, &n)
+		if err != nil {
+			return nil, err
+		}
+		i := strings.Index(term, ":")
+		if n == 0 || i < 0 {
+			continue
+		}
+		name := term[:i]
+		f := m[name]
+		if f == nil {
+			f = &Facet{Name: name}
+			m[name] = f
+		}
+		f.Values = append(f.Values, FacetValue{Value: term[i+1:], Filter: term, Count: n})
+	}
+	var facets []Facet
+	for _, name := range facetNames {
+		if f := m[name]; f != nil {
+			sort.Sort(byFacetCount(f.Values))
+			if len(f.Values) > maxFacetValues {
+				f.Values = f.Values[:maxFacetValues]
+			}
+			facets = append(facets, *f)
+		}
+	}
+	return facets, nil
+}
+
+// Limits on the work done by queryScript.
+const (
+	// Maximum number of candidate packages examined for a query. If the
+	// smallest term set is larger than this, then the candidates are read
+	// from the rank sorted set in rank order and the total is estimated
+	// from the fraction of examined packages that match.
+	maxQueryScan = 20000
+
+	// Number of top results used to count the facets.
+	maxFacetResults = 1000
+)
+
+// queryScript finds a page of search results. The results are the
+// intersection of the term sets minus the excluded term sets and the hidden
+// packages, ordered by the precomputed rank. Each list of hidden prefixes is
+// an import path prefix of hidden packages followed by the prefixes of
+// packages that are not hidden. The prefixes are matched against the stored
+// import path, so packages indexed before a prefix was hidden are also
+// hidden. Results with a name equal to the query are boosted.
+//
+// The candidates are the members of the smallest term set when that set is
+// small. Otherwise, the candidates are read from the rank sorted set in rank
+// order until the page is filled. The facets are counted over the top
+// results. The script does not store temporary keys.
+var queryScript = redis.NewScript(0, `
+    local offset = tonumber(ARGV[1])
+    local limit = tonumber(ARGV[2])
+    local hasKind = ARGV[3] == '1'
+    local minImporters = tonumber(ARGV[4])
+    local name = ARGV[5]
+    local maxScan = tonumber(ARGV[6])
+    local maxFacet = tonumber(ARGV[7])
+
+    local i = 8
+    local function list(keyPrefix)
+        local result = {}
+        local n = tonumber(ARGV[i])
+        for j=1,n do
+            result[j] = keyPrefix .. ARGV[i+j]
+        end
+        i = i + n + 1
+        return result
+    end
+    local terms = list('index:')
+    local excluded = list('index:')
+    local hidden = {}
+    local n = tonumber(ARGV[i])
+    i = i + 1
+    for j=1,n do
+        hidden[j] = list('')
+    end
+
+    local function member(key, id)
+        return redis.call('SISMEMBER', key, id) == 1
+    end
+
+    local function under(path, prefix)
+        return path == prefix or string.sub(path, 1, #prefix + 1) == prefix .. '/'
+    end
+
+    local function allowed(id)
+        for _, key in ipairs(terms) do
+            if not member(key, id) then
+                return false
+            end
+        end
+        for _, key in ipairs(excluded) do
+            if member(key, id) then
+                return false
+            end
+        end
+        if #hidden > 0 then
+            local path = redis.call('HGET', 'pkg:' .. id, 'path')
+            if not path then
+                return false
+            end
+            for _, prefixes in ipairs(hidden) do
+                if under(path, prefixes[1]) then
+                    local except = false
+                    for j=2,#prefixes do
+                        if under(path, prefixes[j]) then
+                            except = true
+                            break
+                        end
+                    end
+                    if not except then
+                        return false
+                    end
+                end
+            end
+        end
+        if minImporters > 0 and tonumber(redis.call('ZSCORE', 'importers', id) or '0') < minImporters then
+            return false
+        end
+        return true
+    end
+
+    local nameKey = 'index:name:' .. name
+    local function boost(id, score)
+        if name ~= '' and member(nameKey, id) then
+            score = score * 1.1
+            -- Big bump for exact match on standard package name.
+            if member('index:project:go', id) then
+                score = score * 10000
+            end
+        end
+        return score
+    end
+
+    -- matched is the list of allowed candidates. Each entry is a list of
+    -- id, score and whether the candidate passes the kind filter.
+    local matched = {}
+    local kindCount = 0
+    local function add(id, score)
+        local ok = hasKind or member('index:kind:package', id)
+        if ok then
+            kindCount = kindCount + 1
+        end
+        matched[#matched+1] = {id, score, ok}
+    end
+
+    local smallest, size
+    for _, key in ipairs(terms) do
+        local m = redis.call('SCARD', key)
+        if not smallest or m < size then
+            smallest, size = key, m
+        end
+    end
+
+    local total
+    if size <= maxScan then
+        for _, id in ipairs(redis.call('SMEMBERS', smallest)) do
+            local score = redis.call('ZSCORE', 'rank', id)
+            if score and allowed(id) then
+                add(id, boost(id, tonumber(score)))
+            end
+        end
+        total = kindCount
+    else
+        -- Packages with the name are boosted out of rank order, so they are
+        -- found separately.
+        local boosted = 0
+        local named = name ~= '' and redis.call('SCARD', nameKey) <= maxScan
+        if named then
+            for _, id in ipairs(redis.call('SMEMBERS', nameKey)) do
+                local score = redis.call('ZSCORE', 'rank', id)
+                if score and allowed(id) then
+                    add(id, boost(id, tonumber(score)))
+                end
+            end
+            boosted = kindCount
+        end
+        local need = offset + limit
+        local card = redis.call('ZCARD', 'rank')
+        local scanned = 0
+        while scanned < card and scanned < maxScan and (kindCount - boosted < need or #matched < maxFacet) do
+            local ids = redis.call('ZREVRANGE', 'rank', scanned, scanned + 999, 'WITHSCORES')
+            if #ids == 0 then
+                break
+            end
+            for j=1,#ids,2 do
+                local id = ids[j]
+                if not (named and member(nameKey, id)) and allowed(id) then
+                    add(id, boost(id, tonumber(ids[j+1])))
+                end
+            end
+            scanned = scanned + #ids / 2
+        end
+        total = kindCount
+        if scanned < card then
+            total = boosted + math.floor((kindCount - boosted) * card / scanned)
+        end
+    end
+
+    table.sort(matched, function(a, b)
+        if a[2] ~= b[2] then
+            return a[2] > b[2]
+        end
+        return a[1] < b[1]
+    end)
+
+    local names = {}
+    local counts = {}
+    for j=1,math.min(#matched, maxFacet) do
+        local m = matched[j]
+        for term in string.gmatch(redis.call('HGET', 'pkg:' .. m[1], 'terms') or '', '([^ ]+)') do
+            local facet = string.match(term, '^(%a+):')
+            if term == 'kind:package' or term == 'kind:cmd' or
+                    (m[3] and (facet == 'host' or facet == 'license' or term == 'has:examples')) then
+                if not counts[term] then
+                    counts[term] = 0
+                    names[#names+1] = term
+                end
+                counts[term] = counts[term] + 1
+            end
+        end
+    end
+    local facets = {}
+    for _, term in ipairs(names) do
+        facets[#facets+1] = term
+        facets[#facets+1] = counts[term]
+    end
+
+    local page = {}
+    local k = 0
+    for _, m in ipairs(matched) do
+        if m[3] then
+            k = k + 1
+            if k > offset + limit then
+                break
+            end
+            if k > offset then
+                local values = redis.call('HMGET', 'pkg:' .. m[1], 'path', 'synopsis', 'license')
+                page[#page+1] = values[1]
+                page[#page+1] = values[2]
+                page[#page+1] = values[3]
+                page[#page+1] = tostring(m[2])
+                page[#page+1] = redis.call('SCARD', 'index:import:' .. values[1])
+                page[#page+1] = m[1]
+            end
+        end
+    end
+
+    return {total, page, facets}
+`)
+
+// HiddenPrefix is an import path prefix for packages that are hidden from
+// search results.
+type HiddenPrefix struct {
+	// Packages with import path equal to Prefix or starting with Prefix/
+	// are hidden.
+	Prefix string
+
+	// Packages under these prefixes are not hidden by this prefix.
+	Except []string
+}
+
+// Access specifies the packages that are visible in search results.
+type Access struct {
+	// Include packages in private repositories.
+	Private bool
+
+	// Import path prefixes of packages that are not visible.
+	Hidden []HiddenPrefix
+}
+
+// Query returns the page of search results for query q starting at offset.
+// See parseSearchQuery for the query syntax. If there are no results for
+// the query, then the misspelled words in the query are corrected and the
+// results for the corrected query are returned. The results only include
+// the packages allowed by access.
+func (db *Database) Query(q string, offset, limit int, access Access) (*SearchResults, error) {
+	sq := parseSearchQuery(q)
+	if len(sq.terms) == 0 || limit <= 0 {
+		return &SearchResults{}, nil
 	}
+	sq.restrict(access)
+
 	c := db.Pool.Get()
 	defer c.Close()
-	n, err := redis.Int(c.Do("INCR", "maxQueryId"))
+
+	sr, err := db.query(c, sq, offset, limit)
+	if err != nil || sr.Total > 0 || sq.text == "" {
+		return sr, err
+	}
+
+	corrected, err := db.correctQuery(c, q)
+	if err != nil || corrected == strings.Join(strings.Fields(q), " ") {
+		return sr, err
+	}
+	sq = parseSearchQuery(corrected)
+	if len(sq.terms) == 0 {
+		return sr, nil
+	}
+	sq.restrict(access)
+	sr, err = db.query(c, sq, offset, limit)
 	if err != nil {
 		return nil, err
 	}
-	id := "tmp:query-" + strconv.Itoa(n)
+	sr.Corrected = corrected
+	return sr, nil
+}
 
-	args := []interface{}{id}
-	for _, term := range terms {
-		args = append(args, "index:"+term)
+func (db *Database) query(c redis.Conn, sq *searchQuery, offset, limit int) (*SearchResults, error) {
+	hasKind := 0
+	if sq.hasKind {
+		hasKind = 1
 	}
-	c.Send("SINTERSTORE", args...)
-	c.Send("SORT", id, "DESC", "BY", "nosort", "GET", "pkg:*->path", "GET", "pkg:*->synopsis", "GET", "pkg:*->score")
-	c.Send("DEL", id)
-	c.Flush()
-	c.Receive()                              // SINTERSTORE
-	values, err := redis.Values(c.Receive()) // SORT
+	args := []interface{}{offset, limit, hasKind, sq.minImporters, sq.nameTerm(), maxQueryScan, maxFacetResults}
+	addTerms := func(terms []string) {
+		args = append(args, len(terms))
+		for _, term := range terms {
+			args = append(args, term)
+		}
+	}
+	addTerms(sq.terms)
+	addTerms(sq.excluded)
+	args = append(args, len(sq.hidden))
+	for _, prefixes := range sq.hidden {
+		addTerms(prefixes)
+	}
+
+	values, err := redis.Values(queryScript.Do(c, args...))
 	if err != nil {
 		return nil, err
 	}
-	c.Receive() // DEL
-
-	var queryResults []*queryResult
-	if err := redis.ScanSlice(values, &queryResults, "Path", "Synopsis", "Score"); err != nil {
+	sr := &SearchResults{}
+	var page, counts []interface{}
+	if _, err := redis.Scan(values, &sr.Total, &page, &counts); err != nil {
 		return nil, err
 	}
+	var ids []string
+	for len(page) > 0 {
+		var r SearchResult
+		var id string
+		page, err = redis.Scan(page, &r.Path, &r.Synopsis, &r.License, &r.Score, &r.ImporterCount, &id)
+		if err != nil {
+			return nil, err
+		}
+		r.Reasons = sq.reasons(r.Path, r.Synopsis)
+		sr.Results = append(sr.Results, r)
+		ids = append(ids, id)
+	}
+	if err := db.addSnippets(c, sq, sr.Results, ids); err != nil {
+		return nil, err
+	}
+	sr.Facets, err = newFacets(counts)
+	if err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
 
-	for _, qr := range queryResults {
-		c.Send("SCARD", "index:import:"+qr.Path)
+// addSnippets sets the snippet for the first maxSnippets results. The
+// snippets are computed from the snippet text stored for the packages with
+// the given ids.
+func (db *Database) addSnippets(c redis.Conn, sq *searchQuery, results []SearchResult, ids []string) error {
+	terms := sq.snippetTerms()
+	if len(terms) == 0 {
+		return nil
+	}
+	if len(ids) > maxSnippets {
+		ids = ids[:maxSnippets]
+	}
+	for _, id := range ids {
+		c.Send("HGET", "pkg:"+id, "snippets")
 	}
 	c.Flush()
-
-	for _, qr := range queryResults {
-		importCount, err := redis.Int(c.Receive())
-		if err != nil {
-			return nil, err
+	for i := range ids {
+		text, err := redis.String(c.Receive())
+		if err == redis.ErrNil {
+			continue
+		} else if err != nil {
+			return err
 		}
+		results[i].Snippet = newSnippet(text, terms)
+	}
+	return nil
+}
 
-		qr.Score *= math.Log(float64(10 + importCount))
+var updateRanksScript = redis.NewScript(0, searchIndexLua+`
+    for i=1,#ARGV do
+        local id = ARGV[i]
+        for term in string.gmatch(redis.call('HGET', 'pkg:' .. id, 'terms') or '', '([^ ]+)') do
+            local facet, value = string.match(term, '^(%a+):(.+)$')
+            if facet == 'host' or facet == 'license' then
+                redis.call('ZINCRBY', 'facet:' .. facet, 1, value)
+            end
+        end
+        updateRank(id)
+    end
+`)
 
-		if isStandardPackage(qr.Path) {
-			if strings.HasSuffix(qr.Path, q) {
-				// Big bump for exact match on standard package name.
-				qr.Score *= 10000
-			} else {
-				qr.Score *= 1.2
+// InitSearchRanks computes the search ranks, completion index and facet
+// counts if they have not been computed. The ranks are maintained by Put and
+// Delete after they are computed. The rank:init key is set after the scan of
+// the packages finishes, so an interrupted computation is restarted.
+func (db *Database) InitSearchRanks() error {
+	c := db.Pool.Get()
+	defer c.Close()
+	done, err := redis.Bool(c.Do("EXISTS", "rank:init"))
+	if err != nil || done {
+		return err
+	}
+	if _, err := c.Do("DEL", "importers", "facet:host", "facet:license", "complete:name", "complete:path"); err != nil {
+		return err
+	}
+	cursor := 0
+	for {
+		values, err := redis.Values(c.Do("SCAN", cursor, "MATCH", "pkg:*", "COUNT", 1000))
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return err
+		}
+		args := make([]interface{}, len(keys))
+		for i, key := range keys {
+			args[i] = strings.TrimPrefix(key, "pkg:")
+		}
+		if len(args) > 0 {
+			if _, err := updateRanksScript.Do(c, args...); err != nil {
+				return err
 			}
 		}
-
-		if q == path.Base(qr.Path) {
-			qr.Score *= 1.1
+		if cursor == 0 {
+			_, err := c.Do("SET", "rank:init", time.Now().Unix())
+			return err
 		}
 	}
-
-	sort.Sort(byScore(queryResults))
-
-	pkgs := make([]Package, len(queryResults))
-	for i, qr := range queryResults {
-		pkgs[i].Path = qr.Path
-		pkgs[i].Synopsis = qr.Synopsis
-	}
-
-	return pkgs, nil
 }
 
 type PackageInfo struct {
@@ -781,13 +1443,12 @@ func (db *Database) Do(f func(*PackageInfo) error) error {
 		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
 			return err
 		}
-		if cursor == 0 {
-			break
-		}
 		for _, key := range keys {
-			c.Send("HMGET", key, "gob", "score", "kind", "path", "terms", "synopis")
+			c.Send("HMGET", key, "gob", "score", "kind", "path", "terms", "synopsis")
+		}
+		if cursor != 0 {
+			c.Send("SCAN", cursor, "MATCH", "pkg:*")
 		}
-		c.Send("SCAN", cursor, "MATCH", "pkg:*")
 		c.Flush()
 		for _ = range keys {
 			values, err := redis.Values(c.Receive())
@@ -813,22 +1474,102 @@ func (db *Database) Do(f func(*PackageInfo) error) error {
 
 			pi.Size = len(path) + len(p) + len(terms) + len(synopsis)
 
-			p, err = snappy.Decode(nil, p)
-			if err != nil {
-				return fmt.Errorf("snappy decoding %s: %v", path, err)
-			}
-
-			if err := gob.NewDecoder(bytes.NewReader(p)).Decode(&pi.PDoc); err != nil {
-				return fmt.Errorf("gob decoding %s: %v", path, err)
+			if err := decodeDoc(p, &pi.PDoc); err != nil {
+				return fmt.Errorf("decoding %s: %v", path, err)
 			}
 			if err := f(&pi); err != nil {
 				return fmt.Errorf("func %s: %v", path, err)
 			}
 		}
+		if cursor == 0 {
+			break
+		}
 	}
 	return nil
 }
 
+var reindexScript = redis.NewScript(0, searchIndexLua+`
+    local path = ARGV[1]
+    local score = ARGV[2]
+    local terms = ARGV[3]
+    local words = ARGV[4]
+    local name = ARGV[5]
+    local snippets = ARGV[6]
+
+    local id = redis.call('HGET', 'ids', path)
+    if not id then
+        return false
+    end
+
+    local etag = redis.call('HGET', 'pkg:' .. id, 'etag')
+    if etag and etag ~= '' and etag == redis.call('HGET', 'pkg:' .. id, 'clone') then
+        terms = ''
+        words = ''
+        score = 0
+    end
+
+    local changed = updateIndex(id, terms, words)
+    redis.call('HMSET', 'pkg:' .. id, 'score', score, 'name', name, 'snippets', snippets)
+    updateRank(id)
+    updateRanks(changed)
+    return true
+`)
+
+// Number of packages between calls to the Reindex progress function.
+const reindexProgressInterval = 1000
+
+// Reindex recomputes the search terms, vocabulary words, score, package
+// name and snippet text for every package from the stored documentation and records the version of the
+// search dictionary used to build the index.
+//
+// The index entries for each package are swapped in a single script, so a
+// search sees either the old or the new entries for a package. Put and
+// Delete can run concurrently with Reindex, so the server does not need to
+// be stopped.
+//
+// If isPrivate is not nil, then the privacy of each package is recomputed
+// with isPrivate instead of using the privacy recorded when the package was
+// fetched.
+//
+// If progress is not nil, then progress is called with the number of
+// packages reindexed and the total number of packages after every
+// reindexProgressInterval packages and at the end of the reindex.
+func (db *Database) Reindex(isPrivate func(importPath string) bool, progress func(n, total int)) error {
+	c := db.Pool.Get()
+	defer c.Close()
+
+	total, err := redis.Int(c.Do("HLEN", "ids"))
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	err = db.Do(func(pi *PackageInfo) error {
+		pdoc := pi.PDoc
+		if isPrivate != nil {
+			pdoc.Private = isPrivate(pdoc.ImportPath)
+		}
+		score := documentScore(pdoc)
+		terms := documentTerms(pdoc, score)
+		words := documentWords(pdoc, score)
+		if _, err := reindexScript.Do(c, pdoc.ImportPath, score, strings.Join(terms, " "), strings.Join(words, " "), pdoc.Name, snippetText(pdoc)); err != nil {
+			return err
+		}
+		n++
+		if progress != nil && n%reindexProgressInterval == 0 {
+			progress(n, total)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if progress != nil {
+		progress(n, total)
+	}
+	return db.PutSearchDictVersion()
+}
+
 var importGraphScript = redis.NewScript(0, `
     local path = ARGV[1]
 
@@ -920,6 +1661,59 @@ func (db *Database) GetGob(key string, value interface{}) error {
 	return gob.NewDecoder(bytes.NewReader(p)).Decode(value)
 }
 
+// GetPage returns the rendered page stored for the import path and cache key
+// or nil if the page is not stored.
+func (db *Database) GetPage(path, key string) ([]byte, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	p, err := redis.Bytes(c.Do("HGET", "page:"+path, key))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return snappy.Decode(nil, p)
+}
+
+var putPageScript = redis.NewScript(0, `
+    local key = 'page:' .. ARGV[1]
+    local field = ARGV[2]
+
+    local generation = string.match(field, ' (.*)$') or ''
+    for _, k in ipairs(redis.call('HKEYS', key)) do
+        if (string.match(k, ' (.*)$') or '') ~= generation then
+            redis.call('HDEL', key, k)
+        end
+    end
+    redis.call('HSET', key, field, ARGV[3])
+    redis.call('EXPIRE', key, ARGV[4])
+`)
+
+// PutPage stores a rendered page for the import path and cache key. The key
+// has the form "name generation". The pages for the import path with a
+// different generation are deleted, so pages for old versions of the
+// package do not accumulate while each put extends the expiration. The pages
+// for an import path expire after maxAge and are deleted when the package
+// is updated or deleted.
+func (db *Database) PutPage(path, key string, p []byte, maxAge time.Duration) error {
+	p, err := snappy.Encode(nil, p)
+	if err != nil {
+		return err
+	}
+	c := db.Pool.Get()
+	defer c.Close()
+	_, err = putPageScript.Do(c, path, key, p, int64(maxAge/time.Second))
+	return err
+}
+
+// DeletePages deletes the rendered pages stored for the import path.
+func (db *Database) DeletePages(path string) error {
+	c := db.Pool.Get()
+	defer c.Close()
+	_, err := c.Do("DEL", "page:"+path)
+	return err
+}
+
 var incrementPopularScoreScript = redis.NewScript(0, `
     local path = ARGV[1]
     local n = ARGV[2]
@@ -957,9 +1751,24 @@ func (db *Database) IncrementPopularScore(path string) error {
 	return db.incrementPopularScoreInternal(path, 1, time.Now())
 }
 
+// popularScript returns the most popular packages. The popular score of the
+// candidates is scaled by the effective number of importers from the import
+// graph PageRank so that widely used packages are listed first.
 var popularScript = redis.NewScript(0, `
-    local stop = ARGV[1]
-    local ids = redis.call('ZREVRANGE', 'popular', '0', stop)
+    local count = tonumber(ARGV[1])
+    local candidates = redis.call('ZREVRANGE', 'popular', '0', count * 3 - 1, 'WITHSCORES')
+    local ranked = {}
+    for i=1,#candidates,2 do
+        if redis.call('SISMEMBER', 'index:is:private', candidates[i]) == 0 then
+            local importRank = tonumber(redis.call('ZSCORE', 'pagerank', candidates[i]) or '0')
+            ranked[#ranked+1] = {candidates[i], tonumber(candidates[i+1]) * math.log(10 + importRank)}
+        end
+    end
+    table.sort(ranked, function(a, b) return a[2] > b[2] end)
+    local ids = {}
+    for i=1,math.min(count, #ranked) do
+        ids[i] = ranked[i][1]
+    end
     local result = {}
     for i=1,#ids do
         local values = redis.call('HMGET', 'pkg:' .. ids[i], 'path', 'synopsis', 'kind')
@@ -973,7 +1782,7 @@ var popularScript = redis.NewScript(0, `
 func (db *Database) Popular(count int) ([]Package, error) {
 	c := db.Pool.Get()
 	defer c.Close()
-	reply, err := popularScript.Do(c, count-1)
+	reply, err := popularScript.Do(c, count)
 	if err != nil {
 		return nil, err
 	}
@@ -1003,6 +1812,19 @@ func (db *Database) PopularWithScores() ([]Package, error) {
 	return pkgs, err
 }
 
+// CrawlQueueSizes returns the number of new packages waiting to be crawled
+// and the number of packages with a next crawl time in the past.
+func (db *Database) CrawlQueueSizes() (newCrawl, overdue int, err error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	newCrawl, err = redis.Int(c.Do("SCARD", "newCrawl"))
+	if err != nil {
+		return 0, 0, err
+	}
+	overdue, err = redis.Int(c.Do("ZCOUNT", "nextCrawl", "-inf", time.Now().Unix()))
+	return newCrawl, overdue, err
+}
+
 func (db *Database) PopNewCrawl() (string, bool, error) {
 	c := db.Pool.Get()
 	defer c.Close()
@@ -1046,16 +1868,87 @@ var incrementCounterScript = redis.NewScript(0, `
 
 const counterHalflife = time.Hour
 
-func (db *Database) incrementCounterInternal(key string, delta float64, t time.Time) (float64, error) {
+// counterTime returns the time scaled for decaying counters.
+func counterTime(t time.Time) float64 {
 	// nt = n0 * math.Exp(-lambda * t)
 	// lambda = math.Ln2 / thalf
+	const lambda = math.Ln2 / float64(counterHalflife)
+	return lambda * float64(t.Sub(time.Unix(1257894000, 0)))
+}
+
+func (db *Database) incrementCounterInternal(key string, delta float64, t time.Time) (float64, error) {
 	c := db.Pool.Get()
 	defer c.Close()
-	const lambda = math.Ln2 / float64(counterHalflife)
-	scaledTime := lambda * float64(t.Sub(time.Unix(1257894000, 0)))
-	return redis.Float64(incrementCounterScript.Do(c, key, delta, scaledTime, (4*counterHalflife)/time.Second))
+	return redis.Float64(incrementCounterScript.Do(c, key, delta, counterTime(t), (4*counterHalflife)/time.Second))
 }
 
 func (db *Database) IncrementCounter(key string, delta float64) (float64, error) {
 	return db.incrementCounterInternal(key, delta, time.Now())
 }
+
+// Counter is the current value of a decaying counter.
+type Counter struct {
+	Key   string  `json:"key"`
+	Value float64 `json:"value"`
+}
+
+// TopCounters returns the n counters with the largest current values.
+func (db *Database) TopCounters(n int) ([]Counter, error) {
+	return db.topCountersInternal(n, time.Now())
+}
+
+func (db *Database) topCountersInternal(n int, t time.Time) ([]Counter, error) {
+	c := db.Pool.Get()
+	defer c.Close()
+	now := counterTime(t)
+	var counters []Counter
+	cursor := 0
+	for {
+		values, err := redis.Values(c.Do("SCAN", cursor, "MATCH", "counter:*", "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return nil, err
+		}
+		if len(keys) > 0 {
+			args := make([]interface{}, len(keys))
+			for i, key := range keys {
+				args[i] = key
+			}
+			values, err := redis.Values(c.Do("MGET", args...))
+			if err != nil {
+				return nil, err
+			}
+			for i, v := range values {
+				p, _ := v.([]byte)
+				var counter struct {
+					N float64 `json:"n"`
+					T float64 `json:"t"`
+				}
+				if p == nil || json.Unmarshal(p, &counter) != nil {
+					continue
+				}
+				counters = append(counters, Counter{
+					Key:   strings.TrimPrefix(keys[i], "counter:"),
+					Value: counter.N * math.Exp(counter.T-now),
+				})
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	sort.Sort(byCounterValue(counters))
+	if len(counters) > n {
+		counters = counters[:n]
+	}
+	return counters, nil
+}
+
+type byCounterValue []Counter
+
+func (p byCounterValue) Len() int           { return len(p) }
+func (p byCounterValue) Less(i, j int) bool { return p[i].Value > p[j].Value }
+func (p byCounterValue) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
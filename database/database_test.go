@@ -80,6 +80,12 @@ func TestPutGet(t *testing.T) {
 	if !nextCrawl.Equal(actualCrawl) {
 		t.Errorf("db.Get(.../foo/bar) returned crawl %v, want %v", actualCrawl, nextCrawl)
 	}
+	if name, err := db.PackageName("github.com/user/repo/foo/bar"); err != nil || name != "bar" {
+		t.Errorf("db.PackageName(.../foo/bar) = %q, %v, want bar", name, err)
+	}
+	if name, err := db.PackageName("github.com/user/repo/foo"); err != nil || name != "" {
+		t.Errorf("db.PackageName(.../foo) = %q, %v, want empty", name, err)
+	}
 
 	before := time.Now().Unix()
 	if err := db.BumpCrawl(pdoc.ProjectRoot); err != nil {
@@ -127,6 +133,24 @@ func TestPutGet(t *testing.T) {
 	if !reflect.DeepEqual(actualImporters, expectedImporters) {
 		t.Errorf("db.Importers() = %v, want %v", actualImporters, expectedImporters)
 	}
+
+	// Reindex
+
+	var reindexed int
+	if err := db.Reindex(nil, func(n, total int) { reindexed = n }); err != nil {
+		t.Errorf("db.Reindex() returned error %v", err)
+	}
+	if reindexed != 1 {
+		t.Errorf("db.Reindex() reindexed %d packages, want 1", reindexed)
+	}
+	actualImporters, err = db.Importers("github.com/user/repo/foo/bar")
+	if err != nil {
+		t.Fatalf("db.Importers() after reindex returned error %v", err)
+	}
+	if !reflect.DeepEqual(actualImporters, expectedImporters) {
+		t.Errorf("db.Importers() after reindex = %v, want %v", actualImporters, expectedImporters)
+	}
+
 	actualImports, err := db.Packages(pdoc.Imports)
 	if err != nil {
 		t.Fatalf("db.Imports() retunred error %v", err)
@@ -144,11 +168,29 @@ func TestPutGet(t *testing.T) {
 	if importerCount != 1 {
 		t.Errorf("db.ImporterCount() = %d, want %d", importerCount, 1)
 	}
+	if err := db.PutPage("github.com/user/repo/foo/bar", "pkg.html 1", []byte("old"), time.Hour); err != nil {
+		t.Errorf("db.PutPage() returned error %v", err)
+	}
+	if err := db.PutPage("github.com/user/repo/foo/bar", "pkg.html 2", []byte("hello"), time.Hour); err != nil {
+		t.Errorf("db.PutPage() returned error %v", err)
+	}
+	page, err := db.GetPage("github.com/user/repo/foo/bar", "pkg.html 2")
+	if string(page) != "hello" || err != nil {
+		t.Errorf("db.GetPage() = %q, %v, want %q, nil", page, err, "hello")
+	}
+	page, err = db.GetPage("github.com/user/repo/foo/bar", "pkg.html 1")
+	if page != nil || err != nil {
+		t.Errorf("db.GetPage() for old generation = %q, %v, want nil, nil", page, err)
+	}
 	if err := db.Delete("github.com/user/repo/foo/bar"); err != nil {
 		t.Errorf("db.Delete() returned error %v", err)
 	}
+	page, err = db.GetPage("github.com/user/repo/foo/bar", "pkg.html 2")
+	if page != nil || err != nil {
+		t.Errorf("db.GetPage() after db.Delete() = %q, %v, want nil, nil", page, err)
+	}
 
-	db.Query("bar")
+	db.Query("bar", 0, 10, Access{})
 
 	if err := db.Put(pdoc, time.Time{}, false); err != nil {
 		t.Errorf("db.Put() returned error %v", err)
@@ -256,4 +298,33 @@ func TestCounter(t *testing.T) {
 	if math.Abs(n-2.0)/2.0 > epsilon {
 		t.Errorf("3: got n=%g, want 2", n)
 	}
+
+	counters, err := db.topCountersInternal(10, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counters) != 1 || counters[0].Key != key || math.Abs(counters[0].Value-2.0)/2.0 > epsilon {
+		t.Errorf("topCounters() = %v, want [{%s 2}]", counters, key)
+	}
+}
+
+func TestNewFacets(t *testing.T) {
+	counts := []interface{}{
+		[]byte("kind:package"), int64(4), []byte("kind:cmd"), int64(1),
+		[]byte("host:example.org"), int64(1), []byte("host:github.com"), int64(2), []byte("host:bitbucket.org"), int64(0),
+		[]byte("license:mit"), int64(2),
+		[]byte("has:examples"), int64(0),
+	}
+	expected := []Facet{
+		{Name: "kind", Values: []FacetValue{{"package", "kind:package", 4}, {"cmd", "kind:cmd", 1}}},
+		{Name: "host", Values: []FacetValue{{"github.com", "host:github.com", 2}, {"example.org", "host:example.org", 1}}},
+		{Name: "license", Values: []FacetValue{{"mit", "license:mit", 2}}},
+	}
+	facets, err := newFacets(counts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(facets, expected) {
+		t.Errorf("newFacets() = %+v, want %+v", facets, expected)
+	}
 }
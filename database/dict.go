@@ -0,0 +1,157 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package database
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/garyburd/gddo/config"
+)
+
+// searchDict is a dictionary of search term synonyms and words that are not
+// stemmed.
+type searchDict struct {
+	// synonyms maps a lowercase word to the word used for the search term.
+	synonyms map[string]string
+
+	// noStem is the set of lowercase words used as search terms without
+	// stemming.
+	noStem map[string]bool
+
+	// version is a hash of the dictionary contents or "" for the default
+	// dictionary.
+	version string
+}
+
+var defaultSearchDict = &searchDict{
+	synonyms: map[string]string{
+		"redis":    "redisdb", // append db to avoid stemming to 'red'
+		"rand":     "random",
+		"postgres": "postgresql",
+		"mongo":    "mongodb",
+	},
+	noStem: map[string]bool{},
+}
+
+// dict is the dictionary used to compute search terms.
+var dict = defaultSearchDict
+
+// parseSearchDict parses a search dictionary. Each line in the dictionary is
+// blank, a comment starting with #, or one of the directives:
+//
+//	synonym word replacement   use replacement as the term for word
+//	nostem word...             do not stem the words
+//
+// Words are not case sensitive. The synonyms are applied before the nostem
+// check, so a replacement word can be listed as a nostem word.
+//
+// The dictionary is merged with the default dictionary. A synonym directive
+// for a word in the default dictionary overrides the default replacement.
+func parseSearchDict(r io.Reader, name string) (*searchDict, error) {
+	d := &searchDict{
+		synonyms: make(map[string]string),
+		noStem:   make(map[string]bool),
+	}
+	for w, r := range defaultSearchDict.synonyms {
+		d.synonyms[w] = r
+	}
+	for w := range defaultSearchDict.noStem {
+		d.noStem[w] = true
+	}
+	err := config.Read(r, name, func(l *config.Line) error {
+		fields := l.Fields
+		for i := range fields {
+			fields[i] = strings.ToLower(fields[i])
+		}
+		switch fields[0] {
+		case "synonym":
+			if len(fields) != 3 {
+				return l.Errorf("synonym directive requires word and replacement")
+			}
+			d.synonyms[fields[1]] = fields[2]
+		case "nostem":
+			if len(fields) < 2 {
+				return l.Errorf("nostem directive requires at least one word")
+			}
+			for _, w := range fields[1:] {
+				d.noStem[w] = true
+			}
+		default:
+			return l.Errorf("unknown directive %q", fields[0])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.version = d.hash()
+	return d, nil
+}
+
+// hash returns a hash of the dictionary contents.
+func (d *searchDict) hash() string {
+	var lines []string
+	for w, r := range d.synonyms {
+		lines = append(lines, "synonym "+w+" "+r)
+	}
+	for w := range d.noStem {
+		lines = append(lines, "nostem "+w)
+	}
+	sort.Strings(lines)
+	h := sha1.New()
+	for _, line := range lines {
+		io.WriteString(h, line)
+		io.WriteString(h, "\n")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// loadSearchDict sets the search dictionary from the named file.
+func loadSearchDict(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d, err := parseSearchDict(f, name)
+	if err != nil {
+		return err
+	}
+	dict = d
+	return nil
+}
+
+// SearchDictVersion returns the version of the search dictionary. The
+// version is "" for the default dictionary. The search index must be
+// rebuilt when the version changes.
+func SearchDictVersion() string {
+	return dict.version
+}
+
+// Key for the version of the search dictionary used to build the index.
+const searchDictKey = "searchDict"
+
+// SearchDictChanged returns true if the search index was built with a
+// different search dictionary than the current dictionary.
+func (db *Database) SearchDictChanged() (bool, error) {
+	var version string
+	if err := db.GetGob(searchDictKey, &version); err != nil {
+		return false, err
+	}
+	return version != dict.version, nil
+}
+
+// PutSearchDictVersion records that the search index was built with the
+// current search dictionary.
+func (db *Database) PutSearchDictVersion() error {
+	return db.PutGob(searchDictKey, dict.version)
+}
@@ -0,0 +1,63 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package database
+
+import (
+	"strings"
+	"testing"
+)
+
+const testSearchDict = `
+# Test dictionary.
+synonym Rand random
+synonym pg postgresql
+synonym redis redis
+nostem redis postgresql
+`
+
+var searchDictTermTests = []struct {
+	word, term string
+}{
+	{"rand", "random"},
+	{"Redis", "redis"},
+	{"pg", "postgresql"},
+	{"postgres", "postgresql"},
+	{"mongo", "mongodb"},
+	{"clients", "cly"},
+}
+
+func TestSearchDict(t *testing.T) {
+	d, err := parseSearchDict(strings.NewReader(testSearchDict), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.version == "" {
+		t.Error("version is empty")
+	}
+
+	defer func() { dict = defaultSearchDict }()
+	dict = d
+	for _, tt := range searchDictTermTests {
+		if term := term(tt.word); term != tt.term {
+			t.Errorf("term(%q) = %q, want %q", tt.word, term, tt.term)
+		}
+	}
+}
+
+var badSearchDictTests = []string{
+	"synonym rand\n",
+	"nostem\n",
+	"stem redis\n",
+}
+
+func TestBadSearchDict(t *testing.T) {
+	for _, s := range badSearchDictTests {
+		if _, err := parseSearchDict(strings.NewReader(s), "test"); err == nil {
+			t.Errorf("parseSearchDict(%q) did not return error", s)
+		}
+	}
+}
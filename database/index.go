@@ -7,8 +7,10 @@
 package database
 
 import (
+	"go/ast"
 	"path"
 	"regexp"
+	"strconv"
 	"strings"
 	"unicode"
 
@@ -31,18 +33,14 @@ func normalizeProjectRoot(projectRoot string) string {
 	return projectRoot
 }
 
-var synonyms = map[string]string{
-	"redis":    "redisdb", // append db to avoid stemming to 'red'
-	"rand":     "random",
-	"postgres": "postgresql",
-	"mongo":    "mongodb",
-}
-
 func term(s string) string {
 	s = strings.ToLower(s)
-	if x, ok := synonyms[s]; ok {
+	if x, ok := dict.synonyms[s]; ok {
 		s = x
 	}
+	if dict.noStem[s] {
+		return s
+	}
 	return stem(s)
 }
 
@@ -61,6 +59,31 @@ func documentTerms(pdoc *doc.Package, score float64) []string {
 		terms["project:subrepo"] = true
 	}
 
+	// Host
+
+	if !isStandardPackage(pdoc.ImportPath) {
+		terms["host:"+importPathHost(pdoc.ImportPath)] = true
+	}
+
+	// Kind
+
+	switch {
+	case pdoc.Name == "":
+		terms["kind:directory"] = true
+	case pdoc.IsCmd:
+		terms["kind:cmd"] = true
+	default:
+		terms["kind:package"] = true
+	}
+
+	if len(pdoc.Examples) > 0 {
+		terms["has:examples"] = true
+	}
+
+	if pdoc.Private {
+		terms["is:private"] = true
+	}
+
 	// Imports
 
 	for _, path := range pdoc.Imports {
@@ -76,23 +99,41 @@ func documentTerms(pdoc *doc.Package, score float64) []string {
 				terms[term] = true
 			}
 		} else {
-			terms["all:"] = true
+			if !pdoc.IsCmd {
+				terms["all:"] = true
+			}
 			for _, term := range parseQuery(pdoc.ProjectName) {
 				terms[term] = true
 			}
-			for _, term := range parseQuery(pdoc.Name) {
+			name := pdoc.Name
+			if pdoc.IsCmd {
+				name = path.Base(pdoc.ImportPath)
+			}
+			for _, term := range parseQuery(name) {
 				terms[term] = true
 			}
 		}
 
+		// Name
+
+		terms["name:"+strings.ToLower(path.Base(pdoc.ImportPath))] = true
+
+		// License
+
+		if pdoc.License != nil {
+			terms[licenseTerm(pdoc.License)] = true
+		}
+
 		// Synopsis
 
-		synopsis := httpPat.ReplaceAllLiteralString(pdoc.Synopsis, "")
-		for i, s := range strings.FieldsFunc(synopsis, isTermSep) {
-			s = strings.ToLower(s)
-			if !stopWord[s] && (i > 3 || s != "package") {
-				terms[term(s)] = true
-			}
+		for _, term := range synopsisTerms(pdoc.Synopsis) {
+			terms[term] = true
+		}
+
+		// Identifiers
+
+		for _, name := range exportedNames(pdoc) {
+			terms[term(name)] = true
 		}
 	}
 
@@ -103,9 +144,96 @@ func documentTerms(pdoc *doc.Package, score float64) []string {
 	return result
 }
 
+// synopsisTerms returns the search terms for a package synopsis.
+func synopsisTerms(synopsis string) []string {
+	var terms []string
+	synopsis = httpPat.ReplaceAllLiteralString(synopsis, "")
+	for i, s := range strings.FieldsFunc(synopsis, isTermSep) {
+		s = strings.ToLower(s)
+		if !stopWord[s] && (i > 3 || s != "package") {
+			terms = append(terms, term(s))
+		}
+	}
+	return terms
+}
+
+// exportedNames returns the names of the exported top-level functions and
+// types in the package.
+func exportedNames(pdoc *doc.Package) []string {
+	var names []string
+	for _, f := range pdoc.Funcs {
+		if ast.IsExported(f.Name) {
+			names = append(names, f.Name)
+		}
+	}
+	for _, t := range pdoc.Types {
+		if ast.IsExported(t.Name) {
+			names = append(names, t.Name)
+		}
+	}
+	return names
+}
+
+// Minimum and maximum length of words in the vocabulary.
+const (
+	minWordLen = 3
+	maxWordLen = 32
+)
+
+// documentWords returns the vocabulary words for a document. The words are
+// the lowercase words in the package path, name, synopsis and identifiers
+// that are indexed as search terms. The vocabulary is used to correct and
+// complete search queries for all users, so private packages do not add
+// words.
+func documentWords(pdoc *doc.Package, score float64) []string {
+	if score <= 0 || pdoc.Private {
+		return nil
+	}
+	var text []string
+	if isStandardPackage(pdoc.ImportPath) {
+		text = append(text, pdoc.ImportPath)
+	} else {
+		text = append(text, pdoc.ProjectName, path.Base(pdoc.ImportPath))
+	}
+	text = append(text, pdoc.Name, httpPat.ReplaceAllLiteralString(pdoc.Synopsis, ""))
+	text = append(text, exportedNames(pdoc)...)
+
+	words := make(map[string]bool)
+	for _, s := range text {
+		for _, w := range strings.FieldsFunc(strings.ToLower(s), isTermSep) {
+			if isVocabularyWord(w) {
+				words[w] = true
+			}
+		}
+	}
+
+	result := make([]string, 0, len(words))
+	for w := range words {
+		result = append(result, w)
+	}
+	return result
+}
+
+// isVocabularyWord returns true if lowercase word w is a candidate for
+// corrections and completions.
+func isVocabularyWord(w string) bool {
+	if len(w) < minWordLen || len(w) > maxWordLen || stopWord[w] {
+		return false
+	}
+	for _, r := range w {
+		if r < 'a' || r > 'z' {
+			if r < '0' || r > '9' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// documentScore returns the search score for a package or command. Documents
+// with a zero score are not returned in search results.
 func documentScore(pdoc *doc.Package) float64 {
 	if pdoc.Name == "" ||
-		pdoc.IsCmd ||
 		len(pdoc.Errors) > 0 ||
 		strings.HasSuffix(pdoc.ImportPath, ".go") ||
 		strings.HasPrefix(pdoc.ImportPath, "gist.github.com/") {
@@ -118,7 +246,8 @@ func documentScore(pdoc *doc.Package) float64 {
 		}
 	}
 
-	if !pdoc.Truncated &&
+	if !pdoc.IsCmd &&
+		!pdoc.Truncated &&
 		len(pdoc.Consts) == 0 &&
 		len(pdoc.Vars) == 0 &&
 		len(pdoc.Funcs) == 0 &&
@@ -131,7 +260,7 @@ func documentScore(pdoc *doc.Package) float64 {
 	if pdoc.Doc == "" || pdoc.Synopsis == "" {
 		r *= 0.95
 	}
-	if path.Base(pdoc.ImportPath) != pdoc.Name {
+	if path.Base(pdoc.ImportPath) != pdoc.Name && !pdoc.IsCmd {
 		r *= 0.9
 	}
 	for i := 0; i < strings.Count(pdoc.ImportPath[len(pdoc.ProjectRoot):], "/"); i++ {
@@ -143,6 +272,183 @@ func documentScore(pdoc *doc.Package) float64 {
 	return r
 }
 
+// licenseTerm returns the search term for a license.
+func licenseTerm(l *doc.License) string {
+	if l.ID == "" {
+		return "license:unknown"
+	}
+	return "license:" + strings.ToLower(l.ID)
+}
+
+// importPathHost returns the host in a remote import path.
+func importPathHost(importPath string) string {
+	if i := strings.Index(importPath, "/"); i >= 0 {
+		importPath = importPath[:i]
+	}
+	return strings.ToLower(importPath)
+}
+
+// searchQuery is a parsed search query.
+type searchQuery struct {
+	// Index terms required in the results.
+	terms []string
+
+	// Index terms excluded from the results.
+	excluded []string
+
+	// Lists of import path prefixes for packages hidden from the results.
+	// The packages under the first prefix in a list minus the packages under
+	// the remaining prefixes are hidden.
+	hidden [][]string
+
+	// Text of the query with the filters removed.
+	text string
+
+	// Filters in the query, excluding negated filters.
+	filters []string
+
+	// Minimum number of importers for results.
+	minImporters int
+
+	// True if the query has a kind filter.
+	hasKind bool
+}
+
+// searchFilters maps filter names to functions that return the index term
+// for a filter value or "" if the value is not valid.
+var searchFilters = map[string]func(string) string{
+	"project": func(v string) string { return "project:" + v },
+	"host":    func(v string) string { return "host:" + strings.ToLower(v) },
+	"imports": func(v string) string { return "import:" + v },
+	"license": func(v string) string { return "license:" + strings.ToLower(v) },
+	"kind": func(v string) string {
+		switch strings.ToLower(v) {
+		case "cmd", "command":
+			return "kind:cmd"
+		case "pkg", "package":
+			return "kind:package"
+		}
+		return ""
+	},
+	"has": func(v string) string {
+		if strings.ToLower(v) == "examples" {
+			return "has:examples"
+		}
+		return ""
+	},
+}
+
+// parseSearchQuery parses a search query. Words in the query with the form
+// name:value are filters. A word or filter prefixed with "-" excludes
+// results matching the word or filter. The filters are:
+//
+//	project:root       packages in project with root
+//	host:name          packages hosted at name
+//	kind:cmd           commands instead of packages
+//	imports:path       packages importing path
+//	license:id         packages with the license
+//	has:examples       packages with examples
+//	min-importers:N    packages with at least N importers
+func parseSearchQuery(q string) *searchQuery {
+	sq := &searchQuery{}
+	var words []string
+	for _, w := range strings.Fields(q) {
+		exclude := len(w) > 1 && w[0] == '-'
+		if exclude {
+			w = w[1:]
+		}
+		if i := strings.Index(w, ":"); i > 0 && i < len(w)-1 {
+			name, value := strings.ToLower(w[:i]), w[i+1:]
+			if name == "min-importers" {
+				if n, err := strconv.Atoi(value); err == nil && !exclude {
+					sq.minImporters = n
+					sq.filters = append(sq.filters, name+":"+value)
+				}
+				continue
+			}
+			if f, ok := searchFilters[name]; ok {
+				if term := f(value); term != "" {
+					if exclude {
+						sq.excluded = append(sq.excluded, term)
+					} else {
+						sq.terms = append(sq.terms, term)
+						sq.filters = append(sq.filters, name+":"+value)
+						sq.hasKind = sq.hasKind || name == "kind"
+					}
+				}
+				continue
+			}
+		}
+		if exclude {
+			sq.excluded = append(sq.excluded, parseQuery(w)...)
+		} else {
+			words = append(words, w)
+		}
+	}
+	sq.text = strings.Join(words, " ")
+	sq.terms = append(sq.terms, parseQuery(sq.text)...)
+	return sq
+}
+
+// nameTerm returns the name term used to boost results with a name equal to
+// the query or "" if the query cannot match a name.
+func (sq *searchQuery) nameTerm() string {
+	if sq.text == "" || strings.ContainsAny(sq.text, " \t") {
+		return ""
+	}
+	return strings.ToLower(path.Base(sq.text))
+}
+
+// reasons returns descriptions of why the package with the given import
+// path and synopsis matches the query.
+func (sq *searchQuery) reasons(importPath, synopsis string) []string {
+	var reasons []string
+	seen := make(map[string]bool)
+	add := func(reason string) {
+		if !seen[reason] {
+			seen[reason] = true
+			reasons = append(reasons, reason)
+		}
+	}
+	if name := sq.nameTerm(); name != "" && strings.ToLower(path.Base(importPath)) == name {
+		if isStandardPackage(importPath) {
+			add("standard package name")
+		} else {
+			add("package name")
+		}
+	}
+	inName := make(map[string]bool)
+	for _, t := range parseQuery(path.Base(importPath)) {
+		inName[t] = true
+	}
+	inSynopsis := make(map[string]bool)
+	for _, t := range synopsisTerms(synopsis) {
+		inSynopsis[t] = true
+	}
+	inPath := make(map[string]bool)
+	for _, t := range parseQuery(importPath) {
+		inPath[t] = true
+	}
+	for _, w := range strings.Fields(sq.text) {
+		for _, t := range parseQuery(w) {
+			switch {
+			case inName[t]:
+				add("name:" + w)
+			case inSynopsis[t]:
+				add("synopsis:" + w)
+			case inPath[t]:
+				add("path:" + w)
+			default:
+				add("project:" + w)
+			}
+		}
+	}
+	for _, f := range sq.filters {
+		add(f)
+	}
+	return reasons
+}
+
 func parseQuery(q string) []string {
 	var terms []string
 	q = strings.ToLower(q)
@@ -153,3 +459,13 @@ func parseQuery(q string) []string {
 	}
 	return terms
 }
+
+// restrict limits the search results to the packages allowed by access.
+func (sq *searchQuery) restrict(access Access) {
+	if !access.Private {
+		sq.excluded = append(sq.excluded, "is:private")
+	}
+	for _, h := range access.Hidden {
+		sq.hidden = append(sq.hidden, append([]string{h.Prefix}, h.Except...))
+	}
+}
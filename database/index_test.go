@@ -34,6 +34,8 @@ var indexTests = []struct {
 			"import:errors",
 			"import:math",
 			"import:unicode/utf8",
+			"kind:package",
+			"name:strconv",
 			"project:go",
 			"repres",
 			"strconv",
@@ -73,16 +75,31 @@ var indexTests = []struct {
 		},
 		TestImports: []string{"bytes", "net/url", "testing"},
 		Funcs:       []*doc.Func{{}},
+		License:     &doc.License{ID: "BSD-3-Clause", File: "LICENSE"},
 	},
 		[]string{
 			"all:",
-			"5849", "cly", "defin", "dir", "go",
+			"5849", "cly", "defin", "dir", "go", "host:github.com", "kind:package", "name:dir",
 			"import:bytes", "import:crypto/hmac", "import:crypto/sha1",
 			"import:encoding/base64", "import:encoding/binary", "import:errors",
 			"import:fmt", "import:io", "import:io/ioutil", "import:net/http",
 			"import:net/url", "import:regexp", "import:sort", "import:strconv",
 			"import:strings", "import:sync", "import:time", "interfac",
-			"oau", "project:github.com/user/repo", "rfc", "subset",
+			"license:bsd-3-clause", "oau", "project:github.com/user/repo", "rfc", "subset",
+		},
+	},
+	{&doc.Package{
+		ImportPath:  "github.com/corp/secret",
+		ProjectRoot: "github.com/corp/secret",
+		ProjectName: "secret",
+		Name:        "secret",
+		Synopsis:    "Package secret keeps secrets.",
+		Funcs:       []*doc.Func{{}},
+		Private:     true,
+	},
+		[]string{
+			"all:", "host:github.com", "is:private", "keep", "kind:package",
+			"name:secret", "project:github.com/corp/secret", "secret",
 		},
 	},
 }
@@ -98,3 +115,92 @@ func TestDocTerms(t *testing.T) {
 		}
 	}
 }
+
+func TestDocumentWords(t *testing.T) {
+	pdoc := &doc.Package{
+		ImportPath:  "github.com/user/websocket",
+		ProjectRoot: "github.com/user/websocket",
+		ProjectName: "websocket",
+		Name:        "websocket",
+		Synopsis:    "Package websocket implements the WebSocket protocol, see http://example.com/rfc.",
+		Funcs:       []*doc.Func{{Name: "Dial"}, {Name: "newConn"}},
+		Types:       []*doc.Type{{Name: "Conn"}},
+	}
+	words := documentWords(pdoc, documentScore(pdoc))
+	sort.Strings(words)
+	expected := []string{"conn", "dial", "package", "protocol", "websocket"}
+	if !reflect.DeepEqual(words, expected) {
+		t.Errorf("documentWords() = %q, want %q", words, expected)
+	}
+	if words := documentWords(pdoc, 0); words != nil {
+		t.Errorf("documentWords(score=0) = %q, want nil", words)
+	}
+	pdoc.Private = true
+	if words := documentWords(pdoc, documentScore(pdoc)); words != nil {
+		t.Errorf("documentWords(private) = %q, want nil", words)
+	}
+}
+
+var parseSearchQueryTests = []struct {
+	q  string
+	sq searchQuery
+}{
+	{"oauth client", searchQuery{terms: []string{"oau", "cly"}, text: "oauth client"}},
+	{"License:MIT oauth", searchQuery{terms: []string{"license:mit", "oau"}, text: "oauth", filters: []string{"license:MIT"}}},
+	{"kind:cmd host:GitHub.com has:examples imports:net/http",
+		searchQuery{
+			terms:   []string{"kind:cmd", "host:github.com", "has:examples", "import:net/http"},
+			filters: []string{"kind:cmd", "host:GitHub.com", "has:examples", "imports:net/http"},
+			hasKind: true,
+		}},
+	{"json -host:github.com -xml min-importers:10",
+		searchQuery{
+			terms:        []string{"json"},
+			excluded:     []string{"host:github.com", "xml"},
+			text:         "json",
+			filters:      []string{"min-importers:10"},
+			minImporters: 10,
+		}},
+	{"kind:other license: oauth", searchQuery{terms: []string{"licens", "oau"}, text: "license: oauth"}},
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	for _, tt := range parseSearchQueryTests {
+		sq := parseSearchQuery(tt.q)
+		if !reflect.DeepEqual(*sq, tt.sq) {
+			t.Errorf("parseSearchQuery(%q) = %+v, want %+v", tt.q, *sq, tt.sq)
+		}
+	}
+}
+
+func TestRestrict(t *testing.T) {
+	sq := parseSearchQuery("secret")
+	sq.restrict(Access{Hidden: []HiddenPrefix{{Prefix: "corp.example.com", Except: []string{"corp.example.com/docs"}}}})
+	if expected := []string{"is:private"}; !reflect.DeepEqual(sq.excluded, expected) {
+		t.Errorf("excluded = %v, want %v", sq.excluded, expected)
+	}
+	if expected := [][]string{{"corp.example.com", "corp.example.com/docs"}}; !reflect.DeepEqual(sq.hidden, expected) {
+		t.Errorf("hidden = %v, want %v", sq.hidden, expected)
+	}
+}
+
+var searchReasonsTests = []struct {
+	q, path, synopsis string
+	reasons           []string
+}{
+	{"http", "net/http", "Package http provides HTTP client and server implementations.",
+		[]string{"standard package name", "name:http"}},
+	{"oauth client license:mit", "github.com/user/go-oauth/oauth", "Package oauth implements a subset of the OAuth client interface.",
+		[]string{"name:oauth", "synopsis:client", "license:mit"}},
+	{"user", "github.com/user/repo/dir", "", []string{"path:user"}},
+	{"gopher", "github.com/user/repo/dir", "", []string{"project:gopher"}},
+}
+
+func TestSearchReasons(t *testing.T) {
+	for _, tt := range searchReasonsTests {
+		reasons := parseSearchQuery(tt.q).reasons(tt.path, tt.synopsis)
+		if !reflect.DeepEqual(reasons, tt.reasons) {
+			t.Errorf("reasons(%q, %q) = %q, want %q", tt.q, tt.path, reasons, tt.reasons)
+		}
+	}
+}
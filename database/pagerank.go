@@ -0,0 +1,194 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package database
+
+import (
+	"math"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// Probability that a random walk of the import graph follows an import.
+	pageRankDamping = 0.85
+
+	// Maximum number of PageRank iterations.
+	pageRankIterations = 50
+
+	// PageRank iterations stop when the sum of the changes is less than
+	// this value.
+	pageRankTolerance = 1e-6
+)
+
+// pageRank returns the PageRank of the nodes in a directed graph. Edges[i]
+// is the list of nodes linked from node i. The rank of nodes with no
+// outgoing links is not redistributed, so the ranks sum to at most one and
+// a node with no incoming links has rank (1 - damping) / n.
+func pageRank(edges [][]int) []float64 {
+	n := len(edges)
+	if n == 0 {
+		return nil
+	}
+	pr := make([]float64, n)
+	next := make([]float64, n)
+	for i := range pr {
+		pr[i] = 1 / float64(n)
+	}
+	for iter := 0; iter < pageRankIterations; iter++ {
+		for i := range next {
+			next[i] = 0
+		}
+		for i, links := range edges {
+			if len(links) > 0 {
+				share := pageRankDamping * pr[i] / float64(len(links))
+				for _, j := range links {
+					next[j] += share
+				}
+			}
+		}
+		base := (1 - pageRankDamping) / float64(n)
+		diff := 0.0
+		for i := range next {
+			next[i] += base
+			diff += math.Abs(next[i] - pr[i])
+		}
+		pr, next = next, pr
+		if diff < pageRankTolerance {
+			break
+		}
+	}
+	return pr
+}
+
+// importRanks returns the PageRank of the import graph scaled to an
+// effective importer count. A package with no importers has a count of
+// zero. Each importer with no importers of its own adds the damping factor
+// divided by the number of packages it imports to the count. Importers
+// that are widely used add more to the count.
+func importRanks(edges [][]int) []float64 {
+	pr := pageRank(edges)
+	scale := float64(len(edges)) / (1 - pageRankDamping)
+	for i := range pr {
+		pr[i] = math.Max(0, pr[i]*scale-1)
+	}
+	return pr
+}
+
+// loadImportGraph returns the package ids and the import graph for the
+// packages in the database. Edges[i] is the list of packages imported by
+// the package with id ids[i].
+func (db *Database) loadImportGraph(c redis.Conn) (ids []string, edges [][]int, err error) {
+	index := make(map[string]int)
+	var imports [][]string
+	cursor := 0
+	for {
+		values, err := redis.Values(c.Do("SCAN", cursor, "MATCH", "pkg:*", "COUNT", 1000))
+		if err != nil {
+			return nil, nil, err
+		}
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return nil, nil, err
+		}
+		for _, key := range keys {
+			c.Send("HMGET", key, "path", "terms")
+		}
+		c.Flush()
+		for _, key := range keys {
+			values, err := redis.Values(c.Receive())
+			if err != nil {
+				return nil, nil, err
+			}
+			var path, terms string
+			if _, err := redis.Scan(values, &path, &terms); err != nil {
+				return nil, nil, err
+			}
+			if path == "" {
+				continue
+			}
+			var paths []string
+			for _, term := range strings.Fields(terms) {
+				if strings.HasPrefix(term, "import:") {
+					paths = append(paths, term[len("import:"):])
+				}
+			}
+			index[path] = len(ids)
+			ids = append(ids, strings.TrimPrefix(key, "pkg:"))
+			imports = append(imports, paths)
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+
+	edges = make([][]int, len(ids))
+	for i, paths := range imports {
+		for _, path := range paths {
+			if j, ok := index[path]; ok && j != i {
+				edges[i] = append(edges[i], j)
+			}
+		}
+	}
+	return ids, edges, nil
+}
+
+var updateRankScript = redis.NewScript(0, searchIndexLua+`
+    for i=1,#ARGV do
+        updateRank(ARGV[i])
+    end
+`)
+
+// Number of packages in a batch of import rank updates.
+const importRankBatchSize = 1000
+
+// UpdateImportRanks computes the PageRank of the import graph, stores the
+// rank for each package and updates the search ranks using the new values.
+// Packages added since the last update are ranked as packages with no
+// importers.
+func (db *Database) UpdateImportRanks() error {
+	c := db.Pool.Get()
+	defer c.Close()
+
+	ids, edges, err := db.loadImportGraph(c)
+	if err != nil {
+		return err
+	}
+	ranks := importRanks(edges)
+
+	const tmp = "pagerank:new"
+	if _, err := c.Do("DEL", tmp); err != nil {
+		return err
+	}
+	for i := 0; i < len(ids); i += importRankBatchSize {
+		args := []interface{}{tmp}
+		for j := i; j < len(ids) && j < i+importRankBatchSize; j++ {
+			args = append(args, ranks[j], ids[j])
+		}
+		if _, err := c.Do("ZADD", args...); err != nil {
+			return err
+		}
+	}
+	if len(ids) == 0 {
+		_, err := c.Do("DEL", "pagerank")
+		return err
+	}
+	if _, err := c.Do("RENAME", tmp, "pagerank"); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(ids); i += importRankBatchSize {
+		var args []interface{}
+		for j := i; j < len(ids) && j < i+importRankBatchSize; j++ {
+			args = append(args, ids[j])
+		}
+		if _, err := updateRankScript.Do(c, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
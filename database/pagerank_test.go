@@ -0,0 +1,52 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package database
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPageRank(t *testing.T) {
+	// 0 and 1 import 2. 2 imports 3. 4 imports nothing and is not imported.
+	edges := [][]int{{2}, {2}, {3}, nil, nil}
+	pr := pageRank(edges)
+	sum := 0.0
+	for _, r := range pr {
+		sum += r
+	}
+	if sum > 1 {
+		t.Errorf("sum of ranks = %g, want at most 1", sum)
+	}
+	if pr[0] != pr[1] || pr[0] != pr[4] {
+		t.Errorf("ranks of packages with no importers differ: %v", pr)
+	}
+	if !(pr[3] > pr[2] && pr[2] > pr[0]) {
+		t.Errorf("ranks not ordered by transitive use: %v", pr)
+	}
+}
+
+func TestImportRanks(t *testing.T) {
+	// Packages 1 through 10 import only package 0. Package 11 is imported
+	// by package 0 only. Package 12 is imported by package 1 only.
+	edges := make([][]int, 13)
+	for i := 1; i <= 10; i++ {
+		edges[i] = []int{0}
+	}
+	edges[0] = []int{11}
+	edges[1] = append(edges[1], 12)
+	ranks := importRanks(edges)
+	if ranks[2] > 1e-6 {
+		t.Errorf("rank of package with no importers = %g, want 0", ranks[2])
+	}
+	if math.Abs(ranks[0]-9.5*pageRankDamping) > 1e-3 {
+		t.Errorf("rank of package with 10 direct importers = %g, want %g", ranks[0], 9.5*pageRankDamping)
+	}
+	if ranks[11] <= 5*ranks[12] {
+		t.Errorf("rank of package imported by widely used package = %g, rank of package imported by unused package = %g", ranks[11], ranks[12])
+	}
+}
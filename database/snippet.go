@@ -0,0 +1,216 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package database
+
+import (
+	"go/ast"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+// Snippet is an excerpt of package documentation that matches a search
+// query.
+type Snippet struct {
+	// Name of the documented identifier or "" for the package
+	// documentation. Methods are named Type.Method.
+	Name string `json:"name,omitempty"`
+
+	// Text of the excerpt.
+	Text string `json:"text"`
+
+	// Byte offsets of the start and end of the matched words in Text.
+	Highlights [][2]int `json:"highlights,omitempty"`
+}
+
+const (
+	// Maximum length of snippet text, excluding ellipses.
+	maxSnippetLen = 200
+
+	// Length of text included before the first match in a snippet.
+	snippetContextLen = 60
+
+	// Number of results on a page with snippets.
+	maxSnippets = 20
+)
+
+// wordSpans returns the byte offsets of the words in s.
+func wordSpans(s string) [][2]int {
+	var spans [][2]int
+	start := -1
+	for i, r := range s {
+		if isTermSep(r) {
+			if start >= 0 {
+				spans = append(spans, [2]int{start, i})
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, [2]int{start, len(s)})
+	}
+	return spans
+}
+
+// snippetCandidate is documentation that can be used for a snippet.
+type snippetCandidate struct {
+	name    string
+	text    string
+	matches [][2]int
+	score   int
+}
+
+func newSnippetCandidate(name, text string, terms map[string]bool) *snippetCandidate {
+	sc := &snippetCandidate{name: name, text: text}
+	matched := make(map[string]bool)
+	for _, span := range wordSpans(text) {
+		if t := term(text[span[0]:span[1]]); terms[t] {
+			sc.matches = append(sc.matches, span)
+			matched[t] = true
+		}
+	}
+	sc.score = len(matched)
+	if name != "" {
+		if i := strings.LastIndex(name, "."); i >= 0 {
+			name = name[i+1:]
+		}
+		if terms[term(name)] {
+			sc.score += 2
+		}
+	}
+	return sc
+}
+
+// snippet returns the snippet for the candidate.
+func (sc *snippetCandidate) snippet() *Snippet {
+	start, end := 0, len(sc.text)
+	if len(sc.matches) > 0 && sc.matches[0][0] > snippetContextLen {
+		start = sc.matches[0][0] - snippetContextLen
+		// Start at the beginning of a word.
+		if i := strings.IndexFunc(sc.text[start:], unicode.IsSpace); i >= 0 && start+i < sc.matches[0][0] {
+			start += i + 1
+		}
+	}
+	if end-start > maxSnippetLen {
+		end = start + maxSnippetLen
+		// End at the end of a word.
+		if i := strings.LastIndexFunc(sc.text[start:end], unicode.IsSpace); i > 0 {
+			end = start + i
+		} else {
+			for end > start && !utf8.RuneStart(sc.text[end]) {
+				end--
+			}
+		}
+	}
+
+	s := &Snippet{Name: sc.name, Text: sc.text[start:end]}
+	offset := -start
+	if start > 0 {
+		s.Text = "..." + s.Text
+		offset += len("...")
+	}
+	if end < len(sc.text) {
+		s.Text += "..."
+	}
+	for _, m := range sc.matches {
+		if m[0] >= start && m[1] <= end {
+			s.Highlights = append(s.Highlights, [2]int{m[0] + offset, m[1] + offset})
+		}
+	}
+	return s
+}
+
+// normalizeSpace replaces runs of white space in s with a single space.
+func normalizeSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// Maximum size of the snippet text stored for a package.
+const maxSnippetTextSize = 16000
+
+// snippetText returns the compact excerpt of the package documentation
+// stored in the database for computing snippets. The excerpt is the package
+// documentation without the part that repeats the synopsis followed by the
+// documentation for the exported identifiers, one "name\ttext" line per
+// documented item with white space in the text normalized. Items that do not
+// fit in maxSnippetTextSize bytes are dropped.
+func snippetText(pdoc *doc.Package) string {
+	var buf []byte
+	add := func(name, text string) {
+		text = normalizeSpace(text)
+		if text == "" || len(buf)+len(name)+len(text)+2 > maxSnippetTextSize {
+			return
+		}
+		buf = append(buf, name...)
+		buf = append(buf, '\t')
+		buf = append(buf, text...)
+		buf = append(buf, '\n')
+	}
+
+	text := normalizeSpace(pdoc.Doc)
+	if synopsis := normalizeSpace(pdoc.Synopsis); strings.HasPrefix(text, synopsis) {
+		text = strings.TrimSpace(text[len(synopsis):])
+	}
+	add("", text)
+
+	for _, f := range pdoc.Funcs {
+		if ast.IsExported(f.Name) {
+			add(f.Name, f.Doc)
+		}
+	}
+	for _, t := range pdoc.Types {
+		if !ast.IsExported(t.Name) {
+			continue
+		}
+		add(t.Name, t.Doc)
+		for _, f := range t.Funcs {
+			if ast.IsExported(f.Name) {
+				add(f.Name, f.Doc)
+			}
+		}
+		for _, m := range t.Methods {
+			if ast.IsExported(m.Name) {
+				add(t.Name+"."+m.Name, m.Doc)
+			}
+		}
+	}
+	return string(buf)
+}
+
+// newSnippet returns the snippet from the item in the excerpt returned by
+// snippetText that best matches the search terms. If no item matches the
+// terms, then nil is returned.
+func newSnippet(text string, terms map[string]bool) *Snippet {
+	var best *snippetCandidate
+	for _, line := range strings.Split(text, "\n") {
+		i := strings.IndexByte(line, '\t')
+		if i < 0 {
+			continue
+		}
+		if sc := newSnippetCandidate(line[:i], line[i+1:], terms); sc.score > 0 && (best == nil || sc.score > best.score) {
+			best = sc
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return best.snippet()
+}
+
+// snippetTerms returns the set of search terms in the query text used to
+// select and highlight snippets.
+func (sq *searchQuery) snippetTerms() map[string]bool {
+	terms := make(map[string]bool)
+	for _, t := range parseQuery(sq.text) {
+		terms[t] = true
+	}
+	return terms
+}
@@ -0,0 +1,91 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package database
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+var snippetPackage = &doc.Package{
+	ImportPath: "example.com/json",
+	Name:       "json",
+	Synopsis:   "Package json implements encoding and decoding of JSON objects.",
+	Doc: "Package json implements encoding and decoding of JSON objects.\n\n" +
+		"The mapping between JSON objects and Go values\nis described in the documentation for the Marshal function.",
+	Funcs: []*doc.Func{
+		{Name: "Marshal", Doc: "Marshal returns the JSON encoding of v."},
+		{Name: "indent", Doc: "indent streams values."},
+	},
+	Types: []*doc.Type{{
+		Name:    "Decoder",
+		Doc:     "A Decoder reads and decodes JSON values from an input stream.",
+		Methods: []*doc.Func{{Name: "Buffered", Doc: "Buffered returns a reader of the data remaining in the Decoder's buffer."}},
+	}},
+}
+
+var snippetTests = []struct {
+	q       string
+	snippet *Snippet
+}{
+	{"mapping", &Snippet{
+		Text:       "The mapping between JSON objects and Go values is described in the documentation for the Marshal function.",
+		Highlights: [][2]int{{4, 11}},
+	}},
+	{"decoder stream", &Snippet{
+		Name:       "Decoder",
+		Text:       "A Decoder reads and decodes JSON values from an input stream.",
+		Highlights: [][2]int{{2, 9}, {20, 27}, {54, 60}},
+	}},
+	{"buffered", &Snippet{
+		Name:       "Decoder.Buffered",
+		Text:       "Buffered returns a reader of the data remaining in the Decoder's buffer.",
+		Highlights: [][2]int{{0, 8}, {65, 71}},
+	}},
+	{"indent", nil},
+	{"xml", nil},
+}
+
+func TestSnippet(t *testing.T) {
+	for _, tt := range snippetTests {
+		s := newSnippet(snippetText(snippetPackage), parseSearchQuery(tt.q).snippetTerms())
+		if !reflect.DeepEqual(s, tt.snippet) {
+			t.Errorf("newSnippet(%q) = %+v, want %+v", tt.q, s, tt.snippet)
+		}
+	}
+}
+
+func TestLongSnippet(t *testing.T) {
+	text := strings.Repeat("lorem ipsum ", 20) + "gopher " + strings.Repeat("dolor sit ", 30)
+	pdoc := &doc.Package{ImportPath: "example.com/p", Name: "p", Doc: text}
+	s := newSnippet(snippetText(pdoc), parseSearchQuery("gopher").snippetTerms())
+	if s == nil {
+		t.Fatal("no snippet")
+	}
+	if !strings.HasPrefix(s.Text, "...") || !strings.HasSuffix(s.Text, "...") {
+		t.Errorf("snippet %q does not have ellipses", s.Text)
+	}
+	if len(s.Highlights) != 1 || s.Text[s.Highlights[0][0]:s.Highlights[0][1]] != "gopher" {
+		t.Errorf("snippet %q has highlights %v, want gopher", s.Text, s.Highlights)
+	}
+	if n := len(s.Text) - 2*len("..."); n > maxSnippetLen {
+		t.Errorf("snippet length %d, want at most %d", n, maxSnippetLen)
+	}
+}
+
+func TestSnippetTextSize(t *testing.T) {
+	pdoc := &doc.Package{ImportPath: "example.com/p", Name: "p", Doc: strings.Repeat("lorem ipsum ", 1000)}
+	for i := 0; i < 1000; i++ {
+		pdoc.Funcs = append(pdoc.Funcs, &doc.Func{Name: "Func", Doc: strings.Repeat("dolor sit ", 10)})
+	}
+	if n := len(snippetText(pdoc)); n > maxSnippetTextSize {
+		t.Errorf("snippet text size %d, want at most %d", n, maxSnippetTextSize)
+	}
+}
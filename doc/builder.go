@@ -12,9 +12,12 @@ import (
 	"go/ast"
 	"go/build"
 	"go/doc"
+	"go/doc/comment"
 	"go/format"
 	"go/parser"
 	"go/token"
+	"go/types"
+	"net/http"
 	"regexp"
 	"sort"
 	"strings"
@@ -149,21 +152,38 @@ type builder struct {
 	fset     *token.FileSet
 	examples []*doc.Example
 	buf      []byte // scratch space for printNode method.
+	info     *types.Info
+	tpkg     *types.Package
+	decls    map[types.Object]*Decl
+
+	// Package names for import paths found by resolveImports.
+	importNames map[string]string
+
+	// Parser for doc comments. The parser resolves doc links to the
+	// declarations and imports of the package.
+	parser *comment.Parser
+}
+
+// comment parses a doc comment.
+func (b *builder) comment(text string) *Comment {
+	return ParseComment(b.parser, text)
 }
 
 type Value struct {
-	Decl Code
-	Pos  Pos
-	Doc  string
+	Decl    Code
+	Pos     Pos
+	Doc     string
+	Comment *Comment
 }
 
 func (b *builder) values(vdocs []*doc.Value) []*Value {
 	var result []*Value
 	for _, d := range vdocs {
 		result = append(result, &Value{
-			Decl: b.printDecl(d.Decl),
-			Pos:  b.position(d.Decl),
-			Doc:  d.Doc,
+			Decl:    b.printDecl(d.Decl),
+			Pos:     b.position(d.Decl),
+			Doc:     d.Doc,
+			Comment: b.comment(d.Doc),
 		})
 	}
 	return result
@@ -200,11 +220,12 @@ func (b *builder) notes(gnotes map[string][]*doc.Note) map[string][]*Note {
 }
 
 type Example struct {
-	Name   string
-	Doc    string
-	Code   Code
-	Play   string
-	Output string
+	Name    string
+	Doc     string
+	Comment *Comment
+	Code    Code
+	Play    string
+	Output  string
 }
 
 var exampleOutputRx = regexp.MustCompile(`(?i)//[[:space:]]*output:`)
@@ -240,11 +261,12 @@ func (b *builder) getExamples(name string) []*Example {
 		}
 
 		docs = append(docs, &Example{
-			Name:   n,
-			Doc:    e.Doc,
-			Code:   code,
-			Output: output,
-			Play:   play})
+			Name:    n,
+			Doc:     e.Doc,
+			Comment: b.comment(e.Doc),
+			Code:    code,
+			Output:  output,
+			Play:    play})
 	}
 	return docs
 }
@@ -253,11 +275,12 @@ type Func struct {
 	Decl     Code
 	Pos      Pos
 	Doc      string
+	Comment  *Comment
 	Name     string
 	Recv     string
 	Examples []*Example
 	Source   []byte
-	FileName  string
+	FileName string
 	Line     int
 }
 
@@ -278,6 +301,7 @@ func (b *builder) funcs(fdocs []*doc.Func) []*Func {
 			Decl:     b.printDecl(d.Decl),
 			Pos:      b.position(d.Decl),
 			Doc:      d.Doc,
+			Comment:  b.comment(d.Doc),
 			Name:     d.Name,
 			Recv:     d.Recv,
 			Examples: b.getExamples(exampleName),
@@ -291,6 +315,7 @@ func (b *builder) funcs(fdocs []*doc.Func) []*Func {
 
 type Type struct {
 	Doc      string
+	Comment  *Comment
 	Name     string
 	Decl     Code
 	Pos      Pos
@@ -299,6 +324,17 @@ type Type struct {
 	Funcs    []*Func
 	Methods  []*Func
 	Examples []*Example
+
+	// Promoted is the exported methods promoted from embedded fields that
+	// are not listed in Methods.
+	Promoted []*PromotedMethod
+
+	// Implements is the interfaces implemented by the type.
+	Implements []*TypeRef
+
+	// ImplementedBy is the types in the package that implement the type. The
+	// field is set for interface types only.
+	ImplementedBy []*TypeRef
 }
 
 func (b *builder) types(tdocs []*doc.Type) []*Type {
@@ -306,6 +342,7 @@ func (b *builder) types(tdocs []*doc.Type) []*Type {
 	for _, d := range tdocs {
 		result = append(result, &Type{
 			Doc:      d.Doc,
+			Comment:  b.comment(d.Doc),
 			Name:     d.Name,
 			Decl:     b.printDecl(d.Decl),
 			Pos:      b.position(d.Decl),
@@ -335,6 +372,18 @@ var packageNamePats = []*regexp.Regexp{
 	regexp.MustCompile(`([^/]+)$`),
 }
 
+// guessPackageName guesses the name of the package from the import path. The
+// empty string is returned if no guess is possible.
+func guessPackageName(path string) string {
+	for _, pat := range packageNamePats {
+		m := pat.FindStringSubmatch(path)
+		if m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
 func simpleImporter(imports map[string]*ast.Object, path string) (*ast.Object, error) {
 	pkg := imports[path]
 	if pkg != nil {
@@ -342,17 +391,31 @@ func simpleImporter(imports map[string]*ast.Object, path string) (*ast.Object, e
 	}
 
 	// Guess the package name without importing it.
-	for _, pat := range packageNamePats {
-		m := pat.FindStringSubmatch(path)
-		if m != nil {
-			pkg = ast.NewObj(ast.Pkg, m[1])
-			pkg.Data = ast.NewScope(nil)
-			imports[path] = pkg
-			return pkg, nil
-		}
+	name := guessPackageName(path)
+	if name == "" {
+		return nil, errors.New("package not found")
 	}
+	pkg = ast.NewObj(ast.Pkg, name)
+	pkg.Data = ast.NewScope(nil)
+	imports[path] = pkg
+	return pkg, nil
+}
 
-	return nil, errors.New("package not found")
+// importer is an ast.Importer that uses the package names found by
+// resolveImports.
+func (b *builder) importer(imports map[string]*ast.Object, path string) (*ast.Object, error) {
+	pkg := imports[path]
+	if pkg != nil {
+		return pkg, nil
+	}
+	name := b.importNames[path]
+	if name == "" {
+		return simpleImporter(imports, path)
+	}
+	pkg = ast.NewObj(ast.Pkg, name)
+	pkg.Data = ast.NewScope(nil)
+	imports[path] = pkg
+	return pkg, nil
 }
 
 type File struct {
@@ -374,7 +437,7 @@ type source struct {
 }
 
 // PackageVersion is modified when previously stored packages are invalid.
-const PackageVersion = "6"
+const PackageVersion = "13"
 
 type Package struct {
 	// The import path for this package.
@@ -392,12 +455,26 @@ type Package struct {
 	// Errors found when fetching or parsing this package.
 	Errors []string
 
+	// Problems found when building the documentation that do not prevent
+	// the package from being installed.
+	Diagnostics []string
+
 	// Packages referenced in README files.
 	References []string
 
+	// README and markdown files in the directory.
+	Readmes []*Readme
+
+	// License for the package or nil if no license file was found.
+	License *License
+
 	// Version control system: git, hg, bzr, ...
 	VCS string
 
+	// True if the package is in a private repository. Private packages are
+	// not listed in the index, popular packages or anonymous search results.
+	Private bool
+
 	// The time this object was created.
 	Updated time.Time
 
@@ -415,6 +492,7 @@ type Package struct {
 	// Synopsis and full documentation for the package.
 	Synopsis string
 	Doc      string
+	Comment  *Comment
 
 	// Format this package as a command.
 	IsCmd bool
@@ -442,6 +520,12 @@ type Package struct {
 	Files     []*File
 	TestFiles []*File
 
+	// Annotated source for Files.
+	Source []*SourceFile
+
+	// Declarations in Source and the references to the declarations.
+	Decls []*Decl
+
 	// Source size in bytes.
 	SourceSize     int
 	TestSourceSize int
@@ -450,6 +534,9 @@ type Package struct {
 	Imports      []string
 	TestImports  []string
 	XTestImports []string
+
+	// Package names for Imports keyed by import path.
+	ImportNames map[string]string
 }
 
 var goEnvs = []struct{ GOOS, GOARCH string }{
@@ -458,7 +545,7 @@ var goEnvs = []struct{ GOOS, GOARCH string }{
 	{"windows", "amd64"},
 }
 
-func newPackage(dir *gosrc.Directory) (*Package, error) {
+func newPackage(dir *gosrc.Directory, client *http.Client, resolve NameResolver) (*Package, error) {
 
 	pkg := &Package{
 		Updated:        time.Now().UTC(),
@@ -476,14 +563,25 @@ func newPackage(dir *gosrc.Directory) (*Package, error) {
 	var b builder
 	b.srcs = make(map[string]*source)
 	references := make(map[string]bool)
+	base := newReadmeBase(dir)
 	for _, file := range dir.Files {
 		if strings.HasSuffix(file.Name, ".go") {
 			gosrc.OverwriteLineComments(file.Data)
 			b.srcs[file.Name] = &source{name: file.Name, browseURL: file.BrowseURL, data: file.Data}
 		} else {
 			addReferences(references, file.Data)
+			if isReadme(file.Name) && len(file.Data) <= maxReadmeSize {
+				pkg.Readmes = append(pkg.Readmes, newReadme(file.Name, file.BrowseURL, file.Data, base))
+			}
 		}
 	}
+	sortReadmes(pkg.Readmes)
+
+	pkg.License = FindLicense(dir)
+	if pkg.License == nil && dir.ProjectRoot == "" {
+		l := goLicense
+		pkg.License = &l
+	}
 
 	for r := range references {
 		pkg.References = append(pkg.References, r)
@@ -543,7 +641,22 @@ func newPackage(dir *gosrc.Directory) (*Package, error) {
 		pkg.SourceSize += len(src.data)
 	}
 
-	apkg, _ := ast.NewPackage(b.fset, files, simpleImporter, nil)
+	b.resolveImports(pkg, dir, &ctxt, files, client, resolve)
+	apkg, _ := ast.NewPackage(b.fset, files, b.importer, nil)
+
+	var checkFiles []*ast.File
+	for _, name := range names {
+		if file := files[name]; file != nil {
+			checkFiles = append(checkFiles, file)
+		}
+	}
+	b.checkTypes(pkg.ImportPath, checkFiles)
+	for _, name := range names {
+		if file := files[name]; file != nil {
+			pkg.Source = append(pkg.Source, b.printFile(name, file))
+		}
+	}
+	pkg.Decls = b.declList()
 
 	// Find examples in the test files.
 
@@ -569,6 +682,7 @@ func newPackage(dir *gosrc.Directory) (*Package, error) {
 	}
 
 	dpkg := doc.New(apkg, pkg.ImportPath, mode)
+	b.parser = dpkg.Parser()
 
 	if pkg.ImportPath == "builtin" {
 		removeAssociations(dpkg)
@@ -576,6 +690,7 @@ func newPackage(dir *gosrc.Directory) (*Package, error) {
 
 	pkg.Name = dpkg.Name
 	pkg.Doc = strings.TrimRight(dpkg.Doc, " \t\n\r")
+	pkg.Comment = b.comment(pkg.Doc)
 	pkg.Synopsis = synopsis(pkg.Doc)
 
 	pkg.Examples = b.getExamples("")
@@ -586,10 +701,17 @@ func newPackage(dir *gosrc.Directory) (*Package, error) {
 	pkg.Consts = b.values(dpkg.Consts)
 	pkg.Funcs = b.funcs(dpkg.Funcs)
 	pkg.Types = b.types(dpkg.Types)
+	b.addMethodSets(pkg.Types)
 	pkg.Vars = b.values(dpkg.Vars)
 	pkg.Notes = b.notes(dpkg.Notes)
 
 	pkg.Imports = bpkg.Imports
+	pkg.ImportNames = make(map[string]string)
+	for _, p := range pkg.Imports {
+		if name := b.importNames[p]; name != "" {
+			pkg.ImportNames[p] = name
+		}
+	}
 	pkg.TestImports = bpkg.TestImports
 	pkg.XTestImports = bpkg.XTestImports
 
@@ -8,7 +8,13 @@ package doc
 
 import (
 	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"reflect"
 	"testing"
+
+	"github.com/garyburd/gosrc"
 )
 
 var badSynopsis = []string{
@@ -91,3 +97,238 @@ func TestSimpleImporter(t *testing.T) {
 		}
 	}
 }
+
+const sourceFileTest = `package p
+
+import "io"
+
+// T is a type.
+type T struct{ r io.Reader }
+
+func (t T) Len() int { return len("x") }
+
+func (t *T) Reader() io.Reader { return t.r }
+`
+
+var expectedSourceAnnotations = []struct {
+	kind AnnotationKind
+	text string
+	path string
+}{
+	{KeywordAnnotation, "package", ""},
+	{KeywordAnnotation, "import", ""},
+	{StringAnnotation, `"io"`, ""},
+	{CommentAnnotation, "// T is a type.", ""},
+	{KeywordAnnotation, "type", ""},
+	{DeclAnnotation, "T", "T"},
+	{KeywordAnnotation, "struct", ""},
+	{DeclAnnotation, "r", "T.r"},
+	{PackageLinkAnnotation, "io", "io"},
+	{LinkAnnotation, "Reader", "io"},
+	{KeywordAnnotation, "func", ""},
+	{ReferenceAnnotation, "T", "T"},
+	{DeclAnnotation, "Len", "T.Len"},
+	{BuiltinAnnotation, "int", ""},
+	{KeywordAnnotation, "return", ""},
+	{BuiltinAnnotation, "len", ""},
+	{StringAnnotation, `"x"`, ""},
+	{KeywordAnnotation, "func", ""},
+	{ReferenceAnnotation, "T", "T"},
+	{DeclAnnotation, "Reader", "T.Reader"},
+	{PackageLinkAnnotation, "io", "io"},
+	{LinkAnnotation, "Reader", "io"},
+	{KeywordAnnotation, "return", ""},
+	{ReferenceAnnotation, "r", "T.r"},
+}
+
+var expectedDecls = []struct {
+	name string
+	line int32
+	refs []int32
+}{
+	{"T", 6, []int32{8, 10}},
+	{"T.Len", 8, nil},
+	{"T.Reader", 10, nil},
+	{"T.r", 6, []int32{10}},
+}
+
+func TestPrintFile(t *testing.T) {
+	b := &builder{
+		srcs: map[string]*source{"p.go": {name: "p.go", data: []byte(sourceFileTest)}},
+		fset: token.NewFileSet(),
+	}
+	file, err := parser.ParseFile(b.fset, "p.go", b.srcs["p.go"].data, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.checkTypes("example.com/p", []*ast.File{file})
+	f := b.printFile("p.go", file)
+	if len(f.Code.Annotations) != len(expectedSourceAnnotations) {
+		t.Fatalf("got %d annotations, want %d", len(f.Code.Annotations), len(expectedSourceAnnotations))
+	}
+	for i, a := range f.Code.Annotations {
+		expected := expectedSourceAnnotations[i]
+		text := f.Code.Text[a.Pos:a.End]
+		var path string
+		if a.PathIndex >= 0 {
+			path = f.Code.Paths[a.PathIndex]
+		}
+		if a.Kind != expected.kind || text != expected.text || path != expected.path {
+			t.Errorf("annotation %d = %d %q %q, want %d %q %q", i, a.Kind, text, path, expected.kind, expected.text, expected.path)
+		}
+	}
+
+	decls := b.declList()
+	if len(decls) != len(expectedDecls) {
+		t.Fatalf("got %d decls, want %d", len(decls), len(expectedDecls))
+	}
+	for i, d := range decls {
+		expected := expectedDecls[i]
+		var refs []int32
+		for _, r := range d.Refs {
+			refs = append(refs, r.Line)
+		}
+		if d.Name != expected.name || d.Pos.Line != expected.line || !reflect.DeepEqual(refs, expected.refs) {
+			t.Errorf("decl %d = %s %d %v, want %s %d %v", i, d.Name, d.Pos.Line, refs, expected.name, expected.line, expected.refs)
+		}
+	}
+}
+
+func TestPrintFileCRLF(t *testing.T) {
+	const src = "package p\r\n\r\n/*\r\nComment.\r\n*/\r\nconst s = `a\r\nb`\r\n\r\n// Line comment.\r\nvar x = 1\r\n"
+	b := &builder{
+		srcs: map[string]*source{"p.go": {name: "p.go", data: []byte(src)}},
+		fset: token.NewFileSet(),
+	}
+	file, err := parser.ParseFile(b.fset, "p.go", b.srcs["p.go"].data, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.checkTypes("example.com/p", []*ast.File{file})
+	f := b.printFile("p.go", file)
+	var texts []string
+	for _, a := range f.Code.Annotations {
+		if a.Kind == CommentAnnotation || a.Kind == StringAnnotation {
+			texts = append(texts, f.Code.Text[a.Pos:a.End])
+		}
+	}
+	expected := []string{"/*\r\nComment.\r\n*/", "`a\r\nb`", "// Line comment."}
+	if !reflect.DeepEqual(texts, expected) {
+		t.Errorf("comment and string annotations = %q, want %q", texts, expected)
+	}
+}
+
+const methodSetTest = `package p
+
+import (
+	"expvar"
+	"io"
+)
+
+var _ expvar.Var = T{}
+
+type Base struct{}
+
+func (Base) Name() string { return "" }
+func (*Base) Close() error { return nil }
+
+type Namer interface {
+	Name() string
+}
+
+type T struct {
+	Base
+	io.Reader
+}
+
+func (t T) String() string { return "" }
+`
+
+func TestMethodSets(t *testing.T) {
+	b := &builder{fset: token.NewFileSet()}
+	file, err := parser.ParseFile(b.fset, "p.go", methodSetTest, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.checkTypes("example.com/p", []*ast.File{file})
+	typs := []*Type{{Name: "Base"}, {Name: "Namer"}, {Name: "T", Methods: []*Func{{Name: "String"}}}}
+	b.addMethodSets(typs)
+
+	refs := func(refs []*TypeRef) []string {
+		var result []string
+		for _, r := range refs {
+			s := r.ImportPath + "." + r.Name
+			if r.Pointer {
+				s = "*" + s
+			}
+			result = append(result, s)
+		}
+		return result
+	}
+
+	expectedImplements := map[string][]string{
+		"Base": {"example.com/p.Namer", "*io.Closer"},
+		"T":    {"example.com/p.Namer", "expvar.Var", "*io.Closer", "*io.ReadCloser", "io.Reader"},
+	}
+	for _, typ := range typs {
+		if got, want := refs(typ.Implements), expectedImplements[typ.Name]; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s implements %v, want %v", typ.Name, got, want)
+		}
+	}
+
+	if got, want := refs(typs[1].ImplementedBy), []string{"example.com/p.Base", "example.com/p.T"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Namer implemented by %v, want %v", got, want)
+	}
+
+	var promoted []string
+	for _, m := range typs[2].Promoted {
+		promoted = append(promoted, m.Decl.Text+" "+refs([]*TypeRef{&m.Orig})[0])
+	}
+	expectedPromoted := []string{
+		"func (*T) Close() error *example.com/p.Base",
+		"func (T) Name() string example.com/p.Base",
+		"func (T) Read(p []byte) (n int, err error) io.Reader",
+	}
+	if !reflect.DeepEqual(promoted, expectedPromoted) {
+		t.Errorf("promoted = %q, want %q", promoted, expectedPromoted)
+	}
+}
+
+const resolveImportsTest = `package p
+
+import (
+	"example.com/go-q"
+	"example.com/r"
+	s "example.com/s"
+	"io"
+)
+`
+
+func TestResolveImports(t *testing.T) {
+	b := &builder{fset: token.NewFileSet()}
+	file, err := parser.ParseFile(b.fset, "p.go", resolveImportsTest, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolve := func(importPath string) (string, error) {
+		if importPath == "example.com/go-q" {
+			return "quux", nil
+		}
+		return "", nil
+	}
+	var pkg Package
+	b.resolveImports(&pkg, &gosrc.Directory{ProjectRoot: "example.com/p"}, &build.Context{}, map[string]*ast.File{"p.go": file}, nil, resolve)
+
+	expectedNames := map[string]string{
+		"example.com/go-q": "quux",
+		"example.com/r":    "r",
+		"io":               "io",
+	}
+	if !reflect.DeepEqual(b.importNames, expectedNames) {
+		t.Errorf("importNames = %v, want %v", b.importNames, expectedNames)
+	}
+	expectedDiagnostics := []string{`Unresolved import "example.com/r", assuming package name "r"`}
+	if !reflect.DeepEqual(pkg.Diagnostics, expectedDiagnostics) {
+		t.Errorf("diagnostics = %q, want %q", pkg.Diagnostics, expectedDiagnostics)
+	}
+}
@@ -14,7 +14,9 @@ import (
 	"go/printer"
 	"go/scanner"
 	"go/token"
+	"go/types"
 	"math"
+	"sort"
 	"strconv"
 )
 
@@ -89,6 +91,19 @@ const (
 
 	// Link to builtin entity with name Text[Pos:End].
 	BuiltinAnnotation
+
+	// Go keyword.
+	KeywordAnnotation
+
+	// String or character literal.
+	StringAnnotation
+
+	// Declaration in the package source with name Paths[PathIndex].
+	DeclAnnotation
+
+	// Reference to the declaration in the package source with name
+	// Paths[PathIndex].
+	ReferenceAnnotation
 )
 
 type Annotation struct {
@@ -103,25 +118,33 @@ type Code struct {
 	Paths       []string
 }
 
+// annotationPaths assigns indices to the import paths used in annotations.
+type annotationPaths struct {
+	paths     []string
+	pathIndex map[string]int
+}
+
+func (p *annotationPaths) index(importPath string) int16 {
+	if importPath == "" {
+		return -1
+	}
+	pathIndex, ok := p.pathIndex[importPath]
+	if !ok {
+		pathIndex = len(p.paths)
+		p.paths = append(p.paths, importPath)
+		p.pathIndex[importPath] = pathIndex
+	}
+	return int16(pathIndex)
+}
+
 // annotationVisitor collects annotations.
 type annotationVisitor struct {
+	annotationPaths
 	annotations []Annotation
-	paths       []string
-	pathIndex   map[string]int
 }
 
 func (v *annotationVisitor) add(kind AnnotationKind, importPath string) {
-	pathIndex := -1
-	if importPath != "" {
-		var ok bool
-		pathIndex, ok = v.pathIndex[importPath]
-		if !ok {
-			pathIndex = len(v.paths)
-			v.paths = append(v.paths, importPath)
-			v.pathIndex[importPath] = pathIndex
-		}
-	}
-	v.annotations = append(v.annotations, Annotation{Kind: kind, PathIndex: int16(pathIndex)})
+	v.annotations = append(v.annotations, Annotation{Kind: kind, PathIndex: v.index(importPath)})
 }
 
 func (v *annotationVisitor) ignoreName() {
@@ -205,7 +228,7 @@ func (v *annotationVisitor) Visit(n ast.Node) ast.Visitor {
 }
 
 func (b *builder) printDecl(decl ast.Decl) (d Code) {
-	v := &annotationVisitor{pathIndex: make(map[string]int)}
+	v := &annotationVisitor{annotationPaths: annotationPaths{pathIndex: make(map[string]int)}}
 	ast.Walk(v, decl)
 	b.buf = b.buf[:0]
 	err := (&printer.Config{Mode: printer.UseSpaces, Tabwidth: 4}).Fprint(sliceWriter{&b.buf}, b.fset, decl)
@@ -226,7 +249,7 @@ loop:
 			break loop
 		case token.COMMENT:
 			p := file.Offset(pos)
-			e := p + len(lit)
+			e := litEnd(b.buf, p, lit)
 			annotations = append(annotations, Annotation{Kind: CommentAnnotation, Pos: int32(p), End: int32(e)})
 		case token.IDENT:
 			if len(v.annotations) == 0 {
@@ -266,7 +289,6 @@ func (b *builder) position(n ast.Node) Pos {
 	return position
 }
 
-
 func (b *builder) printSource(decl *ast.FuncDecl) ([]byte, string, int) {
 	start := b.fset.Position(decl.Pos())
 	end := b.fset.Position(decl.End())
@@ -326,10 +348,129 @@ scanLoop:
 			break scanLoop
 		case token.COMMENT:
 			p := file.Offset(pos)
-			e := p + len(lit)
+			e := litEnd(b.buf, p, lit)
 			annotations = append(annotations, Annotation{Kind: CommentAnnotation, Pos: int32(p), End: int32(e)})
 		}
 	}
 
 	return Code{Text: string(b.buf), Annotations: annotations}, output
 }
+
+// SourceFile is the annotated source of a file in Package.Files.
+type SourceFile struct {
+	Name string
+	Code Code
+}
+
+type byPos []Annotation
+
+func (s byPos) Len() int           { return len(s) }
+func (s byPos) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byPos) Less(i, j int) bool { return s[i].Pos < s[j].Pos }
+
+// sourceVisitor collects annotations for the identifiers in a source file.
+// Unlike annotationVisitor, the annotations are positioned using the AST
+// because the file is not reformatted.
+type sourceVisitor struct {
+	annotationPaths
+	annotations []Annotation
+	b           *builder
+	file        *token.File
+}
+
+func (v *sourceVisitor) add(kind AnnotationKind, path string, n *ast.Ident) {
+	p := v.file.Offset(n.Pos())
+	v.annotations = append(v.annotations, Annotation{
+		Kind:      kind,
+		PathIndex: v.index(path),
+		Pos:       int32(p),
+		End:       int32(p + len(n.Name)),
+	})
+}
+
+func (v *sourceVisitor) Visit(n ast.Node) ast.Visitor {
+	switch n := n.(type) {
+	case *ast.Ident:
+		if obj := v.b.info.Defs[n]; obj != nil {
+			if d := v.b.decls[obj]; d != nil {
+				v.add(DeclAnnotation, d.Name, n)
+			}
+		} else if obj := v.b.info.Uses[n]; obj != nil {
+			if d := v.b.decls[obj]; d != nil {
+				v.add(ReferenceAnnotation, d.Name, n)
+				d.Refs = append(d.Refs, v.b.position(n))
+			} else if obj.Parent() == types.Universe {
+				v.add(BuiltinAnnotation, "", n)
+			}
+		}
+	case *ast.SelectorExpr:
+		if x, _ := n.X.(*ast.Ident); x != nil {
+			if pkg, _ := v.b.info.Uses[x].(*types.PkgName); pkg != nil {
+				path := pkg.Imported().Path()
+				v.add(PackageLinkAnnotation, path, x)
+				if path != "C" && ast.IsExported(n.Sel.Name) {
+					v.add(LinkAnnotation, path, n.Sel)
+				}
+				return nil
+			}
+		}
+		return v
+	default:
+		return v
+	}
+	return nil
+}
+
+// printFile returns the annotated source for the named file and records the
+// references to declarations in the file. The file must be printed after
+// checkTypes and before doc.New removes unexported declarations from the AST.
+func (b *builder) printFile(name string, file *ast.File) *SourceFile {
+	src := b.srcs[name]
+	v := &sourceVisitor{
+		annotationPaths: annotationPaths{pathIndex: make(map[string]int)},
+		b:               b,
+		file:            b.fset.File(file.Pos()),
+	}
+	ast.Walk(v, file)
+
+	var s scanner.Scanner
+	fset := token.NewFileSet()
+	f := fset.AddFile("", fset.Base(), len(src.data))
+	s.Init(f, src.data, nil, scanner.ScanComments)
+	for {
+		pos, tok, lit := s.Scan()
+		var kind AnnotationKind
+		switch {
+		case tok == token.EOF:
+			sort.Sort(byPos(v.annotations))
+			return &SourceFile{
+				Name: name,
+				Code: Code{Text: string(src.data), Annotations: v.annotations, Paths: v.paths},
+			}
+		case tok == token.COMMENT:
+			kind = CommentAnnotation
+		case tok == token.STRING || tok == token.CHAR:
+			kind = StringAnnotation
+		case tok.IsKeyword():
+			kind = KeywordAnnotation
+		default:
+			continue
+		}
+		p := f.Offset(pos)
+		v.annotations = append(v.annotations, Annotation{Kind: kind, PathIndex: -1, Pos: int32(p), End: int32(litEnd(src.data, p, lit))})
+	}
+}
+
+// litEnd returns the offset in src of the end of the token literal lit
+// starting at offset p. The scanner removes carriage returns from comments
+// and raw strings, so the end is found by matching the literal against src
+// and skipping the carriage returns that are not in the literal.
+func litEnd(src []byte, p int, lit string) int {
+	for i := 0; i < len(lit) && p < len(src); p++ {
+		if src[p] == '\r' && lit[i] != '\r' {
+			continue
+		}
+		i++
+	}
+	return p
+}
@@ -0,0 +1,162 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package doc
+
+import (
+	"bytes"
+	"go/doc/comment"
+)
+
+type BlockKind int16
+
+const (
+	// Paragraph with text in Spans.
+	ParagraphBlock BlockKind = iota
+
+	// Heading with text in Spans.
+	HeadingBlock
+
+	// Preformatted text in Code.
+	CodeBlock
+
+	// List with items in Items.
+	ListBlock
+)
+
+type SpanKind int16
+
+const (
+	// Plain text.
+	TextSpan SpanKind = iota
+
+	// Link to URL with text Text.
+	URLSpan
+
+	// Link to the documentation for an identifier or package with text
+	// Text. The URL is "#name" for identifiers in the current package and
+	// "/importPath" or "/importPath#name" for other packages.
+	DocLinkSpan
+)
+
+// Span is a run of inline text in a paragraph, heading or list item.
+type Span struct {
+	Kind SpanKind
+	Text string
+	URL  string
+}
+
+// ListItem is an item in a list block.
+type ListItem struct {
+	// Number is the item number for numbered lists or "" for bullet lists.
+	Number string
+	Spans  []*Span
+}
+
+// Block is a paragraph, heading, preformatted code or list in a doc
+// comment.
+type Block struct {
+	Kind  BlockKind
+	Spans []*Span
+	Code  string
+	Items []*ListItem
+}
+
+// Comment is a doc comment parsed into blocks.
+type Comment struct {
+	Blocks []*Block
+}
+
+// ParseComment parses a doc comment with the go/doc/comment parser p. The
+// parser resolves the doc links in the comment. The comment syntax is
+// described at https://go.dev/doc/comment.
+func ParseComment(p *comment.Parser, text string) *Comment {
+	c := &Comment{}
+	for _, b := range p.Parse(text).Content {
+		switch b := b.(type) {
+		case *comment.Paragraph:
+			c.Blocks = append(c.Blocks, &Block{Kind: ParagraphBlock, Spans: newSpans(b.Text)})
+		case *comment.Heading:
+			c.Blocks = append(c.Blocks, &Block{Kind: HeadingBlock, Spans: newSpans(b.Text)})
+		case *comment.Code:
+			c.Blocks = append(c.Blocks, &Block{Kind: CodeBlock, Code: b.Text})
+		case *comment.List:
+			block := &Block{Kind: ListBlock}
+			for _, item := range b.Items {
+				var text []comment.Text
+				for i, ib := range item.Content {
+					if p, ok := ib.(*comment.Paragraph); ok {
+						if i > 0 {
+							text = append(text, comment.Plain("\n"))
+						}
+						text = append(text, p.Text...)
+					}
+				}
+				block.Items = append(block.Items, &ListItem{Number: item.Number, Spans: newSpans(text)})
+			}
+			c.Blocks = append(c.Blocks, block)
+		}
+	}
+	return c
+}
+
+// newSpans converts inline text to spans. Adjacent plain text is merged into
+// a single span.
+func newSpans(text []comment.Text) []*Span {
+	var spans []*Span
+	addText := func(s string) {
+		if s == "" {
+			return
+		}
+		if n := len(spans); n > 0 && spans[n-1].Kind == TextSpan {
+			spans[n-1].Text += s
+			return
+		}
+		spans = append(spans, &Span{Kind: TextSpan, Text: s})
+	}
+	for _, t := range text {
+		switch t := t.(type) {
+		case comment.Plain:
+			addText(string(t))
+		case comment.Italic:
+			addText(string(t))
+		case *comment.Link:
+			spans = append(spans, &Span{Kind: URLSpan, Text: plainText(t.Text), URL: t.URL})
+		case *comment.DocLink:
+			spans = append(spans, &Span{Kind: DocLinkSpan, Text: plainText(t.Text), URL: docLinkURL(t)})
+		}
+	}
+	return spans
+}
+
+// plainText returns the text of a link.
+func plainText(text []comment.Text) string {
+	var buf bytes.Buffer
+	for _, t := range text {
+		switch t := t.(type) {
+		case comment.Plain:
+			buf.WriteString(string(t))
+		case comment.Italic:
+			buf.WriteString(string(t))
+		}
+	}
+	return buf.String()
+}
+
+// docLinkURL returns the documentation URL for a doc link.
+func docLinkURL(l *comment.DocLink) string {
+	name := l.Name
+	if l.Recv != "" {
+		name = l.Recv + "." + name
+	}
+	switch {
+	case l.ImportPath == "":
+		return "#" + name
+	case name == "":
+		return "/" + l.ImportPath
+	}
+	return "/" + l.ImportPath + "#" + name
+}
@@ -0,0 +1,99 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package doc
+
+import (
+	"go/doc/comment"
+	"reflect"
+	"testing"
+)
+
+func text(s string) *Span { return &Span{Kind: TextSpan, Text: s} }
+
+var parseCommentTests = []struct {
+	text   string
+	blocks []*Block
+}{
+	{
+		"Package p does ``things''.\n\nSecond paragraph\nwith two lines.\n",
+		[]*Block{
+			{Kind: ParagraphBlock, Spans: []*Span{text("Package p does “things”.")}},
+			{Kind: ParagraphBlock, Spans: []*Span{text("Second paragraph\nwith two lines.")}},
+		},
+	},
+	{
+		"Intro.\n\n# Usage\n\nText.\n\nOld Style Heading\n\nMore text.\n",
+		[]*Block{
+			{Kind: ParagraphBlock, Spans: []*Span{text("Intro.")}},
+			{Kind: HeadingBlock, Spans: []*Span{text("Usage")}},
+			{Kind: ParagraphBlock, Spans: []*Span{text("Text.")}},
+			{Kind: HeadingBlock, Spans: []*Span{text("Old Style Heading")}},
+			{Kind: ParagraphBlock, Spans: []*Span{text("More text.")}},
+		},
+	},
+	{
+		"Example:\n\n\tif x {\n\n\t\ty()\n\t}\n\nDone.\n",
+		[]*Block{
+			{Kind: ParagraphBlock, Spans: []*Span{text("Example:")}},
+			{Kind: CodeBlock, Code: "if x {\n\n\ty()\n}\n"},
+			{Kind: ParagraphBlock, Spans: []*Span{text("Done.")}},
+		},
+	},
+	{
+		"Steps:\n  1. First\n     continued.\n  2. Second\n\nBullets:\n  - one\n  - two\n",
+		[]*Block{
+			{Kind: ParagraphBlock, Spans: []*Span{text("Steps:")}},
+			{Kind: ListBlock, Items: []*ListItem{
+				{Number: "1", Spans: []*Span{text("First\ncontinued.")}},
+				{Number: "2", Spans: []*Span{text("Second")}},
+			}},
+			{Kind: ParagraphBlock, Spans: []*Span{text("Bullets:")}},
+			{Kind: ListBlock, Items: []*ListItem{
+				{Spans: []*Span{text("one")}},
+				{Spans: []*Span{text("two")}},
+			}},
+		},
+	},
+	{
+		"See [the spec], [io.Reader], [NewClient], [Missing] and http://golang.org/doc.\n\n[the spec]: http://golang.org/ref/spec\n",
+		[]*Block{
+			{Kind: ParagraphBlock, Spans: []*Span{
+				text("See "),
+				{Kind: URLSpan, Text: "the spec", URL: "http://golang.org/ref/spec"},
+				text(", "),
+				{Kind: DocLinkSpan, Text: "io.Reader", URL: "/io#Reader"},
+				text(", "),
+				{Kind: DocLinkSpan, Text: "NewClient", URL: "#NewClient"},
+				text(", [Missing] and "),
+				{Kind: URLSpan, Text: "http://golang.org/doc", URL: "http://golang.org/doc"},
+				text("."),
+			}},
+		},
+	},
+}
+
+func TestParseComment(t *testing.T) {
+	p := &comment.Parser{LookupSym: func(recv, name string) bool { return recv == "" && name == "NewClient" }}
+	for _, tt := range parseCommentTests {
+		c := ParseComment(p, tt.text)
+		if !reflect.DeepEqual(c.Blocks, tt.blocks) {
+			t.Errorf("ParseComment(%q) =", tt.text)
+			for _, b := range c.Blocks {
+				t.Errorf("  %+v", *b)
+				for _, s := range b.Spans {
+					t.Errorf("    %+v", *s)
+				}
+				for _, item := range b.Items {
+					t.Errorf("    item %q", item.Number)
+					for _, s := range item.Spans {
+						t.Errorf("      %+v", *s)
+					}
+				}
+			}
+		}
+	}
+}
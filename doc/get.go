@@ -14,7 +14,9 @@ import (
 	"strings"
 )
 
-func Get(client *http.Client, importPath string, etag string) (*Package, error) {
+// Get fetches and builds the documentation for the package at importPath. The
+// names of imported packages are found using resolve if resolve is not nil.
+func Get(client *http.Client, importPath string, etag string, resolve NameResolver) (*Package, error) {
 
 	const versionPrefix = PackageVersion + "-"
 
@@ -24,17 +26,18 @@ func Get(client *http.Client, importPath string, etag string) (*Package, error)
 		etag = ""
 	}
 
-	dir, err := gosrc.Get(client, importPath, etag)
+	dir, custom, err := getDir(client, importPath, etag)
 	if err != nil {
 		return nil, err
 	}
 
-	pdoc, err := newPackage(dir)
+	pdoc, err := newPackage(dir, client, resolve)
 	if err != nil {
 		return pdoc, err
 	}
 
-	if pdoc.Synopsis == "" &&
+	if !custom &&
+		pdoc.Synopsis == "" &&
 		pdoc.Doc == "" &&
 		!pdoc.IsCmd &&
 		pdoc.Name != "" &&
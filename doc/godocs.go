@@ -54,7 +54,7 @@ func main() {
 	_, err = pg.Exec(fmt.Sprintf("delete from namespaces where version = '%s'", version))
 	check(err)
 	for pkg, _ := range gosrc.GoRepoPath {
-		pdoc, err := doc.Get(http.DefaultClient, pkg, "")
+		pdoc, err := doc.Get(http.DefaultClient, pkg, "", nil)
 		if err != nil {
 			fmt.Println("failed to get doc")
 			return
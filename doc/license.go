@@ -0,0 +1,435 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package doc
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/garyburd/gosrc"
+)
+
+// License is the license file found for a package.
+type License struct {
+	// SPDX identifier of the license or "" if the license is not
+	// recognized.
+	ID string
+
+	// Import path of the directory containing the license file. The path
+	// is a parent of the package import path if the package directory does
+	// not have a license file.
+	ImportPath string
+
+	// Name and browse URL of the license file.
+	File string
+	URL  string
+
+	// Similarity of the license file to the text of the recognized
+	// license, from 0 to 1.
+	Score float64
+}
+
+// Name returns the human readable name of the license.
+func (l *License) Name() string {
+	if name, ok := licenseNames[l.ID]; ok {
+		return name
+	}
+	return "Unknown license"
+}
+
+var licenseNames = map[string]string{
+	"AGPL-3.0":     "GNU Affero General Public License v3.0",
+	"Apache-2.0":   "Apache License 2.0",
+	"BSD-2-Clause": "BSD 2-Clause License",
+	"BSD-3-Clause": "BSD 3-Clause License",
+	"CC0-1.0":      "Creative Commons Zero v1.0 Universal",
+	"GPL-2.0":      "GNU General Public License v2.0",
+	"GPL-3.0":      "GNU General Public License v3.0",
+	"ISC":          "ISC License",
+	"LGPL-2.1":     "GNU Lesser General Public License v2.1",
+	"LGPL-3.0":     "GNU Lesser General Public License v3.0",
+	"MIT":          "MIT License",
+	"MPL-2.0":      "Mozilla Public License 2.0",
+	"Unlicense":    "The Unlicense",
+}
+
+// goLicense is the license for the standard packages.
+var goLicense = License{ID: "BSD-3-Clause", File: "LICENSE", URL: "http://golang.org/LICENSE", Score: 1}
+
+// knownLicenses is the bundled set of license texts. Texts marked as excerpts
+// are distinctive passages from long licenses. A file matches an excerpt if
+// the file contains the passage. A file matches a full text if the file and
+// the text are nearly the same.
+var knownLicenses = []struct {
+	id      string
+	excerpt bool
+	text    string
+}{
+	{"MIT", false, `
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+`},
+	{"BSD-2-Clause", false, `
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+`},
+	{"BSD-3-Clause", false, `
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its
+   contributors may be used to endorse or promote products derived from
+   this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+`},
+	{"ISC", false, `
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted, provided that the above
+copyright notice and this permission notice appear in all copies.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+`},
+	{"Unlicense", false, `
+This is free and unencumbered software released into the public domain.
+
+Anyone is free to copy, modify, publish, use, compile, sell, or
+distribute this software, either in source code form or as a compiled
+binary, for any purpose, commercial or non-commercial, and by any
+means.
+
+In jurisdictions that recognize copyright laws, the author or authors
+of this software dedicate any and all copyright interest in the
+software to the public domain. We make this dedication for the benefit
+of the public at large and to the detriment of our heirs and
+successors. We intend this dedication to be an overt act of
+relinquishment in perpetuity of all present and future rights to this
+software under copyright law.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+OTHER DEALINGS IN THE SOFTWARE.
+
+For more information, please refer to <http://unlicense.org/>
+`},
+	{"Apache-2.0", true, `
+TERMS AND CONDITIONS FOR USE, REPRODUCTION, AND DISTRIBUTION
+
+1. Definitions.
+
+"License" shall mean the terms and conditions for use, reproduction,
+and distribution as defined by Sections 1 through 9 of this document.
+
+"Licensor" shall mean the copyright owner or entity authorized by
+the copyright owner that is granting the License.
+
+2. Grant of Copyright License. Subject to the terms and conditions of
+this License, each Contributor hereby grants to You a perpetual,
+worldwide, non-exclusive, no-charge, royalty-free, irrevocable
+copyright license to reproduce, prepare Derivative Works of,
+publicly display, publicly perform, sublicense, and distribute the
+Work and such Derivative Works in Source or Object form.
+`},
+	{"Apache-2.0", true, `
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+`},
+	{"GPL-2.0", true, `
+GNU GENERAL PUBLIC LICENSE
+Version 2, June 1991
+
+The licenses for most software are designed to take away your
+freedom to share and change it. By contrast, the GNU General Public
+License is intended to guarantee your freedom to share and change free
+software--to make sure the software is free for all its users. This
+General Public License applies to most of the Free Software
+Foundation's software and to any other program whose authors commit to
+using it.
+`},
+	{"GPL-3.0", true, `
+GNU GENERAL PUBLIC LICENSE
+Version 3, 29 June 2007
+
+The GNU General Public License is a free, copyleft license for
+software and other kinds of works.
+
+The licenses for most software and other practical works are designed
+to take away your freedom to share and change the works. By contrast,
+the GNU General Public License is intended to guarantee your freedom to
+share and change all versions of a program--to make sure it remains free
+software for all its users. We, the Free Software Foundation, use the
+GNU General Public License for most of our software; it applies also to
+any other work released this way by its authors.
+`},
+	{"AGPL-3.0", true, `
+GNU AFFERO GENERAL PUBLIC LICENSE
+Version 3, 19 November 2007
+
+The GNU Affero General Public License is a free, copyleft license for
+software and other kinds of works, specifically designed to ensure
+cooperation with the community in the case of network server software.
+
+The licenses for most software and other practical works are designed
+to take away your freedom to share and change the works. By contrast,
+our General Public Licenses are intended to guarantee your freedom to
+share and change all versions of a program--to make sure it remains free
+software for all its users.
+`},
+	{"LGPL-2.1", true, `
+GNU LESSER GENERAL PUBLIC LICENSE
+Version 2.1, February 1999
+
+The licenses for most software are designed to take away your
+freedom to share and change it. By contrast, the GNU General Public
+Licenses are intended to guarantee your freedom to share and change
+free software--to make sure the software is free for all its users.
+
+This license, the Lesser General Public License, applies to some
+specially designated software packages--typically libraries--of the
+Free Software Foundation and other authors who decide to use it.
+`},
+	{"LGPL-3.0", true, `
+GNU LESSER GENERAL PUBLIC LICENSE
+Version 3, 29 June 2007
+
+This version of the GNU Lesser General Public License incorporates
+the terms and conditions of version 3 of the GNU General Public
+License, supplemented by the additional permissions listed below.
+
+0. Additional Definitions.
+
+As used herein, "this License" refers to version 3 of the GNU Lesser
+General Public License, and the "GNU GPL" refers to version 3 of the GNU
+General Public License.
+`},
+	{"MPL-2.0", true, `
+Mozilla Public License Version 2.0
+
+1. Definitions
+
+1.1. "Contributor"
+    means each individual or legal entity that creates, contributes to
+    the creation of, or owns Covered Software.
+
+1.2. "Contributor Version"
+    means the combination of the Contributions of others (if any) used
+    by a Contributor and that particular Contributor's Contribution.
+`},
+	{"MPL-2.0", true, `
+This Source Code Form is subject to the terms of the Mozilla Public
+License, v. 2.0. If a copy of the MPL was not distributed with this
+file, You can obtain one at http://mozilla.org/MPL/2.0/.
+`},
+	{"CC0-1.0", true, `
+CC0 1.0 Universal
+
+Statement of Purpose
+
+The laws of most jurisdictions throughout the world automatically confer
+exclusive Copyright and Related Rights (defined below) upon the creator
+and subsequent owner(s) (each and all, an "owner") of an original work of
+authorship and/or a database (each, a "Work").
+`},
+}
+
+// minLicenseScore is the minimum score for a license file to match a known
+// license.
+const minLicenseScore = 0.75
+
+var (
+	licenseFilePat    = regexp.MustCompile(`(?i)^(?:un)?licen[cs]e(?:$|[.\-_])|^copying(?:$|[.\-_])`)
+	copyrightLinePat  = regexp.MustCompile(`(?im)^[ \t]*(?:copyright|\(c\)|©).*(?:[0-9]{4}|\(c\)|©).*$`)
+	licenseWordPat    = regexp.MustCompile(`[a-z0-9]+`)
+	knownLicenseTerms []map[string]bool
+)
+
+func init() {
+	for _, l := range knownLicenses {
+		knownLicenseTerms = append(knownLicenseTerms, licenseShingles(l.text))
+	}
+}
+
+// licenseShingles returns the set of three word sequences in the license
+// text after removing copyright lines and punctuation.
+func licenseShingles(text string) map[string]bool {
+	text = copyrightLinePat.ReplaceAllString(strings.ToLower(text), "")
+	words := licenseWordPat.FindAllString(text, -1)
+	shingles := make(map[string]bool)
+	for i := 0; i+3 <= len(words); i++ {
+		shingles[strings.Join(words[i:i+3], " ")] = true
+	}
+	return shingles
+}
+
+// ClassifyLicense returns the SPDX identifier of the known license most
+// similar to text and the similarity score. The empty string is returned if
+// the text does not match a known license.
+func ClassifyLicense(text []byte) (string, float64) {
+	shingles := licenseShingles(string(text))
+	if len(shingles) == 0 {
+		return "", 0
+	}
+	bestID := ""
+	bestScore := 0.0
+	for i, l := range knownLicenses {
+		known := knownLicenseTerms[i]
+		n := 0
+		for s := range known {
+			if shingles[s] {
+				n++
+			}
+		}
+		var score float64
+		if l.excerpt {
+			score = float64(n) / float64(len(known))
+		} else {
+			score = 2 * float64(n) / float64(len(known)+len(shingles))
+		}
+		if score > bestScore {
+			bestID, bestScore = l.id, score
+		}
+	}
+	if bestScore < minLicenseScore {
+		return "", bestScore
+	}
+	return bestID, bestScore
+}
+
+// licenseFileRank orders license file names. Lesser GPL files are preferred
+// over the GPL file that accompanies them.
+func licenseFileRank(name string) int {
+	name = strings.ToLower(name)
+	switch {
+	case strings.Contains(name, "lesser") || strings.Contains(name, "lgpl"):
+		return 0
+	case strings.HasPrefix(name, "licen"):
+		return 1
+	case strings.HasPrefix(name, "copying"):
+		return 2
+	}
+	return 3
+}
+
+type byLicenseFileRank []*gosrc.File
+
+func (s byLicenseFileRank) Len() int      { return len(s) }
+func (s byLicenseFileRank) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byLicenseFileRank) Less(i, j int) bool {
+	ri, rj := licenseFileRank(s[i].Name), licenseFileRank(s[j].Name)
+	if ri != rj {
+		return ri < rj
+	}
+	return s[i].Name < s[j].Name
+}
+
+// GetLicense fetches the directory at importPath and returns the license for
+// the license files in the directory. The directory is fetched from a mirror
+// or the resolver table when configured, the same as the directories fetched
+// by Get.
+func GetLicense(client *http.Client, importPath string) (*License, error) {
+	dir, _, err := getDir(client, importPath, "")
+	if err != nil {
+		return nil, err
+	}
+	return FindLicense(dir), nil
+}
+
+// FindLicense returns the license for the LICENSE or COPYING files in dir or
+// nil if the directory does not have a license file. The first recognized
+// license is returned if the directory has more than one license file.
+func FindLicense(dir *gosrc.Directory) *License {
+	var files []*gosrc.File
+	for _, f := range dir.Files {
+		if licenseFilePat.MatchString(f.Name) {
+			files = append(files, f)
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	sort.Sort(byLicenseFileRank(files))
+	var result *License
+	for _, f := range files {
+		id, score := ClassifyLicense(f.Data)
+		l := &License{ID: id, ImportPath: dir.ImportPath, File: f.Name, URL: f.BrowseURL, Score: score}
+		if id != "" {
+			return l
+		}
+		if result == nil {
+			result = l
+		}
+	}
+	return result
+}
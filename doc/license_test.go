@@ -0,0 +1,176 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package doc
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/garyburd/gosrc"
+)
+
+const goLicenseText = `Copyright (c) 2012 The Go Authors. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+`
+
+const mitLicenseText = `The MIT License (MIT)
+
+Copyright (c) 2014 Gopher
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction, including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+`
+
+const apacheNoticeText = `Copyright 2014 Example Corp.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+`
+
+const gpl3Text = `                    GNU GENERAL PUBLIC LICENSE
+                       Version 3, 29 June 2007
+
+ Copyright (C) 2007 Free Software Foundation, Inc. <http://fsf.org/>
+ Everyone is permitted to copy and distribute verbatim copies
+ of this license document, but changing it is not allowed.
+
+                            Preamble
+
+  The GNU General Public License is a free, copyleft license for
+software and other kinds of works.
+
+  The licenses for most software and other practical works are designed
+to take away your freedom to share and change the works.  By contrast,
+the GNU General Public License is intended to guarantee your freedom to
+share and change all versions of a program--to make sure it remains free
+software for all its users.  We, the Free Software Foundation, use the
+GNU General Public License for most of our software; it applies also to
+any other work released this way by its authors.  You can apply it to
+your programs, too.
+`
+
+const lgpl3Text = `                   GNU LESSER GENERAL PUBLIC LICENSE
+                       Version 3, 29 June 2007
+
+ Copyright (C) 2007 Free Software Foundation, Inc. <http://fsf.org/>
+ Everyone is permitted to copy and distribute verbatim copies
+ of this license document, but changing it is not allowed.
+
+
+  This version of the GNU Lesser General Public License incorporates
+the terms and conditions of version 3 of the GNU General Public
+License, supplemented by the additional permissions listed below.
+
+  0. Additional Definitions.
+
+  As used herein, "this License" refers to version 3 of the GNU Lesser
+General Public License, and the "GNU GPL" refers to version 3 of the GNU
+General Public License.
+`
+
+var classifyLicenseTests = []struct {
+	text string
+	id   string
+}{
+	{goLicenseText, "BSD-3-Clause"},
+	{mitLicenseText, "MIT"},
+	{apacheNoticeText, "Apache-2.0"},
+	{gpl3Text, "GPL-3.0"},
+	{lgpl3Text, "LGPL-3.0"},
+	{"All rights reserved. Do not copy.\n", ""},
+	{"", ""},
+}
+
+func TestClassifyLicense(t *testing.T) {
+	for _, tt := range classifyLicenseTests {
+		id, score := ClassifyLicense([]byte(tt.text))
+		if id != tt.id {
+			t.Errorf("ClassifyLicense(%.40q) = %q, %v, want %q", tt.text, id, score, tt.id)
+		}
+	}
+}
+
+var findLicenseTests = []struct {
+	files []string
+	id    string
+	file  string
+}{
+	{[]string{"main.go", "README.md"}, "", ""},
+	{[]string{"LICENSE.txt", "main.go"}, "MIT", "LICENSE.txt"},
+	{[]string{"COPYING", "COPYING.LESSER"}, "LGPL-3.0", "COPYING.LESSER"},
+	{[]string{"LICENSE-FOO"}, "", "LICENSE-FOO"},
+}
+
+var findLicenseData = map[string]string{
+	"main.go":        "package main\n",
+	"README.md":      "# Readme\n",
+	"LICENSE.txt":    mitLicenseText,
+	"COPYING":        gpl3Text,
+	"COPYING.LESSER": lgpl3Text,
+	"LICENSE-FOO":    "Proprietary.\n",
+}
+
+func TestFindLicense(t *testing.T) {
+	for _, tt := range findLicenseTests {
+		dir := &gosrc.Directory{ImportPath: "example.com/p"}
+		for _, name := range tt.files {
+			dir.Files = append(dir.Files, &gosrc.File{Name: name, BrowseURL: "http://example.com/p/" + name, Data: []byte(findLicenseData[name])})
+		}
+		l := FindLicense(dir)
+		if tt.file == "" {
+			if l != nil {
+				t.Errorf("FindLicense(%v) = %+v, want nil", tt.files, *l)
+			}
+			continue
+		}
+		if l == nil {
+			t.Errorf("FindLicense(%v) = nil, want %s", tt.files, tt.file)
+			continue
+		}
+		expected := License{ID: tt.id, ImportPath: "example.com/p", File: tt.file, URL: "http://example.com/p/" + tt.file, Score: l.Score}
+		if !reflect.DeepEqual(*l, expected) {
+			t.Errorf("FindLicense(%v) = %+v, want %+v", tt.files, *l, expected)
+		}
+	}
+}
@@ -0,0 +1,732 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package doc
+
+import (
+	"bytes"
+	"html"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/gosrc"
+)
+
+// Readme is a README or markdown file from the package directory.
+type Readme struct {
+	Name string
+	URL  string
+
+	// Sanitized HTML rendering of the file.
+	HTML string
+}
+
+// Maximum size of README files rendered to HTML.
+const maxReadmeSize = 128 * 1024
+
+var markdownExts = map[string]bool{
+	".md":       true,
+	".markdown": true,
+	".mdown":    true,
+	".mkd":      true,
+}
+
+func isReadme(name string) bool {
+	if licenseFilePat.MatchString(name) {
+		return false
+	}
+	return strings.HasPrefix(strings.ToLower(name), "readme") ||
+		markdownExts[strings.ToLower(path.Ext(name))]
+}
+
+// readmeBase holds the URLs used to resolve relative URLs in README files.
+type readmeBase struct {
+	// Browse URLs of the directory and of the repository root at the same
+	// revision.
+	dir, root string
+
+	// URLs of the raw file content in the directory and the repository
+	// root or "" if the raw content URLs are not known for the host.
+	rawDir, rawRoot string
+}
+
+// rawURLPats convert browse URLs for directories to raw content URLs.
+var rawURLPats = []struct {
+	pat  *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`^https://github\.com/([^/]+/[^/]+)/tree/(.+)$`), "https://raw.githubusercontent.com/$1/$2"},
+	{regexp.MustCompile(`^https://bitbucket\.org/([^/]+/[^/]+)/src/(.+)$`), "https://bitbucket.org/$1/raw/$2"},
+}
+
+func rawURL(browseURL string) string {
+	for _, p := range rawURLPats {
+		if p.pat.MatchString(browseURL) {
+			return p.pat.ReplaceAllString(browseURL, p.repl)
+		}
+	}
+	return ""
+}
+
+// newReadmeBase returns the base URLs for the README files in dir. The
+// repository root is found by removing the directory's path in the project
+// from the end of the directory browse URL.
+func newReadmeBase(dir *gosrc.Directory) readmeBase {
+	b := readmeBase{dir: dir.BrowseURL, root: dir.BrowseURL}
+	if sub := strings.TrimPrefix(dir.ImportPath, dir.ProjectRoot); sub != dir.ImportPath && strings.HasSuffix(dir.BrowseURL, sub) {
+		b.root = strings.TrimSuffix(dir.BrowseURL, sub)
+	}
+	b.rawDir = rawURL(b.dir)
+	b.rawRoot = rawURL(b.root)
+	return b
+}
+
+// newReadme renders a README file. Files with a markdown extension are
+// rendered as markdown. Other files are rendered as preformatted text.
+func newReadme(name, browseURL string, data []byte, base readmeBase) *Readme {
+	r := &Readme{Name: name, URL: browseURL}
+	if markdownExts[strings.ToLower(path.Ext(name))] {
+		r.HTML = renderMarkdown(data, base)
+	} else {
+		r.HTML = "<pre>" + html.EscapeString(string(data)) + "</pre>\n"
+	}
+	return r
+}
+
+type byReadmeName []*Readme
+
+func (s byReadmeName) Len() int      { return len(s) }
+func (s byReadmeName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byReadmeName) Less(i, j int) bool {
+	ri := strings.HasPrefix(strings.ToLower(s[i].Name), "readme")
+	rj := strings.HasPrefix(strings.ToLower(s[j].Name), "readme")
+	if ri != rj {
+		return ri
+	}
+	return s[i].Name < s[j].Name
+}
+
+func sortReadmes(readmes []*Readme) {
+	sort.Sort(byReadmeName(readmes))
+}
+
+var (
+	mdFencePat      = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})")
+	mdHeadingPat    = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	mdRulePat       = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	mdQuotePat      = regexp.MustCompile(`^ {0,3}> ?`)
+	mdListPat       = regexp.MustCompile(`^( {0,3})(?:([-*+])|([0-9]{1,9})[.)])(?:[ \t]+|$)`)
+	mdSetextPat     = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	mdTableSepPat   = regexp.MustCompile(`^ *\|? *:?-+:? *(?:\| *:?-+:? *)*\|? *$`)
+	mdLinkDefPat    = regexp.MustCompile(`^ {0,3}\[([^\]]+)\]:[ \t]*<?([^\s>]+)>?(?:[ \t]+(?:"[^"]*"|'[^']*'|\([^)]*\)))?[ \t]*$`)
+	mdAutolinkPat   = regexp.MustCompile(`^<((?:https?://|mailto:)[^\s<>]+)>`)
+	mdBareURLPat    = regexp.MustCompile(`^https?://[^\s<>"\[\]]*[^\s<>"\[\].,:;!?'()*_]`)
+	mdDestTitlePat  = regexp.MustCompile(`^<?([^\s>]*)>?(?:[ \t\n]+(?:"[^"]*"|'[^']*'|\([^)]*\)))?$`)
+	mdPunctuation   = "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+	mdBlockStartPat = []*regexp.Regexp{mdFencePat, mdHeadingPat, mdRulePat, mdQuotePat, mdListPat}
+)
+
+// markdown holds the state used to render a markdown file.
+type markdown struct {
+	buf             bytes.Buffer
+	dir, root       *url.URL
+	rawDir, rawRoot *url.URL
+	refs            map[string]string
+}
+
+// parseBaseURL parses a base URL for resolving relative URLs. Nil is
+// returned if the URL is empty or not valid.
+func parseBaseURL(s string) *url.URL {
+	if s == "" {
+		return nil
+	}
+	u, err := url.Parse(strings.TrimSuffix(s, "/") + "/")
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+// renderMarkdown converts markdown to HTML. Raw HTML in the source is
+// escaped. Relative URLs are resolved against the URLs in base.
+func renderMarkdown(src []byte, base readmeBase) string {
+	m := &markdown{
+		dir:     parseBaseURL(base.dir),
+		root:    parseBaseURL(base.root),
+		rawDir:  parseBaseURL(base.rawDir),
+		rawRoot: parseBaseURL(base.rawRoot),
+		refs:    make(map[string]string),
+	}
+	lines := strings.Split(strings.Replace(string(src), "\r\n", "\n", -1), "\n")
+	for i, line := range lines {
+		lines[i] = expandTabs(line)
+	}
+	m.blocks(m.linkDefs(lines), false)
+	return m.buf.String()
+}
+
+func expandTabs(line string) string {
+	if strings.IndexByte(line, '\t') < 0 {
+		return line
+	}
+	var buf []byte
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\t' {
+			n := 4 - len(buf)%4
+			buf = append(buf, "    "[:n]...)
+		} else {
+			buf = append(buf, line[i])
+		}
+	}
+	return string(buf)
+}
+
+func indentWidth(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// linkDefs records the link reference definitions outside of fenced code
+// blocks and returns the remaining lines.
+func (m *markdown) linkDefs(lines []string) []string {
+	var result []string
+	fence := ""
+	for _, line := range lines {
+		if fence != "" {
+			if strings.HasPrefix(strings.TrimSpace(line), fence) {
+				fence = ""
+			}
+		} else if f := mdFencePat.FindStringSubmatch(line); f != nil {
+			fence = f[1]
+		} else if d := mdLinkDefPat.FindStringSubmatch(line); d != nil {
+			label := strings.ToLower(d[1])
+			if _, ok := m.refs[label]; !ok {
+				m.refs[label] = d[2]
+			}
+			continue
+		}
+		result = append(result, line)
+	}
+	return result
+}
+
+func isBlockStart(line string) bool {
+	for _, pat := range mdBlockStartPat {
+		if pat.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// blocks renders block level elements. Paragraphs in tight list items are
+// rendered without the enclosing <p> element.
+func (m *markdown) blocks(lines []string, tight bool) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case isBlank(line):
+			i++
+		case mdFencePat.MatchString(line):
+			i = m.fencedCode(lines, i)
+		case mdHeadingPat.MatchString(line):
+			h := mdHeadingPat.FindStringSubmatch(line)
+			m.heading(len(h[1]), h[2])
+			i++
+		case mdRulePat.MatchString(line):
+			m.buf.WriteString("<hr>\n")
+			i++
+		case mdQuotePat.MatchString(line):
+			var quote []string
+			for ; i < len(lines) && !isBlank(lines[i]); i++ {
+				quote = append(quote, mdQuotePat.ReplaceAllString(lines[i], ""))
+			}
+			m.buf.WriteString("<blockquote>\n")
+			m.blocks(quote, false)
+			m.buf.WriteString("</blockquote>\n")
+		case mdListPat.MatchString(line):
+			i = m.list(lines, i)
+		case indentWidth(line) >= 4:
+			j := i
+			for j < len(lines) && (isBlank(lines[j]) || indentWidth(lines[j]) >= 4) {
+				j++
+			}
+			for isBlank(lines[j-1]) {
+				j--
+			}
+			m.buf.WriteString("<pre><code>")
+			for _, line := range lines[i:j] {
+				if len(line) >= 4 {
+					line = line[4:]
+				} else {
+					line = ""
+				}
+				m.buf.WriteString(html.EscapeString(line))
+				m.buf.WriteByte('\n')
+			}
+			m.buf.WriteString("</code></pre>\n")
+			i = j
+		case i+1 < len(lines) && strings.Contains(line, "|") && mdTableSepPat.MatchString(lines[i+1]) &&
+			strings.Contains(lines[i+1], "|"):
+			i = m.table(lines, i)
+		default:
+			i = m.paragraph(lines, i, tight)
+		}
+	}
+}
+
+func (m *markdown) fencedCode(lines []string, i int) int {
+	fence := mdFencePat.FindStringSubmatch(lines[i])[1]
+	indent := indentWidth(lines[i])
+	m.buf.WriteString("<pre><code>")
+	for i++; i < len(lines); i++ {
+		line := lines[i]
+		if strings.HasPrefix(strings.TrimSpace(line), fence) && strings.Trim(strings.TrimSpace(line), fence[:1]) == "" {
+			i++
+			break
+		}
+		n := indentWidth(line)
+		if n > indent {
+			n = indent
+		}
+		m.buf.WriteString(html.EscapeString(line[n:]))
+		m.buf.WriteByte('\n')
+	}
+	m.buf.WriteString("</code></pre>\n")
+	return i
+}
+
+func (m *markdown) heading(level int, text string) {
+	tag := "h" + strconv.Itoa(level)
+	m.buf.WriteString("<" + tag + ">")
+	m.inline(strings.TrimSpace(text))
+	m.buf.WriteString("</" + tag + ">\n")
+}
+
+func (m *markdown) paragraph(lines []string, i int, tight bool) int {
+	var text []string
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if isBlank(line) {
+			break
+		}
+		if len(text) > 0 {
+			if s := mdSetextPat.FindStringSubmatch(line); s != nil {
+				level := 1
+				if s[1][0] == '-' {
+					level = 2
+				}
+				m.heading(level, strings.Join(text, "\n"))
+				return i + 1
+			}
+			if isBlockStart(line) {
+				break
+			}
+		}
+		text = append(text, strings.TrimLeft(line, " "))
+	}
+	if !tight {
+		m.buf.WriteString("<p>")
+	}
+	m.inline(strings.Join(text, "\n"))
+	if !tight {
+		m.buf.WriteString("</p>")
+	}
+	m.buf.WriteByte('\n')
+	return i
+}
+
+func splitTableRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	line = strings.TrimSuffix(line, "|")
+	cells := strings.Split(line, "|")
+	for i := range cells {
+		cells[i] = strings.TrimSpace(cells[i])
+	}
+	return cells
+}
+
+func (m *markdown) table(lines []string, i int) int {
+	m.buf.WriteString("<table>\n<thead>\n<tr>")
+	for _, cell := range splitTableRow(lines[i]) {
+		m.buf.WriteString("<th>")
+		m.inline(cell)
+		m.buf.WriteString("</th>")
+	}
+	m.buf.WriteString("</tr>\n</thead>\n<tbody>\n")
+	for i += 2; i < len(lines) && !isBlank(lines[i]) && strings.Contains(lines[i], "|"); i++ {
+		m.buf.WriteString("<tr>")
+		for _, cell := range splitTableRow(lines[i]) {
+			m.buf.WriteString("<td>")
+			m.inline(cell)
+			m.buf.WriteString("</td>")
+		}
+		m.buf.WriteString("</tr>\n")
+	}
+	m.buf.WriteString("</tbody>\n</table>\n")
+	return i
+}
+
+// list renders the list starting at lines[i] and returns the index of the
+// line following the list.
+func (m *markdown) list(lines []string, i int) int {
+	first := mdListPat.FindStringSubmatch(lines[i])
+	ordered := first[3] != ""
+	indent := len(first[1])
+
+	var items [][]string
+	loose := false
+	for i < len(lines) {
+		mark := mdListPat.FindStringSubmatch(lines[i])
+		if mark == nil || (mark[3] != "") != ordered || len(mark[1]) > indent+1 {
+			break
+		}
+		contentIndent := len(mark[0])
+		if rest := lines[i][len(mark[0]):]; isBlank(rest) || len(mark[0])-len(strings.TrimRight(mark[0], " ")) > 4 {
+			contentIndent = len(strings.TrimRight(mark[0], " ")) + 1
+		}
+		item := []string{strings.TrimLeft(lines[i][len(mark[0]):], " ")}
+		if len(lines[i]) < contentIndent {
+			item[0] = ""
+		}
+		i++
+		for i < len(lines) {
+			line := lines[i]
+			if isBlank(line) {
+				j := i
+				for j < len(lines) && isBlank(lines[j]) {
+					j++
+				}
+				if j < len(lines) && indentWidth(lines[j]) >= contentIndent {
+					loose = true
+					for ; i < j; i++ {
+						item = append(item, "")
+					}
+					continue
+				}
+				if j < len(lines) && mdListPat.MatchString(lines[j]) {
+					if next := mdListPat.FindStringSubmatch(lines[j]); (next[3] != "") == ordered && len(next[1]) <= indent+1 {
+						loose = true
+					}
+				}
+				break
+			}
+			if indentWidth(line) >= contentIndent {
+				item = append(item, line[contentIndent:])
+			} else if !isBlockStart(line) && !isBlank(item[len(item)-1]) {
+				// Lazy continuation of a paragraph.
+				item = append(item, strings.TrimLeft(line, " "))
+			} else {
+				break
+			}
+			i++
+		}
+		items = append(items, item)
+		if i < len(lines) && isBlank(lines[i]) {
+			j := i
+			for j < len(lines) && isBlank(lines[j]) {
+				j++
+			}
+			if j < len(lines) && mdListPat.MatchString(lines[j]) {
+				i = j
+			}
+		}
+	}
+
+	if ordered {
+		if n, _ := strconv.Atoi(first[3]); n != 1 {
+			m.buf.WriteString(`<ol start="` + strconv.Itoa(n) + `">` + "\n")
+		} else {
+			m.buf.WriteString("<ol>\n")
+		}
+	} else {
+		m.buf.WriteString("<ul>\n")
+	}
+	for _, item := range items {
+		m.buf.WriteString("<li>")
+		if loose {
+			m.buf.WriteByte('\n')
+		}
+		m.blocks(item, !loose)
+		m.buf.WriteString("</li>\n")
+	}
+	if ordered {
+		m.buf.WriteString("</ol>\n")
+	} else {
+		m.buf.WriteString("</ul>\n")
+	}
+	return i
+}
+
+// inline renders the text of a paragraph, heading, table cell or tight list
+// item.
+func (m *markdown) inline(s string) {
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte(mdPunctuation, s[i+1]) >= 0:
+			m.buf.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\n':
+			m.buf.WriteString("<br>\n")
+			i += 2
+			continue
+		case c == '`':
+			if n := m.codeSpan(s[i:]); n > 0 {
+				i += n
+				continue
+			}
+		case c == '!' && i+1 < len(s) && s[i+1] == '[':
+			if n := m.link(s[i:], true); n > 0 {
+				i += n
+				continue
+			}
+		case c == '[':
+			if n := m.link(s[i:], false); n > 0 {
+				i += n
+				continue
+			}
+		case c == '<':
+			if a := mdAutolinkPat.FindStringSubmatch(s[i:]); a != nil {
+				m.writeLink(a[1], a[1])
+				i += len(a[0])
+				continue
+			}
+		case c == '*' || c == '_':
+			if n := m.emphasis(s, i); n > 0 {
+				i += n
+				continue
+			}
+		case c == 'h' && (i == 0 || !isWordByte(s[i-1])):
+			if u := mdBareURLPat.FindString(s[i:]); u != "" {
+				m.writeLink(u, u)
+				i += len(u)
+				continue
+			}
+		case c == '\n':
+			if strings.HasSuffix(s[:i], "  ") {
+				m.buf.WriteString("<br>")
+			}
+		}
+		m.buf.WriteString(html.EscapeString(s[i : i+1]))
+		i++
+	}
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c >= 0x80
+}
+
+// codeSpan renders the code span at the start of s and returns the length
+// of the span or 0 if there is no span.
+func (m *markdown) codeSpan(s string) int {
+	n := len(s) - len(strings.TrimLeft(s, "`"))
+	ticks := s[:n]
+	for i := n; i < len(s); {
+		j := strings.Index(s[i:], ticks)
+		if j < 0 {
+			return 0
+		}
+		j += i
+		k := j + n
+		if k < len(s) && s[k] == '`' {
+			i = k + len(s[k:]) - len(strings.TrimLeft(s[k:], "`"))
+			continue
+		}
+		code := strings.Replace(s[n:j], "\n", " ", -1)
+		if len(code) > 1 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.TrimSpace(code) != "" {
+			code = code[1 : len(code)-1]
+		}
+		m.buf.WriteString("<code>" + html.EscapeString(code) + "</code>")
+		return k
+	}
+	return 0
+}
+
+// emphasis renders emphasis starting at s[i] and returns the length of the
+// emphasized text including delimiters or 0 if there is no emphasis.
+func (m *markdown) emphasis(s string, i int) int {
+	c := s[i]
+	n := len(s[i:]) - len(strings.TrimLeft(s[i:], s[i:i+1]))
+	if n > 2 {
+		return 0
+	}
+	if i+n >= len(s) || s[i+n] == ' ' || s[i+n] == '\n' {
+		return 0
+	}
+	if c == '_' && i > 0 && isWordByte(s[i-1]) {
+		return 0
+	}
+	delim := s[i : i+n]
+	for j := i + n; j < len(s); {
+		k := strings.Index(s[j:], delim)
+		if k < 0 {
+			return 0
+		}
+		k += j
+		end := k + n
+		if s[k-1] == ' ' || s[k-1] == '\n' || (end < len(s) && s[end] == c) ||
+			(c == '_' && end < len(s) && isWordByte(s[end])) {
+			j = k + 1
+			for j < len(s) && s[j] == c {
+				j++
+			}
+			continue
+		}
+		tag := "em"
+		if n == 2 {
+			tag = "strong"
+		}
+		m.buf.WriteString("<" + tag + ">")
+		m.inline(s[i+n : k])
+		m.buf.WriteString("</" + tag + ">")
+		return end - i
+	}
+	return 0
+}
+
+// link renders the link or image at the start of s and returns the length
+// of the link or 0 if there is no link.
+func (m *markdown) link(s string, image bool) int {
+	start := 1
+	if image {
+		start = 2
+	}
+	depth := 0
+	end := -1
+	for i := start; i < len(s) && end < 0; i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '`':
+			i += len(s[i:]) - len(strings.TrimLeft(s[i:], "`")) - 1
+		case '[':
+			depth++
+		case ']':
+			if depth == 0 {
+				end = i
+			}
+			depth--
+		}
+	}
+	if end < 0 {
+		return 0
+	}
+	text := s[start:end]
+	rest := s[end+1:]
+	var dest string
+	var n int
+	switch {
+	case strings.HasPrefix(rest, "("):
+		depth := 0
+		close := -1
+		for i := 1; i < len(rest) && close < 0; i++ {
+			switch rest[i] {
+			case '\\':
+				i++
+			case '(':
+				depth++
+			case ')':
+				if depth == 0 {
+					close = i
+				}
+				depth--
+			}
+		}
+		if close < 0 {
+			return 0
+		}
+		d := mdDestTitlePat.FindStringSubmatch(strings.TrimSpace(rest[1:close]))
+		if d == nil {
+			return 0
+		}
+		dest = d[1]
+		n = end + 1 + close + 1
+	case strings.HasPrefix(rest, "["):
+		close := strings.IndexByte(rest, ']')
+		if close < 0 {
+			return 0
+		}
+		label := rest[1:close]
+		if label == "" {
+			label = text
+		}
+		var ok bool
+		if dest, ok = m.refs[strings.ToLower(label)]; !ok {
+			return 0
+		}
+		n = end + 1 + close + 1
+	default:
+		var ok bool
+		if dest, ok = m.refs[strings.ToLower(text)]; !ok {
+			return 0
+		}
+		n = end + 1
+	}
+
+	u := m.resolveURL(dest, image)
+	switch {
+	case image && u == "":
+		m.buf.WriteString(html.EscapeString(text))
+	case image:
+		m.buf.WriteString(`<img src="` + html.EscapeString(u) + `" alt="` + html.EscapeString(text) + `">`)
+	case u == "":
+		m.inline(text)
+	default:
+		m.buf.WriteString(`<a href="` + html.EscapeString(u) + `">`)
+		m.inline(text)
+		m.buf.WriteString("</a>")
+	}
+	return n
+}
+
+func (m *markdown) writeLink(u, text string) {
+	if u = m.resolveURL(u, false); u == "" {
+		m.buf.WriteString(html.EscapeString(text))
+		return
+	}
+	m.buf.WriteString(`<a href="` + html.EscapeString(u) + `">` + html.EscapeString(text) + "</a>")
+}
+
+// resolveURL resolves relative URLs. Relative links are resolved against
+// the directory browse URL and root-relative links against the repository
+// root browse URL. Images are resolved against the raw content URLs when
+// known. The empty string is returned for URLs with a scheme other than
+// http, https or, for links, mailto.
+func (m *markdown) resolveURL(s string, image bool) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return ""
+	}
+	switch {
+	case u.Scheme == "http" || u.Scheme == "https":
+		return u.String()
+	case u.Scheme == "mailto" && !image:
+		return u.String()
+	case u.Scheme != "" || u.Opaque != "":
+		return ""
+	case strings.HasPrefix(s, "#"):
+		return s
+	}
+	dir, root := m.dir, m.root
+	if image && m.rawDir != nil {
+		dir, root = m.rawDir, m.rawRoot
+	}
+	if u.Host == "" && strings.HasPrefix(u.Path, "/") && root != nil {
+		v := *u
+		v.Path = strings.TrimLeft(u.Path, "/")
+		return root.ResolveReference(&v).String()
+	}
+	if dir != nil {
+		return dir.ResolveReference(u).String()
+	}
+	return s
+}
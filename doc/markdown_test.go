@@ -0,0 +1,60 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package doc
+
+import (
+	"testing"
+
+	"github.com/garyburd/gosrc"
+)
+
+var markdownDir = &gosrc.Directory{
+	ImportPath:  "github.com/user/repo/dir",
+	ProjectRoot: "github.com/user/repo",
+	BrowseURL:   "https://github.com/user/repo/tree/master/dir",
+}
+
+var renderMarkdownTests = []struct {
+	src, html string
+}{
+	{"# Title\n\nSome *emphasis*, **strong** and `code <x>`.\n",
+		"<h1>Title</h1>\n<p>Some <em>emphasis</em>, <strong>strong</strong> and <code>code &lt;x&gt;</code>.</p>\n"},
+	{"Title\n=====\nSub\n---\n",
+		"<h1>Title</h1>\n<h2>Sub</h2>\n"},
+	{"snake_case_name and 2 * 3 * 4\n",
+		"<p>snake_case_name and 2 * 3 * 4</p>\n"},
+	{"<script>alert(1)</script>\n",
+		"<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+	{"[doc](doc.md) [abs](/LICENSE) [web](http://example.com/) [frag](#usage) [js](javascript:alert(1))\n",
+		`<p><a href="https://github.com/user/repo/tree/master/dir/doc.md">doc</a> ` +
+			`<a href="https://github.com/user/repo/tree/master/LICENSE">abs</a> ` +
+			`<a href="http://example.com/">web</a> ` +
+			`<a href="#usage">frag</a> js</p>` + "\n"},
+	{"[![Build](img/status.png)](https://travis-ci.org/user/repo)\n",
+		`<p><a href="https://travis-ci.org/user/repo"><img src="https://raw.githubusercontent.com/user/repo/master/dir/img/status.png" alt="Build"></a></p>` + "\n"},
+	{"![Logo](/doc/logo.png)\n",
+		`<p><img src="https://raw.githubusercontent.com/user/repo/master/doc/logo.png" alt="Logo"></p>` + "\n"},
+	{"See [the docs][docs] and http://example.com/x.\n\n[docs]: http://example.com/docs\n",
+		`<p>See <a href="http://example.com/docs">the docs</a> and <a href="http://example.com/x">http://example.com/x</a>.</p>` + "\n"},
+	{"```go\nif a < b {\n}\n```\n\n    indented\n",
+		"<pre><code>if a &lt; b {\n}\n</code></pre>\n<pre><code>indented\n</code></pre>\n"},
+	{"- one\n- two\n  - nested\n\n1. first\n2. second\n",
+		"<ul>\n<li>one\n</li>\n<li>two\n<ul>\n<li>nested\n</li>\n</ul>\n</li>\n</ul>\n<ol>\n<li>first\n</li>\n<li>second\n</li>\n</ol>\n"},
+	{"> quoted\n> text\n\n---\n",
+		"<blockquote>\n<p>quoted\ntext</p>\n</blockquote>\n<hr>\n"},
+	{"| a | b |\n|---|---|\n| 1 | 2 |\n",
+		"<table>\n<thead>\n<tr><th>a</th><th>b</th></tr>\n</thead>\n<tbody>\n<tr><td>1</td><td>2</td></tr>\n</tbody>\n</table>\n"},
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	base := newReadmeBase(markdownDir)
+	for _, tt := range renderMarkdownTests {
+		if html := renderMarkdown([]byte(tt.src), base); html != tt.html {
+			t.Errorf("renderMarkdown(%q) =\n%q\nwant\n%q", tt.src, html, tt.html)
+		}
+	}
+}
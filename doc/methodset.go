@@ -0,0 +1,198 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package doc
+
+import (
+	"bytes"
+	"go/types"
+	"sort"
+)
+
+// TypeRef refers to a named type.
+type TypeRef struct {
+	ImportPath string
+	Name       string
+
+	// Pointer is true if the relation holds for the pointer to the named type
+	// and not for the named type itself.
+	Pointer bool
+}
+
+// PromotedMethod is a method promoted to a type from an embedded field.
+type PromotedMethod struct {
+	Name string
+
+	// Decl is the method with the outer type as the receiver.
+	Decl Code
+
+	// Orig is the type that declares the method. Orig.Pointer is true if the
+	// method has a pointer receiver.
+	Orig TypeRef
+}
+
+type byTypeRef []*TypeRef
+
+func (s byTypeRef) Len() int      { return len(s) }
+func (s byTypeRef) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byTypeRef) Less(i, j int) bool {
+	if s[i].ImportPath != s[j].ImportPath {
+		return s[i].ImportPath < s[j].ImportPath
+	}
+	return s[i].Name < s[j].Name
+}
+
+func newTypeRef(obj *types.TypeName, pointer bool) *TypeRef {
+	return &TypeRef{ImportPath: obj.Pkg().Path(), Name: obj.Name(), Pointer: pointer}
+}
+
+// namedTypes returns the exported named types declared at package level in
+// pkg. Generic types are skipped.
+func namedTypes(pkg *types.Package) []*types.TypeName {
+	var result []*types.TypeName
+	scope := pkg.Scope()
+	for _, name := range scope.Names() {
+		obj, ok := scope.Lookup(name).(*types.TypeName)
+		if !ok || !obj.Exported() || obj.IsAlias() {
+			continue
+		}
+		if named, ok := obj.Type().(*types.Named); !ok || named.TypeParams().Len() > 0 {
+			continue
+		}
+		result = append(result, obj)
+	}
+	return result
+}
+
+func isInterface(obj *types.TypeName) bool {
+	_, ok := obj.Type().Underlying().(*types.Interface)
+	return ok
+}
+
+// implements returns true if t or *t implements the non-empty interface
+// iface. The pointer result is true if only *t implements the interface.
+func implements(t, iface *types.TypeName) (ok, pointer bool) {
+	it := iface.Type().Underlying().(*types.Interface)
+	switch {
+	case t == iface || it.NumMethods() == 0:
+		return false, false
+	case types.Implements(t.Type(), it):
+		return true, false
+	case !isInterface(t) && types.Implements(types.NewPointer(t.Type()), it):
+		return true, true
+	}
+	return false, false
+}
+
+// addMethodSets sets the promoted methods and the interface relations for the
+// types in the package. The interfaces considered are the interfaces declared
+// in the package and the interfaces declared in the directly imported
+// packages that were type checked by stdImporter.
+func (b *builder) addMethodSets(typs []*Type) {
+	if b.tpkg == nil {
+		return
+	}
+
+	local := namedTypes(b.tpkg)
+	var ifaces []*types.TypeName
+	for _, obj := range local {
+		if isInterface(obj) {
+			ifaces = append(ifaces, obj)
+		}
+	}
+	for _, pkg := range b.tpkg.Imports() {
+		for _, obj := range namedTypes(pkg) {
+			if isInterface(obj) {
+				ifaces = append(ifaces, obj)
+			}
+		}
+	}
+
+	for _, t := range typs {
+		obj, ok := b.tpkg.Scope().Lookup(t.Name).(*types.TypeName)
+		if !ok || obj.IsAlias() {
+			continue
+		}
+		if named, ok := obj.Type().(*types.Named); !ok || named.TypeParams().Len() > 0 {
+			continue
+		}
+
+		for _, iface := range ifaces {
+			if ok, pointer := implements(obj, iface); ok {
+				t.Implements = append(t.Implements, newTypeRef(iface, pointer))
+			}
+		}
+		sort.Sort(byTypeRef(t.Implements))
+
+		if isInterface(obj) {
+			for _, other := range local {
+				if ok, pointer := implements(other, obj); ok {
+					t.ImplementedBy = append(t.ImplementedBy, newTypeRef(other, pointer))
+				}
+			}
+			sort.Sort(byTypeRef(t.ImplementedBy))
+			continue
+		}
+
+		t.Promoted = b.promotedMethods(obj, t.Methods)
+	}
+}
+
+// promotedMethods returns the exported methods promoted to the type from
+// embedded fields. Methods already documented on the type are skipped.
+func (b *builder) promotedMethods(obj *types.TypeName, methods []*Func) []*PromotedMethod {
+	documented := make(map[string]bool)
+	for _, m := range methods {
+		documented[m.Name] = true
+	}
+
+	valueSet := types.NewMethodSet(obj.Type())
+	pointerSet := types.NewMethodSet(types.NewPointer(obj.Type()))
+	qualifier := func(pkg *types.Package) string {
+		if pkg == b.tpkg {
+			return ""
+		}
+		return pkg.Name()
+	}
+
+	var result []*PromotedMethod
+	for i := 0; i < pointerSet.Len(); i++ {
+		sel := pointerSet.At(i)
+		fn, ok := sel.Obj().(*types.Func)
+		if !ok || len(sel.Index()) < 2 || !fn.Exported() || documented[fn.Name()] {
+			continue
+		}
+		sig := fn.Type().(*types.Signature)
+		recv := sig.Recv().Type()
+		pointer := false
+		if p, ok := recv.(*types.Pointer); ok {
+			recv = p.Elem()
+			pointer = true
+		}
+		named, ok := recv.(*types.Named)
+		if !ok || named.Obj().Pkg() == nil {
+			// Method of an unnamed interface type or a predeclared type.
+			continue
+		}
+
+		var buf bytes.Buffer
+		buf.WriteString("func (")
+		if valueSet.Lookup(fn.Pkg(), fn.Name()) == nil {
+			buf.WriteByte('*')
+		}
+		buf.WriteString(obj.Name())
+		buf.WriteString(") ")
+		buf.WriteString(fn.Name())
+		types.WriteSignature(&buf, sig, qualifier)
+
+		result = append(result, &PromotedMethod{
+			Name: fn.Name(),
+			Decl: Code{Text: buf.String()},
+			Orig: *newTypeRef(named.Obj(), pointer),
+		})
+	}
+	return result
+}
@@ -0,0 +1,223 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package doc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/garyburd/gddo/config"
+	"github.com/garyburd/gosrc"
+)
+
+// Mirrors maps import path prefixes to local bare git repositories. Packages
+// with a mapped import path are read from the repository instead of the
+// hosting service.
+type Mirrors struct {
+	mirrors []*mirror
+
+	// Only restricts fetches to the mapped import paths. Fetches for other
+	// import paths return a not found error.
+	Only bool
+}
+
+type mirror struct {
+	// Import path of the repository root.
+	prefix string
+
+	// Path of the bare repository.
+	dir string
+
+	// Revision of the documentation, HEAD or a tag.
+	rev string
+}
+
+// ParseMirrors parses a mirror configuration. Each line in the configuration
+// is blank, a comment starting with #, or has the form
+//
+//	importPathPrefix repositoryPath [revision]
+//
+// The revision is HEAD if not specified. Relative repository paths are
+// relative to dir.
+func ParseMirrors(r io.Reader, name string, dir string) (*Mirrors, error) {
+	m := &Mirrors{}
+	err := config.Read(r, name, func(l *config.Line) error {
+		fields := l.Fields
+		if len(fields) < 2 || len(fields) > 3 {
+			return l.Errorf("expected import path prefix, repository path and optional revision")
+		}
+		mr := &mirror{prefix: strings.TrimSuffix(fields[0], "/"), dir: fields[1], rev: "HEAD"}
+		if !gosrc.IsValidRemotePath(mr.prefix) {
+			return l.Errorf("invalid import path prefix %q", mr.prefix)
+		}
+		if !filepath.IsAbs(mr.dir) && dir != "" {
+			mr.dir = filepath.Join(dir, mr.dir)
+		}
+		if len(fields) == 3 {
+			mr.rev = fields[2]
+		}
+		m.mirrors = append(m.mirrors, mr)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// mirrors is the mirror configuration used by Get.
+var mirrors *Mirrors
+
+// SetMirrors sets the mirror configuration used by Get.
+func SetMirrors(m *Mirrors) {
+	mirrors = m
+}
+
+// LoadMirrors sets the mirror configuration from the named file. Relative
+// repository paths in the file are relative to the directory containing the
+// file.
+func LoadMirrors(name string, only bool) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	m, err := ParseMirrors(f, name, filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	m.Only = only
+	SetMirrors(m)
+	return nil
+}
+
+// find returns the mirror with the longest prefix matching importPath.
+func (m *Mirrors) find(importPath string) *mirror {
+	var result *mirror
+	for _, mr := range m.mirrors {
+		if (importPath == mr.prefix || strings.HasPrefix(importPath, mr.prefix+"/")) &&
+			(result == nil || len(mr.prefix) > len(result.prefix)) {
+			result = mr
+		}
+	}
+	return result
+}
+
+// getDir fetches the directory for importPath from a mirror if the import
+// path is mapped, from a repository in the resolver table if the import path
+// matches a resolver, and from the hosting service otherwise. The boolean
+// result is true if the directory is not from the hosting service.
+func getDir(client *http.Client, importPath string, etag string) (*gosrc.Directory, bool, error) {
+	if mirrors != nil {
+		if mr := mirrors.find(importPath); mr != nil {
+			dir, err := mr.get(importPath, etag)
+			return dir, true, err
+		}
+	}
+	if r, projectRoot, repo := findResolver(importPath); r != nil {
+		dir, err := r.get(importPath, projectRoot, repo, etag)
+		return dir, true, err
+	}
+	if mirrors != nil && mirrors.Only {
+		return nil, false, gosrc.NotFoundError{Message: "no local mirror for " + importPath}
+	}
+	dir, err := gosrc.Get(client, importPath, etag)
+	return dir, false, err
+}
+
+// git runs a git command in the mirror repository and returns the output.
+func (mr *mirror) git(args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"--git-dir=" + mr.dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	p, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s in %s: %v %s", args[0], mr.dir, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return p, nil
+}
+
+// isMirrorFile returns true if the file with the given name is used to build
+// the documentation.
+func isMirrorFile(name string) bool {
+	if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+		return false
+	}
+	return strings.HasSuffix(name, ".go") || isReadme(name) || licenseFilePat.MatchString(name)
+}
+
+// isMirrorSubdirectory returns true if the directory with the given name can
+// contain packages.
+func isMirrorSubdirectory(name string) bool {
+	return !strings.HasPrefix(name, ".") && !strings.HasPrefix(name, "_") && name != "testdata"
+}
+
+// get reads the directory for importPath from the tree at the mirror
+// revision. The etag is the commit hash.
+func (mr *mirror) get(importPath string, etag string) (*gosrc.Directory, error) {
+	p, err := mr.git("rev-parse", "--verify", "--quiet", mr.rev+"^{commit}")
+	if err != nil {
+		return nil, gosrc.NotFoundError{Message: "revision " + mr.rev + " not found in mirror " + mr.dir}
+	}
+	commit := string(bytes.TrimSpace(p))
+	if commit == etag {
+		return nil, gosrc.ErrNotModified
+	}
+
+	// The ls-tree command fails if the path is missing or is not a
+	// directory.
+	sub := strings.TrimPrefix(importPath[len(mr.prefix):], "/")
+	p, err = mr.git("ls-tree", "-z", commit+":"+sub)
+	if err != nil {
+		return nil, gosrc.NotFoundError{Message: "directory " + sub + " not found in mirror " + mr.dir}
+	}
+
+	dir := &gosrc.Directory{
+		ImportPath:   importPath,
+		ProjectRoot:  mr.prefix,
+		ProjectName:  path.Base(mr.prefix),
+		ResolvedPath: importPath,
+		Etag:         commit,
+		VCS:          "git",
+	}
+
+	// Each entry has the form "mode type object\tname".
+	for _, entry := range bytes.Split(p, []byte{0}) {
+		i := bytes.IndexByte(entry, '\t')
+		if i < 0 {
+			continue
+		}
+		name := string(entry[i+1:])
+		info := strings.Fields(string(entry[:i]))
+		if len(info) != 3 {
+			continue
+		}
+		switch info[1] {
+		case "tree":
+			if isMirrorSubdirectory(name) {
+				dir.Subdirectories = append(dir.Subdirectories, name)
+			}
+		case "blob":
+			if !isMirrorFile(name) {
+				continue
+			}
+			data, err := mr.git("cat-file", "blob", info[2])
+			if err != nil {
+				return nil, err
+			}
+			dir.Files = append(dir.Files, &gosrc.File{Name: name, Data: data})
+		}
+	}
+	return dir, nil
+}
@@ -0,0 +1,184 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package doc
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/gosrc"
+)
+
+const mirrorConfig = `
+# Test mirrors.
+example.com/a a.git
+example.com/a/b /mirrors/b.git v1.0
+`
+
+func TestParseMirrors(t *testing.T) {
+	m, err := ParseMirrors(strings.NewReader(mirrorConfig), "config", "/base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*mirror{
+		{prefix: "example.com/a", dir: "/base/a.git", rev: "HEAD"},
+		{prefix: "example.com/a/b", dir: "/mirrors/b.git", rev: "v1.0"},
+	}
+	if !reflect.DeepEqual(m.mirrors, expected) {
+		t.Errorf("ParseMirrors() = %+v, want %+v", m.mirrors, expected)
+	}
+
+	for _, tt := range []struct {
+		importPath string
+		prefix     string
+	}{
+		{"example.com/a", "example.com/a"},
+		{"example.com/a/c", "example.com/a"},
+		{"example.com/a/b/c", "example.com/a/b"},
+		{"example.com/ab", ""},
+	} {
+		var prefix string
+		if mr := m.find(tt.importPath); mr != nil {
+			prefix = mr.prefix
+		}
+		if prefix != tt.prefix {
+			t.Errorf("find(%q) = %q, want %q", tt.importPath, prefix, tt.prefix)
+		}
+	}
+
+	for _, config := range []string{"example.com/a", "example.com/a a.git HEAD extra", "notapath a.git"} {
+		if _, err := ParseMirrors(strings.NewReader(config), "config", ""); err == nil {
+			t.Errorf("ParseMirrors(%q) did not return error", config)
+		}
+	}
+}
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=gopher", "GIT_AUTHOR_EMAIL=gopher@example.com",
+		"GIT_COMMITTER_NAME=gopher", "GIT_COMMITTER_EMAIL=gopher@example.com")
+	p, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, p)
+	}
+	return strings.TrimSpace(string(p))
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, data := range files {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func fileNames(dir *gosrc.Directory) []string {
+	var names []string
+	for _, f := range dir.Files {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func TestMirrorGet(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	tmp, err := ioutil.TempDir("", "gddo-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	work := filepath.Join(tmp, "work")
+	writeFiles(t, work, map[string]string{
+		"a.go":          "package a\n",
+		"README.md":     "# A\n",
+		"LICENSE":       "license\n",
+		"Makefile":      "all:\n",
+		"_x.go":         "package x\n",
+		"b/b.go":        "package b\n",
+		"testdata/t.go": "package t\n",
+	})
+	runGit(t, work, "init", "-q")
+	runGit(t, work, "add", ".")
+	runGit(t, work, "commit", "-q", "-m", "first")
+	runGit(t, work, "tag", "v1.0")
+	tagCommit := runGit(t, work, "rev-parse", "HEAD")
+	writeFiles(t, work, map[string]string{"c/c.go": "package c\n"})
+	runGit(t, work, "add", ".")
+	runGit(t, work, "commit", "-q", "-m", "second")
+	headCommit := runGit(t, work, "rev-parse", "HEAD")
+	runGit(t, tmp, "clone", "-q", "--bare", work, "a.git")
+
+	head := &mirror{prefix: "example.com/a", dir: filepath.Join(tmp, "a.git"), rev: "HEAD"}
+	tag := &mirror{prefix: "example.com/a", dir: filepath.Join(tmp, "a.git"), rev: "v1.0"}
+
+	dir, err := head.get("example.com/a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir.Etag != headCommit || dir.ProjectRoot != "example.com/a" || dir.ImportPath != "example.com/a" {
+		t.Errorf("get(example.com/a) = %+v", dir)
+	}
+	if names, expected := fileNames(dir), []string{"LICENSE", "README.md", "a.go"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("get(example.com/a) files = %v, want %v", names, expected)
+	}
+	if expected := []string{"b", "c"}; !reflect.DeepEqual(dir.Subdirectories, expected) {
+		t.Errorf("get(example.com/a) subdirectories = %v, want %v", dir.Subdirectories, expected)
+	}
+
+	dir, err = head.get("example.com/a/b", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names, expected := fileNames(dir), []string{"b.go"}; !reflect.DeepEqual(names, expected) || string(dir.Files[0].Data) != "package b\n" {
+		t.Errorf("get(example.com/a/b) files = %v, want %v", names, expected)
+	}
+
+	dir, err = tag.get("example.com/a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir.Etag != tagCommit || !reflect.DeepEqual(dir.Subdirectories, []string{"b"}) {
+		t.Errorf("get(example.com/a) at v1.0 = %+v", dir)
+	}
+
+	if _, err := head.get("example.com/a/b", headCommit); err != gosrc.ErrNotModified {
+		t.Errorf("get with current etag returned %v, want ErrNotModified", err)
+	}
+	if _, err := tag.get("example.com/a/c", ""); !gosrc.IsNotFound(err) {
+		t.Errorf("get(example.com/a/c) at v1.0 returned %v, want not found", err)
+	}
+	if _, err := head.get("example.com/a/a.go", ""); !gosrc.IsNotFound(err) {
+		t.Errorf("get(example.com/a/a.go) returned %v, want not found", err)
+	}
+
+	SetMirrors(&Mirrors{mirrors: []*mirror{head}, Only: true})
+	defer SetMirrors(nil)
+	l, err := GetLicense(nil, "example.com/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l == nil || l.File != "LICENSE" || l.ImportPath != "example.com/a" {
+		t.Errorf("GetLicense(example.com/a) = %+v", l)
+	}
+	if _, err := GetLicense(nil, "example.org/x"); !gosrc.IsNotFound(err) {
+		t.Errorf("GetLicense(example.org/x) returned %v, want not found", err)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package doc
+
+import (
+	"errors"
+	"go/ast"
+	"go/importer"
+	"go/token"
+	"go/types"
+	"sort"
+	"sync"
+
+	"github.com/garyburd/gosrc"
+)
+
+// Decl is a declaration in the package source and the references to the
+// declaration from the package source.
+type Decl struct {
+	// Name of a package level declaration or the type name, ".", and the
+	// name of a field or method.
+	Name string
+	Pos  Pos
+	Refs []Pos
+}
+
+// stdImporter type checks standard packages from the source in GOROOT. The
+// packages are shared by all builders because type checking the standard
+// library is expensive.
+var stdImporter = struct {
+	sync.Mutex
+	imp  types.Importer
+	pkgs map[string]*types.Package
+	errs map[string]error
+}{
+	imp:  importer.ForCompiler(token.NewFileSet(), "source", nil),
+	pkgs: make(map[string]*types.Package),
+	errs: make(map[string]error),
+}
+
+func importStd(path string) (*types.Package, error) {
+	stdImporter.Lock()
+	defer stdImporter.Unlock()
+	if pkg := stdImporter.pkgs[path]; pkg != nil {
+		return pkg, nil
+	}
+	if err := stdImporter.errs[path]; err != nil {
+		return nil, err
+	}
+	pkg, err := stdImporter.imp.Import(path)
+	if err != nil {
+		stdImporter.errs[path] = err
+		return nil, err
+	}
+	stdImporter.pkgs[path] = pkg
+	return pkg, nil
+}
+
+// fakeImporter returns the type checked standard packages or empty packages
+// with the names found by resolveImports or guessed from the import path.
+// Selectors on the empty packages are not resolved.
+type fakeImporter struct {
+	pkgs  map[string]*types.Package
+	names map[string]string
+}
+
+func (imp *fakeImporter) Import(path string) (*types.Package, error) {
+	if pkg := imp.pkgs[path]; pkg != nil {
+		return pkg, nil
+	}
+	if gosrc.IsGoRepoPath(path) {
+		if pkg, err := importStd(path); err == nil {
+			imp.pkgs[path] = pkg
+			return pkg, nil
+		}
+	}
+	name := imp.names[path]
+	if name == "" {
+		name = guessPackageName(path)
+	}
+	if name == "" {
+		return nil, errors.New("package not found")
+	}
+	pkg := types.NewPackage(path, name)
+	pkg.MarkComplete()
+	imp.pkgs[path] = pkg
+	return pkg, nil
+}
+
+// checkTypes type checks the package files and finds the declarations in the
+// files. Type errors are ignored because packages outside of the standard
+// library are not available to the checker.
+func (b *builder) checkTypes(importPath string, files []*ast.File) {
+	b.info = &types.Info{
+		Defs: make(map[*ast.Ident]types.Object),
+		Uses: make(map[*ast.Ident]types.Object),
+	}
+	conf := types.Config{
+		Importer:    &fakeImporter{pkgs: make(map[string]*types.Package), names: b.importNames},
+		FakeImportC: true,
+		Error:       func(error) {},
+	}
+	b.tpkg, _ = conf.Check(importPath, b.fset, files, b.info)
+
+	b.decls = make(map[types.Object]*Decl)
+	add := func(ident *ast.Ident, name string) {
+		if obj := b.info.Defs[ident]; obj != nil && ident.Name != "_" && ident.Name != "init" {
+			b.decls[obj] = &Decl{Name: name, Pos: b.position(ident)}
+		}
+	}
+	for _, file := range files {
+		for _, decl := range file.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				name := decl.Name.Name
+				if decl.Recv != nil && len(decl.Recv.List) == 1 {
+					recv := typeIdent(decl.Recv.List[0].Type)
+					if recv == nil {
+						continue
+					}
+					name = recv.Name + "." + name
+				}
+				add(decl.Name, name)
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					switch spec := spec.(type) {
+					case *ast.ValueSpec:
+						for _, ident := range spec.Names {
+							add(ident, ident.Name)
+						}
+					case *ast.TypeSpec:
+						add(spec.Name, spec.Name.Name)
+						var fields *ast.FieldList
+						switch t := spec.Type.(type) {
+						case *ast.StructType:
+							fields = t.Fields
+						case *ast.InterfaceType:
+							fields = t.Methods
+						}
+						if fields == nil {
+							continue
+						}
+						for _, f := range fields.List {
+							for _, ident := range f.Names {
+								add(ident, spec.Name.Name+"."+ident.Name)
+							}
+							if f.Names == nil {
+								// Embedded field or interface.
+								if ident := typeIdent(f.Type); ident != nil {
+									add(ident, spec.Name.Name+"."+ident.Name)
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// typeIdent returns the identifier for the type name in expression x.
+func typeIdent(x ast.Expr) *ast.Ident {
+	for {
+		switch t := x.(type) {
+		case *ast.Ident:
+			return t
+		case *ast.StarExpr:
+			x = t.X
+		case *ast.ParenExpr:
+			x = t.X
+		case *ast.SelectorExpr:
+			return t.Sel
+		case *ast.IndexExpr:
+			x = t.X
+		case *ast.IndexListExpr:
+			x = t.X
+		default:
+			return nil
+		}
+	}
+}
+
+type byDeclName []*Decl
+
+func (s byDeclName) Len() int           { return len(s) }
+func (s byDeclName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byDeclName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// declList returns the declarations found by checkTypes sorted by name.
+func (b *builder) declList() []*Decl {
+	result := make([]*Decl, 0, len(b.decls))
+	for _, d := range b.decls {
+		result = append(result, d)
+	}
+	sort.Sort(byDeclName(result))
+	return result
+}
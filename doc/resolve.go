@@ -0,0 +1,134 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package doc
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/gosrc"
+)
+
+// NameResolver returns the name of the package with the given import path or
+// the empty string if the name is not known.
+type NameResolver func(importPath string) (string, error)
+
+// resolveImports finds the names of the packages imported without an explicit
+// name in files. Names are found in this order:
+//
+//   - The last element of standard package import paths.
+//   - The resolve function.
+//   - The fetched source of packages in the same project as dir.
+//   - A guess using packageNamePats.
+//
+// Imports that are not found by one of the first three methods are recorded
+// in pkg.Diagnostics.
+func (b *builder) resolveImports(pkg *Package, dir *gosrc.Directory, ctxt *build.Context, files map[string]*ast.File, client *http.Client, resolve NameResolver) {
+	paths := make(map[string]bool)
+	for _, file := range files {
+		for _, spec := range file.Imports {
+			if spec.Name != nil {
+				continue
+			}
+			if p, err := strconv.Unquote(spec.Path.Value); err == nil && p != "C" {
+				paths[p] = true
+			}
+		}
+	}
+
+	b.importNames = make(map[string]string)
+	var diagnostics []string
+	for p := range paths {
+		var name string
+		var err error
+		switch {
+		case gosrc.IsGoRepoPath(p):
+			name = path.Base(p)
+		case resolve != nil:
+			name, err = resolve(p)
+		}
+		if name == "" && err == nil && client != nil && dir.ProjectRoot != "" &&
+			(p == dir.ProjectRoot || strings.HasPrefix(p, dir.ProjectRoot+"/")) {
+			name, err = fetchPackageName(client, ctxt, p)
+		}
+		if name != "" {
+			b.importNames[p] = name
+			continue
+		}
+
+		message := fmt.Sprintf("Unresolved import %q", p)
+		if guess := guessPackageName(p); guess != "" {
+			b.importNames[p] = guess
+			message += fmt.Sprintf(", assuming package name %q", guess)
+		}
+		if err != nil {
+			message += fmt.Sprintf(" (%v)", err)
+		}
+		diagnostics = append(diagnostics, message)
+	}
+	sort.Strings(diagnostics)
+	pkg.Diagnostics = append(pkg.Diagnostics, diagnostics...)
+}
+
+// Time that fetched package names are cached.
+const fetchedNameTTL = time.Hour
+
+// Maximum number of cached package names.
+const maxFetchedNames = 10000
+
+type fetchedName struct {
+	name    string
+	err     error
+	fetched time.Time
+}
+
+// fetchedNames caches the results of fetchPackageName. The crawls of the
+// packages in a project share the fetches of the project's packages that are
+// not in the database yet.
+var fetchedNames = struct {
+	sync.Mutex
+	m map[string]fetchedName
+}{m: make(map[string]fetchedName)}
+
+// fetchPackageName returns the name of the package at importPath from the
+// cache or fetches the source for the package and returns the name.
+func fetchPackageName(client *http.Client, ctxt *build.Context, importPath string) (string, error) {
+	now := time.Now()
+	fetchedNames.Lock()
+	f, ok := fetchedNames.m[importPath]
+	fetchedNames.Unlock()
+	if ok && now.Sub(f.fetched) < fetchedNameTTL {
+		return f.name, f.err
+	}
+
+	f = fetchedName{fetched: now}
+	var dir *gosrc.Directory
+	dir, _, f.err = getDir(client, importPath, "")
+	if f.err == nil {
+		var bpkg *build.Package
+		bpkg, f.err = dir.Import(ctxt, 0)
+		if f.err == nil {
+			f.name = bpkg.Name
+		}
+	}
+
+	fetchedNames.Lock()
+	if len(fetchedNames.m) >= maxFetchedNames {
+		fetchedNames.m = make(map[string]fetchedName)
+	}
+	fetchedNames.m[importPath] = f
+	fetchedNames.Unlock()
+	return f.name, f.err
+}
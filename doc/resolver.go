@@ -0,0 +1,274 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package doc
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/gddo/config"
+	"github.com/garyburd/gosrc"
+)
+
+// Resolver describes how to fetch and browse the source for import paths
+// that are not handled by the hosting services known to gosrc.
+type Resolver struct {
+	// Import path of the project root. The last element of the path can be
+	// {repo} to match every project in a directory.
+	Prefix string
+
+	// Version control system. Only git is supported.
+	VCS string
+
+	// Repository URL. The string {repo} is replaced with the repository
+	// name matched by the prefix.
+	RepoURL string
+
+	// Source browser URL template. The strings {repo}, {commit} and {path}
+	// are replaced with the repository name, the commit hash and the slash
+	// separated path of a file or directory relative to the project root.
+	BrowseURL string
+
+	// Format for the URL of a line in a file. The format is applied to the
+	// file browse URL and the line number.
+	LineFmt string
+}
+
+// ParseResolvers parses a resolver table. Each line in the table is blank, a
+// comment starting with #, or has the form
+//
+//	prefix vcs repoURL browseURL [lineFmt]
+func ParseResolvers(r io.Reader, name string) ([]*Resolver, error) {
+	var rs []*Resolver
+	err := config.Read(r, name, func(l *config.Line) error {
+		fields := l.Fields
+		if len(fields) < 4 || len(fields) > 5 {
+			return l.Errorf("expected prefix, vcs, repository URL, browse URL and optional line format")
+		}
+		r := &Resolver{Prefix: strings.TrimSuffix(fields[0], "/"), VCS: fields[1], RepoURL: fields[2], BrowseURL: fields[3]}
+		if len(fields) == 5 {
+			r.LineFmt = fields[4]
+		}
+		if !gosrc.IsValidRemotePath(r.Base()) {
+			return l.Errorf("invalid prefix %q", r.Prefix)
+		}
+		if r.VCS != "git" {
+			return l.Errorf("vcs %q not supported", r.VCS)
+		}
+		rs = append(rs, r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+var (
+	// resolvers is the resolver table used by Get.
+	resolvers []*Resolver
+
+	// resolverCacheDir is the directory for the local clones of the
+	// resolved repositories.
+	resolverCacheDir string
+)
+
+// SetResolvers sets the resolver table used by Get. Repositories are cloned
+// to cacheDir.
+func SetResolvers(rs []*Resolver, cacheDir string) {
+	resolvers = rs
+	resolverCacheDir = cacheDir
+}
+
+// LoadResolvers sets the resolver table from the named file and returns the
+// table.
+func LoadResolvers(name string, cacheDir string) ([]*Resolver, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rs, err := ParseResolvers(f, name)
+	if err != nil {
+		return nil, err
+	}
+	SetResolvers(rs, cacheDir)
+	return rs, nil
+}
+
+// Base returns the prefix without the trailing {repo} element.
+func (r *Resolver) Base() string {
+	return strings.TrimSuffix(r.Prefix, "/{repo}")
+}
+
+// HasRepo returns true if the last element of the prefix is {repo}.
+func (r *Resolver) HasRepo() bool {
+	return r.Base() != r.Prefix
+}
+
+// match returns the project root and repository name for importPath.
+func (r *Resolver) match(importPath string) (projectRoot, repo string, ok bool) {
+	base := r.Base()
+	if !r.HasRepo() {
+		if importPath == base || strings.HasPrefix(importPath, base+"/") {
+			return base, "", true
+		}
+		return "", "", false
+	}
+	if !strings.HasPrefix(importPath, base+"/") {
+		return "", "", false
+	}
+	repo = importPath[len(base)+1:]
+	if i := strings.Index(repo, "/"); i >= 0 {
+		repo = repo[:i]
+	}
+	return base + "/" + repo, repo, true
+}
+
+// findResolver returns the resolver with the longest prefix matching
+// importPath. A prefix without {repo} is longer than the same prefix with
+// {repo}.
+func findResolver(importPath string) (r *Resolver, projectRoot, repo string) {
+	for _, x := range resolvers {
+		if root, name, ok := x.match(importPath); ok && (r == nil || len(x.Base()) > len(r.Base())) {
+			r, projectRoot, repo = x, root, name
+		}
+	}
+	return r, projectRoot, repo
+}
+
+// expand replaces the variables in a resolver URL template.
+func expand(template, repo, commit, p string) string {
+	s := strings.NewReplacer("{repo}", repo, "{commit}", commit, "{path}", p).Replace(template)
+	if p == "" {
+		s = strings.TrimSuffix(s, "/")
+	}
+	return s
+}
+
+const (
+	// Minimum time between fetches of a resolved repository.
+	minFetchInterval = time.Minute
+
+	// Time that a failed fetch is reported without fetching the repository
+	// again.
+	failedFetchInterval = 10 * time.Minute
+
+	// Number of fetch states kept before the unused states are removed.
+	maxFetchStates = 10000
+)
+
+// fetchState is the state of the local clone of a resolved repository. The
+// mutex serializes the git commands for the clone.
+type fetchState struct {
+	sync.Mutex
+	fetched time.Time // last successful fetch
+	failed  time.Time // last failed fetch
+	err     error     // error from the last failed fetch
+	used    time.Time
+}
+
+var fetchStates = struct {
+	sync.Mutex
+	m map[string]*fetchState
+}{m: make(map[string]*fetchState)}
+
+// getFetchState returns the fetch state for the clone at dir.
+func getFetchState(dir string) *fetchState {
+	now := time.Now()
+	fetchStates.Lock()
+	defer fetchStates.Unlock()
+	if len(fetchStates.m) >= maxFetchStates {
+		for k, fs := range fetchStates.m {
+			if now.Sub(fs.used) > failedFetchInterval {
+				delete(fetchStates.m, k)
+			}
+		}
+	}
+	fs := fetchStates.m[dir]
+	if fs == nil {
+		fs = &fetchState{}
+		fetchStates.m[dir] = fs
+	}
+	fs.used = now
+	return fs
+}
+
+// fetch clones the repository at url to the mirror or updates the mirror if
+// it exists. The fetch is skipped if the mirror was updated recently. The
+// error from a failed fetch is returned without fetching again until
+// failedFetchInterval passes.
+func (mr *mirror) fetch(url string) error {
+	fs := getFetchState(mr.dir)
+	fs.Lock()
+	defer fs.Unlock()
+	now := time.Now()
+	if now.Sub(fs.failed) < failedFetchInterval {
+		return fs.err
+	}
+	if now.Sub(fs.fetched) < minFetchInterval {
+		return nil
+	}
+	if err := mr.clone(url); err != nil {
+		fs.failed, fs.err = now, err
+		return err
+	}
+	fs.fetched, fs.failed, fs.err = now, time.Time{}, nil
+	return nil
+}
+
+// clone clones the repository at url to the mirror or updates the mirror if
+// it exists.
+func (mr *mirror) clone(url string) error {
+	if _, err := os.Stat(mr.dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(mr.dir), 0777); err != nil {
+			return err
+		}
+		p, err := exec.Command("git", "clone", "--mirror", "--quiet", url, mr.dir).CombinedOutput()
+		if err != nil {
+			os.RemoveAll(mr.dir)
+			return fmt.Errorf("git clone %s: %v %s", url, err, strings.TrimSpace(string(p)))
+		}
+		return nil
+	}
+	_, err := mr.git("remote", "update", "--prune")
+	return err
+}
+
+// get fetches the directory for importPath from the repository.
+func (r *Resolver) get(importPath, projectRoot, repo, etag string) (*gosrc.Directory, error) {
+	mr := &mirror{
+		prefix: projectRoot,
+		dir:    filepath.Join(resolverCacheDir, filepath.FromSlash(projectRoot)+".git"),
+		rev:    "HEAD",
+	}
+	if err := mr.fetch(expand(r.RepoURL, repo, "", "")); err != nil {
+		return nil, err
+	}
+	dir, err := mr.get(importPath, etag)
+	if err != nil {
+		return nil, err
+	}
+	sub := strings.TrimPrefix(importPath[len(projectRoot):], "/")
+	dir.VCS = r.VCS
+	dir.LineFmt = r.LineFmt
+	if r.BrowseURL != "" {
+		dir.ProjectURL = expand(r.BrowseURL, repo, dir.Etag, "")
+		dir.BrowseURL = expand(r.BrowseURL, repo, dir.Etag, sub)
+		for _, f := range dir.Files {
+			f.BrowseURL = expand(r.BrowseURL, repo, dir.Etag, path.Join(sub, f.Name))
+		}
+	}
+	return dir, nil
+}
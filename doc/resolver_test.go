@@ -0,0 +1,132 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package doc
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/gosrc"
+)
+
+const resolverTable = `
+# Test resolvers.
+go.corp.example/{repo} git https://git.corp.example/{repo}.git https://code.corp.example/{repo}/blob/{commit}/{path} %s#L%d
+go.corp.example/tools git https://git.corp.example/tools.git https://code.corp.example/tools/blob/{commit}/{path}
+`
+
+var resolverMatchTests = []struct {
+	importPath  string
+	projectRoot string
+	repo        string
+}{
+	{"go.corp.example/a", "go.corp.example/a", "a"},
+	{"go.corp.example/a/b/c", "go.corp.example/a", "a"},
+	{"go.corp.example/tools/x", "go.corp.example/tools", ""},
+	{"go.corp.example", "", ""},
+	{"example.com/a", "", ""},
+}
+
+func TestResolvers(t *testing.T) {
+	rs, err := ParseResolvers(strings.NewReader(resolverTable), "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 2 || rs[0].LineFmt != "%s#L%d" || rs[1].LineFmt != "" || !rs[0].HasRepo() || rs[1].HasRepo() {
+		t.Fatalf("ParseResolvers() = %+v", rs)
+	}
+
+	defer SetResolvers(nil, "")
+	SetResolvers(rs, "")
+	for _, tt := range resolverMatchTests {
+		_, projectRoot, repo := findResolver(tt.importPath)
+		if projectRoot != tt.projectRoot || repo != tt.repo {
+			t.Errorf("findResolver(%q) = %q, %q, want %q, %q", tt.importPath, projectRoot, repo, tt.projectRoot, tt.repo)
+		}
+	}
+
+	for _, table := range []string{
+		"go.corp.example/{repo} git https://git.corp.example/{repo}.git",
+		"go.corp.example/{repo} hg https://hg.corp.example/{repo} https://code.corp.example/{repo}",
+		"corp/{repo} git https://git.corp.example/{repo}.git https://code.corp.example/{repo}",
+	} {
+		if _, err := ParseResolvers(strings.NewReader(table), "table"); err == nil {
+			t.Errorf("ParseResolvers(%q) did not return error", table)
+		}
+	}
+}
+
+func TestResolverGet(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	tmp, err := ioutil.TempDir("", "gddo-resolver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	work := filepath.Join(tmp, "repos", "a")
+	writeFiles(t, work, map[string]string{"b/b.go": "package b\n"})
+	runGit(t, work, "init", "-q")
+	runGit(t, work, "add", ".")
+	runGit(t, work, "commit", "-q", "-m", "first")
+	commit := runGit(t, work, "rev-parse", "HEAD")
+
+	r := &Resolver{
+		Prefix:    "go.corp.example/{repo}",
+		VCS:       "git",
+		RepoURL:   filepath.Join(tmp, "repos", "{repo}"),
+		BrowseURL: "https://code.corp.example/{repo}/blob/{commit}/{path}",
+		LineFmt:   "%s#L%d",
+	}
+	defer SetResolvers(nil, "")
+	SetResolvers([]*Resolver{r}, filepath.Join(tmp, "cache"))
+
+	dir, custom, err := getDir(nil, "go.corp.example/a/b", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !custom {
+		t.Errorf("getDir() did not use resolver")
+	}
+	base := "https://code.corp.example/a/blob/" + commit
+	if dir.ProjectRoot != "go.corp.example/a" || dir.Etag != commit || dir.LineFmt != "%s#L%d" ||
+		dir.ProjectURL != base || dir.BrowseURL != base+"/b" ||
+		len(dir.Files) != 1 || dir.Files[0].BrowseURL != base+"/b/b.go" {
+		t.Errorf("getDir() = %+v", dir)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "cache", "go.corp.example", "a.git")); err != nil {
+		t.Errorf("repository not cloned: %v", err)
+	}
+
+	if _, _, err := getDir(nil, "go.corp.example/a/b", commit); err != gosrc.ErrNotModified {
+		t.Errorf("getDir() with current etag returned %v, want ErrNotModified", err)
+	}
+
+	// A failed clone is an error, not a missing package, and the failure is
+	// reported without cloning again.
+	_, _, err = getDir(nil, "go.corp.example/c", "")
+	if err == nil || gosrc.IsNotFound(err) {
+		t.Fatalf("getDir() for missing repository returned %v, want clone error", err)
+	}
+	work = filepath.Join(tmp, "repos", "c")
+	writeFiles(t, work, map[string]string{"c.go": "package c\n"})
+	runGit(t, work, "init", "-q")
+	runGit(t, work, "add", ".")
+	runGit(t, work, "commit", "-q", "-m", "first")
+	if _, _, err := getDir(nil, "go.corp.example/c", ""); err == nil {
+		t.Errorf("getDir() after failed clone returned nil error, want cached error")
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "cache", "go.corp.example", "c.git")); !os.IsNotExist(err) {
+		t.Errorf("failed clone left repository: %v", err)
+	}
+}
@@ -6,9 +6,15 @@
 
 package doc
 
+import "strings"
+
 type sliceWriter struct{ p *[]byte }
 
 func (w sliceWriter) Write(p []byte) (int, error) {
 	*w.p = append(*w.p, p...)
 	return len(p), nil
 }
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
@@ -0,0 +1,83 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/garyburd/gddo/config"
+	"github.com/garyburd/gddo/database"
+)
+
+var reindexCommand = &command{
+	name:  "reindex",
+	run:   reindex,
+	usage: "reindex [-credentials file]",
+}
+
+var reindexCredentials string
+
+func init() {
+	reindexCommand.flag.StringVar(&reindexCredentials, "credentials", "", "Credentials file of the server. The private directives in the file determine the private packages.")
+}
+
+// reindex recomputes the search terms and scores for every package in the
+// database. The server can run while the index is rebuilt.
+func reindex(c *command) {
+	if len(c.flag.Args()) != 0 {
+		c.printUsage()
+		os.Exit(1)
+	}
+	var isPrivate func(string) bool
+	if reindexCredentials != "" {
+		prefixes, err := readPrivatePrefixes(reindexCredentials)
+		if err != nil {
+			log.Fatal(err)
+		}
+		isPrivate = func(importPath string) bool {
+			for _, p := range prefixes {
+				if importPath == p || strings.HasPrefix(importPath, p+"/") {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	db, err := database.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	start := time.Now()
+	err = db.Reindex(isPrivate, func(n, total int) {
+		log.Printf("Reindexed %d of %d documents in %v", n, total, time.Since(start))
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// readPrivatePrefixes returns the import path prefixes in the lines of the
+// form "prefix private" in a server credentials file. Other lines are
+// ignored.
+func readPrivatePrefixes(name string) ([]string, error) {
+	var prefixes []string
+	err := config.ReadFile(name, func(l *config.Line) error {
+		fields := l.Fields
+		if len(fields) < 2 || fields[1] != "private" {
+			return nil
+		}
+		if len(fields) != 2 {
+			return l.Errorf("private directive does not take arguments")
+		}
+		prefixes = append(prefixes, strings.TrimSuffix(fields[0], "/"))
+		return nil
+	})
+	return prefixes, err
+}
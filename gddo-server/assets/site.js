@@ -70,6 +70,21 @@ $(function() {
         return true;
     });
 
+    $('#x-search-query').typeahead({
+        name: 'packages',
+        limit: 10,
+        remote: {
+            url: '/-/complete?q=%QUERY',
+            filter: function(data) {
+                return $.map(data.results, function(pkg) {
+                    return {value: pkg.path, tokens: [pkg.path]};
+                });
+            }
+        }
+    }).on('typeahead:selected', function(e, datum) {
+        window.location = '/' + datum.value;
+    });
+
     $('span.timeago').timeago();
     if (window.location.hash.substring(0, 9) == '#example-') {
         var id = '#ex-' + window.location.hash.substring(9);
@@ -0,0 +1,527 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/garyburd/gddo/config"
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+	"github.com/garyburd/gddo/httputil"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	authMethod     = flag.String("auth", "", "User authentication method: basic, header or oidc. Users are not authenticated if not set.")
+	usersFile      = flag.String("users", "", "File with lines of the form \"name bcryptHash group...\" for basic authentication.")
+	userHeader     = flag.String("auth_user_header", "X-Forwarded-User", "Request header with the user name set by a trusted proxy for header authentication.")
+	groupsHeader   = flag.String("auth_groups_header", "X-Forwarded-Groups", "Request header with the comma separated user groups set by a trusted proxy for header authentication.")
+	trustedProxies = flag.String("auth_trusted_proxies", "", "Comma separated CIDR ranges of the trusted proxies for header authentication. The headers are ignored on requests from other addresses.")
+	aclFile        = flag.String("acl", "", "File with lines of the form \"importPathPrefix group...\" restricting access to packages.")
+	adminGroup     = flag.String("admin_group", "admin", "User group that can view the server status pages.")
+)
+
+// user is an authenticated user.
+type user struct {
+	name   string
+	groups []string
+}
+
+// authenticator identifies the user making a request.
+type authenticator interface {
+	// user returns the user for the request or nil if the request is not
+	// authenticated.
+	user(req *http.Request) *user
+
+	// challenge responds to a request for a page that requires
+	// authentication.
+	challenge(resp http.ResponseWriter, req *http.Request) error
+}
+
+// auth is the configured authenticator or nil if users are not
+// authenticated.
+var auth authenticator
+
+// userKey and peerAddrKey are the request context keys for the user and the
+// address of the connection peer.
+type (
+	userKey     struct{}
+	peerAddrKey struct{}
+)
+
+// withPeerAddr returns a shallow copy of the request with the connection
+// peer address in the request context. runHandler calls withPeerAddr before
+// replacing the remote address with the address forwarded by the proxy.
+func withPeerAddr(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), peerAddrKey{}, req.RemoteAddr))
+}
+
+// peerAddr returns the address of the connection peer.
+func peerAddr(req *http.Request) string {
+	if s, ok := req.Context().Value(peerAddrKey{}).(string); ok {
+		return s
+	}
+	return req.RemoteAddr
+}
+
+// withUser returns a shallow copy of the request with the authenticated user
+// in the request context.
+func withUser(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), userKey{}, authenticate(req)))
+}
+
+// requestUser returns the user for the request or nil if the request is not
+// authenticated. The user for requests served by runHandler is resolved once
+// by withUser.
+func requestUser(req *http.Request) *user {
+	if u, ok := req.Context().Value(userKey{}).(*user); ok {
+		return u
+	}
+	return authenticate(req)
+}
+
+// authenticate returns the user for the request or nil if the request is not
+// authenticated. Requests with the access token are authenticated as a user
+// with no groups.
+func authenticate(req *http.Request) *user {
+	if *accessToken != "" {
+		const prefix = "Bearer "
+		s := req.Header.Get("Authorization")
+		if strings.HasPrefix(s, prefix) &&
+			subtle.ConstantTimeCompare([]byte(s[len(prefix):]), []byte(*accessToken)) == 1 {
+			return &user{name: "token"}
+		}
+	}
+	if auth == nil {
+		return nil
+	}
+	return auth.user(req)
+}
+
+// authenticated returns true if the request is authenticated.
+func authenticated(req *http.Request) bool {
+	return requestUser(req) != nil
+}
+
+// isAdmin returns true if the request is from a member of the admin group.
+func isAdmin(req *http.Request) bool {
+	u := requestUser(req)
+	if u == nil || *adminGroup == "" {
+		return false
+	}
+	for _, g := range u.groups {
+		if g == *adminGroup {
+			return true
+		}
+	}
+	return false
+}
+
+// basicAuth authenticates users with HTTP basic authentication.
+type basicAuth struct {
+	users map[string]*basicUser
+}
+
+type basicUser struct {
+	hash   []byte
+	groups []string
+}
+
+// parseUsers parses a basic authentication user file. Each line in the file
+// is blank, a comment starting with #, or has the form
+//
+//	name bcryptHash group...
+//
+// where bcryptHash is the bcrypt hash of the password as written by
+// htpasswd -nB.
+func parseUsers(r io.Reader, name string) (*basicAuth, error) {
+	a := &basicAuth{users: make(map[string]*basicUser)}
+	err := config.Read(r, name, func(l *config.Line) error {
+		fields := l.Fields
+		if len(fields) < 2 {
+			return l.Errorf("expected name, password hash and groups")
+		}
+		hash := []byte(fields[1])
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return l.Errorf("bad bcrypt password hash: %v", err)
+		}
+		a.users[fields[0]] = &basicUser{hash: hash, groups: fields[2:]}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *basicAuth) user(req *http.Request) *user {
+	const prefix = "Basic "
+	s := req.Header.Get("Authorization")
+	if !strings.HasPrefix(s, prefix) {
+		return nil
+	}
+	p, err := base64.StdEncoding.DecodeString(s[len(prefix):])
+	if err != nil {
+		return nil
+	}
+	i := strings.IndexByte(string(p), ':')
+	if i < 0 {
+		return nil
+	}
+	name, password := string(p[:i]), string(p[i+1:])
+	u := a.users[name]
+	if u == nil {
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword(u.hash, []byte(password)) != nil {
+		return nil
+	}
+	return &user{name: name, groups: u.groups}
+}
+
+func (a *basicAuth) challenge(resp http.ResponseWriter, req *http.Request) error {
+	resp.Header().Set("WWW-Authenticate", `Basic realm="GoDoc"`)
+	resp.Header().Set("Content-Type", textMIMEType)
+	resp.WriteHeader(http.StatusUnauthorized)
+	io.WriteString(resp, http.StatusText(http.StatusUnauthorized))
+	return nil
+}
+
+// headerAuth authenticates users with request headers set by a trusted
+// proxy. The proxy must remove the headers from client requests. The headers
+// are ignored on requests that do not come from a trusted proxy address.
+type headerAuth struct {
+	userHeader, groupsHeader string
+	proxies                  []*net.IPNet
+}
+
+// trusted returns true if the connection peer is a trusted proxy.
+func (a *headerAuth) trusted(req *http.Request) bool {
+	ip := net.ParseIP(httputil.StripPort(peerAddr(req)))
+	if ip == nil {
+		return false
+	}
+	for _, n := range a.proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *headerAuth) user(req *http.Request) *user {
+	if !a.trusted(req) {
+		return nil
+	}
+	name := req.Header.Get(a.userHeader)
+	if name == "" {
+		return nil
+	}
+	u := &user{name: name}
+	for _, g := range strings.Split(req.Header.Get(a.groupsHeader), ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			u.groups = append(u.groups, g)
+		}
+	}
+	return u
+}
+
+func (a *headerAuth) challenge(resp http.ResponseWriter, req *http.Request) error {
+	// The proxy is responsible for authentication.
+	return &httpError{status: http.StatusNotFound}
+}
+
+// aclEntry restricts access to the packages under an import path prefix.
+type aclEntry struct {
+	prefix string
+	groups map[string]bool
+}
+
+// accessList is a list of ACL entries sorted by prefix.
+type accessList []*aclEntry
+
+func (acl accessList) Len() int           { return len(acl) }
+func (acl accessList) Swap(i, j int)      { acl[i], acl[j] = acl[j], acl[i] }
+func (acl accessList) Less(i, j int) bool { return acl[i].prefix < acl[j].prefix }
+
+// parseACL parses an access control list. Each line in the list is blank, a
+// comment starting with #, or has the form
+//
+//	importPathPrefix group...
+//
+// Packages are allowed for members of the groups in the entry with the
+// longest prefix matching the import path. The group "*" matches all
+// authenticated users and the group "all" matches all users. Packages that
+// do not match an entry are allowed for all users.
+func parseACL(r io.Reader, name string) (accessList, error) {
+	var acl accessList
+	seen := make(map[string]bool)
+	err := config.Read(r, name, func(l *config.Line) error {
+		fields := l.Fields
+		prefix := strings.TrimSuffix(fields[0], "/")
+		if len(fields) < 2 || prefix == "" {
+			return l.Errorf("expected import path prefix and groups")
+		}
+		if seen[prefix] {
+			return l.Errorf("duplicate prefix %q", prefix)
+		}
+		seen[prefix] = true
+		e := &aclEntry{prefix: prefix, groups: make(map[string]bool)}
+		for _, g := range fields[1:] {
+			e.groups[g] = true
+		}
+		acl = append(acl, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(acl)
+	return acl, nil
+}
+
+// acl is the configured access control list.
+var acl accessList
+
+// find returns the entry with the longest prefix matching importPath or nil
+// if no entry matches.
+func (acl accessList) find(importPath string) *aclEntry {
+	var result *aclEntry
+	for _, e := range acl {
+		if hasPathPrefix(importPath, e.prefix) && (result == nil || len(e.prefix) > len(result.prefix)) {
+			result = e
+		}
+	}
+	return result
+}
+
+// allows returns true if the entry allows access by the user.
+func (e *aclEntry) allows(u *user) bool {
+	if e.groups["all"] {
+		return true
+	}
+	if u == nil {
+		return false
+	}
+	if e.groups["*"] {
+		return true
+	}
+	for _, g := range u.groups {
+		if e.groups[g] {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccess returns true if the user can view the package with the given
+// import path. The user is nil for requests that are not authenticated.
+func canAccess(u *user, importPath string) bool {
+	if u == nil && credentials.isPrivate(importPath) {
+		return false
+	}
+	e := acl.find(importPath)
+	return e == nil || e.allows(u)
+}
+
+// searchAccess returns the packages visible to the user in search results.
+// Private packages are hidden from unauthenticated users by the configured
+// private prefixes as well as by the privacy recorded in the index, so that
+// packages indexed before a prefix was made private are not shown.
+func searchAccess(u *user) database.Access {
+	access := database.Access{Private: u != nil}
+	if u == nil {
+		var prefixes []string
+		for p := range credentials.private {
+			prefixes = append(prefixes, p)
+		}
+		sort.Strings(prefixes)
+		for _, p := range prefixes {
+			access.Hidden = append(access.Hidden, database.HiddenPrefix{Prefix: p})
+		}
+	}
+	for _, e := range acl {
+		if e.allows(u) {
+			continue
+		}
+		h := database.HiddenPrefix{Prefix: e.prefix}
+		for _, x := range acl {
+			if x != e && hasPathPrefix(x.prefix, e.prefix) {
+				h.Except = append(h.Except, x.prefix)
+			}
+		}
+		access.Hidden = append(access.Hidden, h)
+	}
+	return access
+}
+
+// canView returns true if the request can view the package. The privacy of
+// the package is determined by the current credentials configuration, not
+// by the Private field recorded when the package was fetched.
+func canView(req *http.Request, pdoc *doc.Package) bool {
+	if pdoc == nil {
+		return true
+	}
+	return canAccess(requestUser(req), pdoc.ImportPath)
+}
+
+// checkView returns nil if the request can view the package. Otherwise,
+// unauthenticated requests are challenged for credentials and other requests
+// get a not found error.
+func checkView(resp http.ResponseWriter, req *http.Request, pdoc *doc.Package) (bool, error) {
+	if canView(req, pdoc) {
+		return true, nil
+	}
+	return false, denyView(resp, req)
+}
+
+// denyView challenges unauthenticated requests for credentials and returns a
+// not found error for other requests.
+func denyView(resp http.ResponseWriter, req *http.Request) error {
+	if auth != nil && !authenticated(req) {
+		return auth.challenge(resp, req)
+	}
+	return &httpError{status: http.StatusNotFound}
+}
+
+// filterPackages returns the packages that the request can view.
+func filterPackages(req *http.Request, pkgs []database.Package) []database.Package {
+	if len(acl) == 0 && len(credentials.private) == 0 {
+		return pkgs
+	}
+	u := requestUser(req)
+	result := pkgs[:0]
+	for _, pkg := range pkgs {
+		if canAccess(u, pkg.Path) {
+			result = append(result, pkg)
+		}
+	}
+	return result
+}
+
+// filterSearchResults returns the search results that the request can view.
+func filterSearchResults(req *http.Request, results []database.SearchResult) []database.SearchResult {
+	if len(acl) == 0 && len(credentials.private) == 0 {
+		return results
+	}
+	u := requestUser(req)
+	result := results[:0]
+	for _, r := range results {
+		if canAccess(u, r.Path) {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// filterGraph removes the packages that the request cannot view from an
+// import graph.
+func filterGraph(req *http.Request, pkgs []database.Package, edges [][2]int) ([]database.Package, [][2]int) {
+	if len(acl) == 0 && len(credentials.private) == 0 {
+		return pkgs, edges
+	}
+	u := requestUser(req)
+	index := make([]int, len(pkgs))
+	var result []database.Package
+	for i, pkg := range pkgs {
+		index[i] = -1
+		if i == 0 || canAccess(u, pkg.Path) {
+			index[i] = len(result)
+			result = append(result, pkg)
+		}
+	}
+	var resultEdges [][2]int
+	for _, e := range edges {
+		if index[e[0]] >= 0 && index[e[1]] >= 0 {
+			resultEdges = append(resultEdges, [2]int{index[e[0]], index[e[1]]})
+		}
+	}
+	return result, resultEdges
+}
+
+// serveLogin asks for credentials and redirects to the page in the next
+// parameter after the user is authenticated.
+func serveLogin(resp http.ResponseWriter, req *http.Request) error {
+	if auth == nil {
+		return &httpError{status: http.StatusNotFound}
+	}
+	if !authenticated(req) {
+		return auth.challenge(resp, req)
+	}
+	http.Redirect(resp, req, safeRedirect(req.Form.Get("next")), 302)
+	return nil
+}
+
+// safeRedirect returns next if it is a path on this server and "/"
+// otherwise.
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func loadAuth() error {
+	if *aclFile != "" {
+		f, err := os.Open(*aclFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		acl, err = parseACL(f, *aclFile)
+		if err != nil {
+			return err
+		}
+	}
+	switch *authMethod {
+	case "":
+	case "basic":
+		f, err := os.Open(*usersFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		a, err := parseUsers(f, *usersFile)
+		if err != nil {
+			return err
+		}
+		auth = a
+	case "header":
+		if *trustedProxies == "" {
+			return fmt.Errorf("header authentication requires -auth_trusted_proxies")
+		}
+		a := &headerAuth{userHeader: *userHeader, groupsHeader: *groupsHeader}
+		for _, s := range strings.Split(*trustedProxies, ",") {
+			_, n, err := net.ParseCIDR(strings.TrimSpace(s))
+			if err != nil {
+				return fmt.Errorf("bad -auth_trusted_proxies: %v", err)
+			}
+			a.proxies = append(a.proxies, n)
+		}
+		auth = a
+	case "oidc":
+		a, err := newOIDCAuth()
+		if err != nil {
+			return err
+		}
+		auth = a
+	default:
+		return fmt.Errorf("unknown auth method %q", *authMethod)
+	}
+	return nil
+}
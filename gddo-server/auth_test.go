@@ -0,0 +1,257 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package main
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/gddo/database"
+	"github.com/garyburd/gddo/doc"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testACL = `
+# Test ACL.
+corp.example.com         *
+corp.example.com/secret  security
+corp.example.com/secret/docs all
+`
+
+var canAccessTests = []struct {
+	user       *user
+	importPath string
+	ok         bool
+}{
+	{nil, "example.com/a", true},
+	{nil, "corp.example.com/a", false},
+	{&user{name: "a"}, "corp.example.com/a", true},
+	{&user{name: "a"}, "corp.example.com/secret/a", false},
+	{&user{name: "a", groups: []string{"security"}}, "corp.example.com/secret/a", true},
+	{nil, "corp.example.com/secret/docs", true},
+	{nil, "corp.example.com/secretary", false},
+}
+
+func TestACL(t *testing.T) {
+	defer func(old accessList) { acl = old }(acl)
+	var err error
+	acl, err = parseACL(strings.NewReader(testACL), "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range canAccessTests {
+		if ok := canAccess(tt.user, tt.importPath); ok != tt.ok {
+			t.Errorf("canAccess(%+v, %q) = %v, want %v", tt.user, tt.importPath, ok, tt.ok)
+		}
+	}
+
+	access := searchAccess(&user{name: "a"})
+	expected := database.Access{
+		Private: true,
+		Hidden:  []database.HiddenPrefix{{Prefix: "corp.example.com/secret", Except: []string{"corp.example.com/secret/docs"}}},
+	}
+	if !reflect.DeepEqual(access, expected) {
+		t.Errorf("searchAccess() = %+v, want %+v", access, expected)
+	}
+
+	for _, s := range []string{"corp.example.com", "a *\na security"} {
+		if _, err := parseACL(strings.NewReader(s), "acl"); err == nil {
+			t.Errorf("parseACL(%q) did not return error", s)
+		}
+	}
+}
+
+func TestFilterGraph(t *testing.T) {
+	defer func(old accessList) { acl = old }(acl)
+	acl = accessList{{prefix: "corp.example.com", groups: map[string]bool{"*": true}}}
+
+	pkgs := []database.Package{{Path: "example.com/a"}, {Path: "corp.example.com/b"}, {Path: "example.com/c"}}
+	edges := [][2]int{{0, 1}, {0, 2}, {1, 2}}
+	req, _ := http.NewRequest("GET", "http://localhost/example.com/a?view=import-graph", nil)
+	pkgs, edges = filterGraph(req, pkgs, edges)
+	if len(pkgs) != 2 || pkgs[1].Path != "example.com/c" || !reflect.DeepEqual(edges, [][2]int{{0, 1}}) {
+		t.Errorf("filterGraph() = %v, %v", pkgs, edges)
+	}
+}
+
+func TestRefreshAccess(t *testing.T) {
+	defer func(old accessList) { acl = old }(acl)
+	acl = accessList{{prefix: "corp.example.com", groups: map[string]bool{"*": true}}}
+	defer func(a authenticator) { auth = a }(auth)
+
+	for _, tt := range []struct {
+		auth   authenticator
+		status int
+	}{
+		{nil, http.StatusNotFound},
+		{&basicAuth{}, http.StatusUnauthorized},
+	} {
+		auth = tt.auth
+		req, _ := http.NewRequest("POST", "http://localhost/-/refresh", strings.NewReader("path=corp.example.com/a"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.ParseForm()
+		resp := httptest.NewRecorder()
+		err := serveRefresh(resp, req)
+		status := resp.Code
+		if e, ok := err.(*httpError); ok {
+			status = e.status
+		}
+		if status != tt.status {
+			t.Errorf("serveRefresh() with auth %T status = %d, want %d", tt.auth, status, tt.status)
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	h, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := parseUsers(strings.NewReader("alice "+string(h)+" dev ops\n"), "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseUsers(strings.NewReader("alice sha256:salt:hash\n"), "users"); err == nil {
+		t.Error("parseUsers did not return error for non-bcrypt hash")
+	}
+	for _, tt := range []struct {
+		auth string
+		user *user
+	}{
+		{"", nil},
+		{"alice:password", &user{name: "alice", groups: []string{"dev", "ops"}}},
+		{"alice:wrong", nil},
+		{"bob:password", nil},
+	} {
+		req, _ := http.NewRequest("GET", "http://localhost/", nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(tt.auth)))
+		}
+		if u := a.user(req); !reflect.DeepEqual(u, tt.user) {
+			t.Errorf("user(%q) = %+v, want %+v", tt.auth, u, tt.user)
+		}
+	}
+}
+
+func TestHeaderAuth(t *testing.T) {
+	_, proxy, _ := net.ParseCIDR("10.0.0.0/8")
+	a := &headerAuth{userHeader: "X-Forwarded-User", groupsHeader: "X-Forwarded-Groups", proxies: []*net.IPNet{proxy}}
+	req, _ := http.NewRequest("GET", "http://localhost/", nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+	if u := a.user(req); u != nil {
+		t.Errorf("user() = %+v, want nil", u)
+	}
+	req.Header.Set("X-Forwarded-User", "alice")
+	req.Header.Set("X-Forwarded-Groups", "dev, ops")
+	expected := &user{name: "alice", groups: []string{"dev", "ops"}}
+	if u := a.user(req); !reflect.DeepEqual(u, expected) {
+		t.Errorf("user() = %+v, want %+v", u, expected)
+	}
+	req.RemoteAddr = "192.0.2.1:1234"
+	if u := a.user(req); u != nil {
+		t.Errorf("user() from untrusted address = %+v, want nil", u)
+	}
+}
+
+func TestHeaderAuthRealIP(t *testing.T) {
+	defer func(a authenticator) { auth = a }(auth)
+	defer func(p *policy) { robotPolicy = p }(robotPolicy)
+	var err error
+	robotPolicy, err = parsePolicy(strings.NewReader(""), "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, proxy, _ := net.ParseCIDR("127.0.0.1/32")
+	auth = &headerAuth{userHeader: "X-Forwarded-User", groupsHeader: "X-Forwarded-Groups", proxies: []*net.IPNet{proxy}}
+	for _, tt := range []struct {
+		remoteAddr, realIP string
+		user               *user
+	}{
+		{"127.0.0.1:1234", "192.0.2.1", &user{name: "alice"}},
+		{"192.0.2.1:1234", "127.0.0.1", nil},
+	} {
+		req, _ := http.NewRequest("GET", "http://localhost/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		req.Header.Set("X-Real-Ip", tt.realIP)
+		req.Header.Set("X-Forwarded-User", "alice")
+		var u *user
+		runHandler(httptest.NewRecorder(), req, func(resp http.ResponseWriter, req *http.Request) error {
+			u = requestUser(req)
+			return nil
+		}, handleError, nil)
+		if !reflect.DeepEqual(u, tt.user) {
+			t.Errorf("user from %s with X-Real-Ip %s = %+v, want %+v", tt.remoteAddr, tt.realIP, u, tt.user)
+		}
+	}
+}
+
+func TestIsAdmin(t *testing.T) {
+	defer func(a authenticator) { auth = a }(auth)
+	_, proxy, _ := net.ParseCIDR("127.0.0.0/8")
+	auth = &headerAuth{userHeader: "X-Forwarded-User", groupsHeader: "X-Forwarded-Groups", proxies: []*net.IPNet{proxy}}
+	for _, tt := range []struct {
+		groups string
+		ok     bool
+	}{
+		{"dev, admin", true},
+		{"dev", false},
+	} {
+		req, _ := http.NewRequest("GET", "http://localhost/-/talkers", nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("X-Forwarded-User", "alice")
+		req.Header.Set("X-Forwarded-Groups", tt.groups)
+		if ok := isAdmin(req); ok != tt.ok {
+			t.Errorf("isAdmin() with groups %q = %v, want %v", tt.groups, ok, tt.ok)
+		}
+	}
+}
+
+func TestImportsView(t *testing.T) {
+	defer func(old accessList) { acl = old }(acl)
+	acl = accessList{{prefix: "corp.example.com", groups: map[string]bool{"*": true}}}
+	defer func(old string) { *assetsDir = old }(*assetsDir)
+	*assetsDir = "assets"
+	cacheBusters.Handler = http.NotFoundHandler()
+	if err := parseHTMLTemplates([][]string{{"imports.html", "common.html", "layout.html"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	pdoc := &doc.Package{ImportPath: "example.com/a", Name: "a", Imports: []string{"example.com/b", "corp.example.com/c"}}
+	pkgs := []database.Package{{Path: "example.com/b"}, {Path: "corp.example.com/c"}}
+	req, _ := http.NewRequest("GET", "http://localhost/example.com/a?imports", nil)
+	resp := httptest.NewRecorder()
+	if err := serveImports(resp, req, pdoc, pkgs); err != nil {
+		t.Fatal(err)
+	}
+	body := resp.Body.String()
+	if !strings.Contains(body, "example.com/b") || strings.Contains(body, "corp.example.com/c") {
+		t.Errorf("imports view shows restricted packages or hides allowed packages:\n%s", body)
+	}
+}
+
+var safeRedirectTests = []struct {
+	next, expected string
+}{
+	{"/example.com/a?view=import-graph", "/example.com/a?view=import-graph"},
+	{"", "/"},
+	{"http://evil.example/", "/"},
+	{"//evil.example/", "/"},
+	{"/\\evil.example/", "/"},
+}
+
+func TestSafeRedirect(t *testing.T) {
+	for _, tt := range safeRedirectTests {
+		if actual := safeRedirect(tt.next); actual != tt.expected {
+			t.Errorf("safeRedirect(%q) = %q, want %q", tt.next, actual, tt.expected)
+		}
+	}
+}
@@ -8,20 +8,29 @@ package main
 
 import (
 	"flag"
-	"github.com/garyburd/gosrc"
-	"log"
 	"time"
 )
 
-var backgroundTasks = []*struct {
+// Maximum number of times the interval of a failing task is doubled.
+const maxTaskBackoff = 5
+
+type backgroundTask struct {
 	name     string
 	fn       func() error
 	interval *time.Duration
 	next     time.Time
-}{
+
+	// Error accounting.
+	runs              int
+	errors            int
+	consecutiveErrors int
+	lastError         error
+}
+
+var backgroundTasks = []*backgroundTask{
 	{
 		name:     "GitHub updates",
-		fn:       readGitHubUpdates,
+		fn:       readUpdates("github", gitHubSource{}),
 		interval: flag.Duration("github_interval", 0, "Github updates crawler sleeps for this duration between fetches. Zero disables the crawler."),
 	},
 	{
@@ -29,10 +38,15 @@ var backgroundTasks = []*struct {
 		fn:       doCrawl,
 		interval: flag.Duration("crawl_interval", 0, "Package updater sleeps for this duration between package updates. Zero disables updates."),
 	},
+	{
+		name:     "Import ranks",
+		fn:       updateImportRanks,
+		interval: flag.Duration("import_rank_interval", 0, "Import graph PageRank is recomputed after this duration. Zero disables the computation."),
+	},
 }
 
 func runBackgroundTasks() {
-	defer log.Println("ERROR: Background exiting!")
+	defer logEvent(levelError, "background exiting")
 
 	sleep := time.Minute
 	for _, task := range backgroundTasks {
@@ -45,27 +59,47 @@ func runBackgroundTasks() {
 		for _, task := range backgroundTasks {
 			start := time.Now()
 			if *task.interval > 0 && start.After(task.next) {
-				if err := task.fn(); err != nil {
-					log.Printf("Task %s: %v", task.name, err)
-				}
-				task.next = time.Now().Add(*task.interval)
+				task.next = time.Now().Add(task.run())
 			}
 		}
 		time.Sleep(sleep)
 	}
 }
 
+// run runs the task and returns the duration to wait before the next run.
+// The interval is doubled for each consecutive error up to maxTaskBackoff
+// times.
+func (task *backgroundTask) run() time.Duration {
+	task.runs++
+	taskRuns.inc(task.name)
+	err := task.fn()
+	if err == nil {
+		task.consecutiveErrors = 0
+		return *task.interval
+	}
+	task.errors++
+	taskErrors.inc(task.name)
+	task.consecutiveErrors++
+	task.lastError = err
+	logEvent(levelError, "task", "task", task.name, "error", err, "consecutive", task.consecutiveErrors, "errors", task.errors, "runs", task.runs)
+	interval := *task.interval
+	for i := 1; i < task.consecutiveErrors && i <= maxTaskBackoff; i++ {
+		interval *= 2
+	}
+	return interval
+}
+
 func doCrawl() error {
 	// Look for new package to crawl.
 	importPath, hasSubdirs, err := db.PopNewCrawl()
 	if err != nil {
-		log.Printf("db.PopNewCrawl() returned error %v", err)
+		logEvent(levelError, "db.PopNewCrawl", "error", err)
 		return nil
 	}
 	if importPath != "" {
-		if pdoc, err := crawlDoc("new", importPath, nil, hasSubdirs, time.Time{}); pdoc == nil && err == nil {
+		if pdoc, err := crawlDoc(nil, "new", importPath, nil, hasSubdirs, time.Time{}); pdoc == nil && err == nil {
 			if err := db.AddBadCrawl(importPath); err != nil {
-				log.Printf("ERROR db.AddBadCrawl(%q): %v", importPath, err)
+				logEvent(levelError, "db.AddBadCrawl", "path", importPath, "error", err)
 			}
 		}
 		return nil
@@ -74,41 +108,21 @@ func doCrawl() error {
 	// Crawl existing doc.
 	pdoc, pkgs, nextCrawl, err := db.Get("-")
 	if err != nil {
-		log.Printf("db.Get(\"-\") returned error %v", err)
+		logEvent(levelError, "db.Get", "path", "-", "error", err)
 		return nil
 	}
 	if pdoc == nil || nextCrawl.After(time.Now()) {
 		return nil
 	}
-	if _, err = crawlDoc("crawl", pdoc.ImportPath, pdoc, len(pkgs) > 0, nextCrawl); err != nil {
+	if _, err = crawlDoc(nil, "crawl", pdoc.ImportPath, pdoc, len(pkgs) > 0, nextCrawl); err != nil {
 		// Touch package so that crawl advances to next package.
 		if err := db.SetNextCrawlEtag(pdoc.ProjectRoot, pdoc.Etag, time.Now().Add(*maxAge/3)); err != nil {
-			log.Printf("ERROR db.TouchLastCrawl(%q): %v", pdoc.ImportPath, err)
+			logEvent(levelError, "db.SetNextCrawlEtag", "path", pdoc.ImportPath, "error", err)
 		}
 	}
 	return nil
 }
 
-func readGitHubUpdates() error {
-	const key = "gitHubUpdates"
-	var last string
-	if err := db.GetGob(key, &last); err != nil {
-		return err
-	}
-	last, names, err := gosrc.GetGitHubUpdates(httpClient, last)
-	if err != nil {
-		return err
-	}
-
-	for _, name := range names {
-		log.Printf("bump crawl github.com/%s", name)
-		if err := db.BumpCrawl("github.com/" + name); err != nil {
-			log.Println("ERROR force crawl:", err)
-		}
-	}
-
-	if err := db.PutGob(key, last); err != nil {
-		return err
-	}
-	return nil
+func updateImportRanks() error {
+	return db.UpdateImportRanks()
 }
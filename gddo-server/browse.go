@@ -11,6 +11,8 @@ import (
 	"path"
 	"regexp"
 	"strings"
+
+	"github.com/garyburd/gddo/doc"
 )
 
 func importPathFromGoogleBrowse(m []string) string {
@@ -39,10 +41,12 @@ func importPathFromGoogleBrowse(m []string) string {
 	return "code.google.com/p/" + project + subrepo + dir
 }
 
-var browsePatterns = []struct {
+type browsePattern struct {
 	pat *regexp.Regexp
 	fn  func([]string) string
-}{
+}
+
+var browsePatterns = []browsePattern{
 	{
 		// GitHub tree  browser.
 		regexp.MustCompile(`^https?://(github\.com/[^/]+/[^/]+)(?:/tree/[^/]+(/.*))?$`),
@@ -80,6 +84,56 @@ var browsePatterns = []struct {
 	},
 }
 
+// resolverBrowsePattern returns the browse pattern for the source browser
+// URL template in an import path resolver.
+func resolverBrowsePattern(r *doc.Resolver) browsePattern {
+	expr := regexp.QuoteMeta(r.BrowseURL)
+	if r.HasRepo() {
+		expr = strings.Replace(expr, `\{repo\}`, `(?P<repo>[^/]+)`, 1)
+	}
+	expr = strings.Replace(expr, `\{repo\}`, `[^/]+`, -1)
+	expr = strings.Replace(expr, `\{commit\}`, `[^/]+`, -1)
+	expr = strings.Replace(expr, `/\{path\}`, `(?:/(?P<path>.*))?`, 1)
+	expr = strings.Replace(expr, `\{path\}`, `(?P<path>.*)`, 1)
+	pat := regexp.MustCompile("^" + expr + "$")
+
+	base := r.Base()
+	names := pat.SubexpNames()
+	return browsePattern{pat, func(m []string) string {
+		importPath := base
+		var dir string
+		for i, name := range names {
+			switch name {
+			case "repo":
+				importPath += "/" + m[i]
+			case "path":
+				dir = strings.Trim(m[i], "/")
+				// Assume that a final element with an extension is a file.
+				if path.Ext(dir) != "" {
+					dir = path.Dir(dir)
+				}
+			}
+		}
+		if dir != "" && dir != "." {
+			importPath += "/" + dir
+		}
+		return importPath
+	}}
+}
+
+// addResolverBrowsePatterns adds browse patterns for the source browser URLs
+// in the import path resolver table. The patterns are checked before the
+// patterns for the hosting services.
+func addResolverBrowsePatterns(rs []*doc.Resolver) {
+	var patterns []browsePattern
+	for _, r := range rs {
+		if r.BrowseURL != "" {
+			patterns = append(patterns, resolverBrowsePattern(r))
+		}
+	}
+	browsePatterns = append(patterns, browsePatterns...)
+}
+
 // isBrowserURL returns importPath and true if URL looks like a URL for a VCS
 // source browser.
 func isBrowseURL(s string) (importPath string, ok bool) {
@@ -8,6 +8,8 @@ package main
 
 import (
 	"testing"
+
+	"github.com/garyburd/gddo/doc"
 )
 
 var isBrowseURLTests = []struct {
@@ -37,3 +39,27 @@ func TestIsBrowseURL(t *testing.T) {
 		}
 	}
 }
+
+var resolverBrowseURLTests = []struct {
+	s          string
+	importPath string
+}{
+	{"https://code.corp.example/a/blob/1234abcd/b/c/c.go", "go.corp.example/a/b/c"},
+	{"https://code.corp.example/a/blob/1234abcd/b/c", "go.corp.example/a/b/c"},
+	{"https://code.corp.example/a/blob/1234abcd", "go.corp.example/a"},
+	{"https://code.corp.example/tools/blob/1234abcd/x/x.go", "go.corp.example/tools/x"},
+}
+
+func TestResolverBrowseURL(t *testing.T) {
+	defer func(patterns []browsePattern) { browsePatterns = patterns }(browsePatterns)
+	addResolverBrowsePatterns([]*doc.Resolver{
+		{Prefix: "go.corp.example/tools", BrowseURL: "https://code.corp.example/tools/blob/{commit}/{path}"},
+		{Prefix: "go.corp.example/{repo}", BrowseURL: "https://code.corp.example/{repo}/blob/{commit}/{path}"},
+	})
+	for _, tt := range resolverBrowseURLTests {
+		importPath, ok := isBrowseURL(tt.s)
+		if importPath != tt.importPath || !ok {
+			t.Errorf("IsBrowseURL(%q) = %q, %v; want %q %v", tt.s, importPath, ok, tt.importPath, true)
+		}
+	}
+}
@@ -0,0 +1,472 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	pageCacheSize  = flag.Int("page_cache_size", 32<<20, "Maximum size in bytes of the in-memory cache of rendered package pages. Zero disables the cache.")
+	pageCacheStore = flag.String("page_cache_store", "", "Second tier for the rendered page cache: redis, disk or empty for none.")
+	pageCacheDir   = flag.String("page_cache_dir", filepath.Join(os.TempDir(), "gddo-pages"), "Directory for the disk tier of the rendered page cache.")
+	pageCacheDisk  = flag.Int64("page_cache_disk_size", 1<<30, "Maximum size in bytes of the disk tier of the rendered page cache.")
+	pageCacheTTL   = flag.Duration("page_cache_ttl", 24*time.Hour, "Maximum age of the pages in the redis tier of the rendered page cache.")
+)
+
+// pageStore is a second tier for the rendered page cache. Page keys have
+// the form "name generation". The generation changes with the page data and
+// the server version.
+type pageStore interface {
+	// getPage returns the page for the import path and key or nil if the
+	// page is not stored.
+	getPage(importPath, key string) ([]byte, error)
+
+	// putPage stores the page for the import path and key and deletes the
+	// pages for the import path with a different generation.
+	putPage(importPath, key string, p []byte) error
+
+	// deletePages deletes the pages for the import path.
+	deletePages(importPath string) error
+}
+
+// redisPageStore stores pages in the database. The database deletes the pages
+// for a package when the package is updated.
+type redisPageStore struct{}
+
+func (redisPageStore) getPage(importPath, key string) ([]byte, error) {
+	return db.GetPage(importPath, key)
+}
+
+func (redisPageStore) putPage(importPath, key string, p []byte) error {
+	return db.PutPage(importPath, key, p, *pageCacheTTL)
+}
+
+func (redisPageStore) deletePages(importPath string) error {
+	return db.DeletePages(importPath)
+}
+
+// splitPageKey splits a page cache key into the template name and the
+// generation.
+func splitPageKey(key string) (name, generation string) {
+	i := strings.Index(key, " ")
+	if i < 0 {
+		return key, ""
+	}
+	return key[:i], key[i+1:]
+}
+
+// diskPageStore stores pages in a directory. The pages for an import path
+// are in a subdirectory named by the hash of the import path. The
+// subdirectories are modified when a page is stored or read. When the store
+// exceeds the maximum size, the least recently modified subdirectories are
+// removed.
+type diskPageStore struct {
+	dir     string
+	maxSize int64
+
+	mu    sync.Mutex
+	size  int64 // estimated size, zero until the first put
+	sized bool
+}
+
+func newDiskPageStore(dir string, maxSize int64) *diskPageStore {
+	return &diskPageStore{dir: dir, maxSize: maxSize}
+}
+
+func hashName(s string) string {
+	h := sha1.New()
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (s *diskPageStore) pathDir(importPath string) string {
+	return filepath.Join(s.dir, hashName(importPath))
+}
+
+// fileName returns the name of the file for a page key. Files for the same
+// generation have the same prefix.
+func (s *diskPageStore) fileName(key string) string {
+	name, generation := splitPageKey(key)
+	return hashName(generation) + "-" + hashName(name)
+}
+
+func (s *diskPageStore) getPage(importPath, key string) ([]byte, error) {
+	dir := s.pathDir(importPath)
+	p, err := ioutil.ReadFile(filepath.Join(dir, s.fileName(key)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+	return p, nil
+}
+
+func (s *diskPageStore) putPage(importPath, key string, p []byte) error {
+	dir := s.pathDir(importPath)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(p)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	fname := s.fileName(key)
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, fname))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	// Remove the pages for other generations.
+	prefix := fname[:strings.Index(fname, "-")+1]
+	if files, err := ioutil.ReadDir(dir); err == nil {
+		for _, fi := range files {
+			if !strings.HasPrefix(fi.Name(), prefix) && !strings.HasPrefix(fi.Name(), "tmp") {
+				os.Remove(filepath.Join(dir, fi.Name()))
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.size += int64(len(p))
+	if !s.sized || s.size > s.maxSize {
+		s.sized = true
+		return s.prune()
+	}
+	return nil
+}
+
+type diskPageDir struct {
+	name string
+	mod  time.Time
+	size int64
+}
+
+type byDiskPageDirAge []diskPageDir
+
+func (p byDiskPageDirAge) Len() int           { return len(p) }
+func (p byDiskPageDirAge) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byDiskPageDirAge) Less(i, j int) bool { return p[i].mod.Before(p[j].mod) }
+
+// prune computes the size of the store and removes the least recently
+// modified import path directories until the store is at most three quarters
+// of the maximum size.
+func (s *diskPageStore) prune() error {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	var dirs []diskPageDir
+	var total int64
+	for _, fi := range infos {
+		if !fi.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(s.dir, fi.Name()))
+		if err != nil {
+			continue
+		}
+		d := diskPageDir{name: fi.Name(), mod: fi.ModTime()}
+		for _, f := range files {
+			d.size += f.Size()
+		}
+		dirs = append(dirs, d)
+		total += d.size
+	}
+	if total > s.maxSize {
+		sort.Sort(byDiskPageDirAge(dirs))
+		for _, d := range dirs {
+			if total <= s.maxSize*3/4 {
+				break
+			}
+			if err := os.RemoveAll(filepath.Join(s.dir, d.name)); err != nil {
+				return err
+			}
+			total -= d.size
+		}
+	}
+	s.size = total
+	return nil
+}
+
+func (s *diskPageStore) deletePages(importPath string) error {
+	return os.RemoveAll(s.pathDir(importPath))
+}
+
+// pageCacheStats counts the rendered page cache lookups.
+type pageCacheStats struct {
+	MemoryHits    int64
+	StoreHits     int64
+	Misses        int64
+	Evictions     int64
+	Invalidations int64
+}
+
+// renderCache caches rendered package pages in memory with an optional
+// second tier. Pages are keyed by import path, template name and generation.
+// The generation is the entity tag and the page version. Because the
+// generation changes with the page data and the server version, stale pages
+// are not served. Adding a page removes the pages for the import path with
+// another generation and invalidation frees the space used by the stale
+// pages.
+type renderCache struct {
+	maxSize int
+	store   pageStore
+
+	mu     sync.Mutex
+	size   int
+	lru    *list.List                          // of *cachedPage, most recent first
+	byPath map[string]map[string]*list.Element // import path -> key -> element
+
+	stats pageCacheStats
+}
+
+type cachedPage struct {
+	importPath, key string
+	p               []byte
+}
+
+func newRenderCache(maxSize int, store pageStore) *renderCache {
+	return &renderCache{
+		maxSize: maxSize,
+		store:   store,
+		lru:     list.New(),
+		byPath:  make(map[string]map[string]*list.Element),
+	}
+}
+
+// pageCache is the cache used by servePackage. The cache is nil if rendered
+// pages are not cached.
+var pageCache *renderCache
+
+// pageVersion is a hash of the templates and the server build. The hash is
+// part of the page cache keys, so pages rendered by another version of the
+// server are not served.
+var pageVersion string
+
+// computePageVersion returns the hash of the template files and the build
+// of the running executable.
+func computePageVersion() (string, error) {
+	h := sha1.New()
+	names, err := filepath.Glob(filepath.Join(*assetsDir, "templates", "*"))
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		io.WriteString(h, filepath.Base(name))
+		h.Write(p)
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		io.WriteString(h, bi.String())
+	}
+	if exe, err := os.Executable(); err == nil {
+		if fi, err := os.Stat(exe); err == nil {
+			fmt.Fprint(h, fi.Size(), fi.ModTime().UnixNano())
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+func (c *renderCache) get(importPath, key string) ([]byte, bool) {
+	c.mu.Lock()
+	if e := c.byPath[importPath][key]; e != nil {
+		c.lru.MoveToFront(e)
+		p := e.Value.(*cachedPage).p
+		c.mu.Unlock()
+		atomic.AddInt64(&c.stats.MemoryHits, 1)
+		return p, true
+	}
+	c.mu.Unlock()
+
+	if c.store != nil {
+		p, err := c.store.getPage(importPath, key)
+		if err != nil {
+			logEvent(levelError, "page cache get", "path", importPath, "error", err)
+		} else if p != nil {
+			atomic.AddInt64(&c.stats.StoreHits, 1)
+			c.add(importPath, key, p)
+			return p, true
+		}
+	}
+	atomic.AddInt64(&c.stats.Misses, 1)
+	return nil, false
+}
+
+func (c *renderCache) put(importPath, key string, p []byte) {
+	c.add(importPath, key, p)
+	if c.store != nil {
+		if err := c.store.putPage(importPath, key, p); err != nil {
+			logEvent(levelError, "page cache put", "path", importPath, "error", err)
+		}
+	}
+}
+
+// add adds a page to the in-memory tier, removes the pages for the import
+// path with a different generation and evicts the least recently used pages
+// to keep the tier within the maximum size.
+func (c *renderCache) add(importPath, key string, p []byte) {
+	if len(p) > c.maxSize/8 {
+		// Don't let one large page flush the cache.
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.byPath[importPath][key] != nil {
+		return
+	}
+	_, generation := splitPageKey(key)
+	for k, e := range c.byPath[importPath] {
+		if _, g := splitPageKey(k); g != generation {
+			c.remove(e)
+		}
+	}
+	m := c.byPath[importPath]
+	if m == nil {
+		m = make(map[string]*list.Element)
+		c.byPath[importPath] = m
+	}
+	m[key] = c.lru.PushFront(&cachedPage{importPath: importPath, key: key, p: p})
+	c.size += len(p)
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+		atomic.AddInt64(&c.stats.Evictions, 1)
+	}
+}
+
+func (c *renderCache) remove(e *list.Element) {
+	cp := c.lru.Remove(e).(*cachedPage)
+	c.size -= len(cp.p)
+	m := c.byPath[cp.importPath]
+	delete(m, cp.key)
+	if len(m) == 0 {
+		delete(c.byPath, cp.importPath)
+	}
+}
+
+// invalidate removes the pages for the import path. The cache is invalidated
+// when the package is updated or deleted in the database.
+func (c *renderCache) invalidate(importPath string) {
+	c.mu.Lock()
+	for _, e := range c.byPath[importPath] {
+		c.remove(e)
+	}
+	c.mu.Unlock()
+	atomic.AddInt64(&c.stats.Invalidations, 1)
+	if c.store != nil {
+		if err := c.store.deletePages(importPath); err != nil {
+			logEvent(levelError, "page cache invalidate", "path", importPath, "error", err)
+		}
+	}
+}
+
+// snapshot returns a copy of the cache statistics.
+func (c *renderCache) snapshot() pageCacheStats {
+	return pageCacheStats{
+		MemoryHits:    atomic.LoadInt64(&c.stats.MemoryHits),
+		StoreHits:     atomic.LoadInt64(&c.stats.StoreHits),
+		Misses:        atomic.LoadInt64(&c.stats.Misses),
+		Evictions:     atomic.LoadInt64(&c.stats.Evictions),
+		Invalidations: atomic.LoadInt64(&c.stats.Invalidations),
+	}
+}
+
+// invalidatePage removes the rendered pages for the import path from the
+// page cache if the cache is enabled.
+func invalidatePage(importPath string) {
+	if pageCache != nil {
+		pageCache.invalidate(importPath)
+	}
+}
+
+// executeCachedTemplate writes the rendered package page for the template
+// and entity tag from the page cache or renders the page and adds it to the
+// cache. The entity tag caps the importer count, so the exact count rendered
+// on the page is also part of the cache key.
+func executeCachedTemplate(resp http.ResponseWriter, importPath, name, etag string, importerCount int, data interface{}) error {
+	if pageCache == nil {
+		return executeTemplate(resp, name, http.StatusOK, http.Header{"Etag": {etag}}, data)
+	}
+	key := name + " " + etag + "-" + strconv.Itoa(importerCount) + "-" + pageVersion
+	p, ok := pageCache.get(importPath, key)
+	if !ok {
+		t := templates[name]
+		if t == nil {
+			return fmt.Errorf("Template %s not found", name)
+		}
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			return err
+		}
+		p = buf.Bytes()
+		pageCache.put(importPath, key, p)
+	}
+	mimeType, ok := mimeTypes[path.Ext(name)]
+	if !ok {
+		mimeType = textMIMEType
+	}
+	resp.Header().Set("Etag", etag)
+	resp.Header().Set("Content-Type", mimeType)
+	resp.WriteHeader(http.StatusOK)
+	_, err := resp.Write(p)
+	return err
+}
+
+func loadPageCache() error {
+	if *pageCacheSize <= 0 {
+		return nil
+	}
+	var store pageStore
+	switch *pageCacheStore {
+	case "":
+	case "redis":
+		store = redisPageStore{}
+	case "disk":
+		store = newDiskPageStore(*pageCacheDir, *pageCacheDisk)
+	default:
+		return fmt.Errorf("unknown page cache store %q", *pageCacheStore)
+	}
+	v, err := computePageVersion()
+	if err != nil {
+		return err
+	}
+	pageVersion = v
+	pageCache = newRenderCache(*pageCacheSize, store)
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	ttemp "text/template"
+	"time"
+)
+
+func TestRenderCache(t *testing.T) {
+	c := newRenderCache(80, nil)
+	page := strings.Repeat("x", 10)
+
+	c.put("a", "pkg.html 1", []byte(page))
+	c.put("a", "pkg.txt 1", []byte(page))
+	c.put("b", "pkg.html 1", []byte(page))
+	if _, ok := c.get("a", "pkg.html 1"); !ok {
+		t.Errorf("get(a) missed")
+	}
+	if _, ok := c.get("a", "pkg.html 2"); ok {
+		t.Errorf("get(a) with new etag hit")
+	}
+
+	// Adding pages evicts the least recently used page.
+	for i := 0; i < 6; i++ {
+		c.put("d"+strconv.Itoa(i), "pkg.html 1", []byte(page))
+	}
+	if _, ok := c.get("a", "pkg.txt 1"); ok {
+		t.Errorf("get(a) hit after eviction")
+	}
+	if c.size > c.maxSize {
+		t.Errorf("size = %d, want <= %d", c.size, c.maxSize)
+	}
+
+	c.invalidate("d0")
+	if _, ok := c.byPath["d0"]; ok {
+		t.Errorf("pages for d0 not removed by invalidate")
+	}
+
+	// Adding a page for a new generation removes the pages for the old
+	// generation.
+	c.put("d1", "pkg.txt 1", []byte(page))
+	c.put("d1", "pkg.html 2", []byte(page))
+	if m := c.byPath["d1"]; len(m) != 1 || m["pkg.html 2"] == nil {
+		t.Errorf("pages for d1 = %v, want only the new generation", m)
+	}
+
+	s := c.snapshot()
+	if s.MemoryHits != 1 || s.Misses != 2 || s.Evictions == 0 || s.Invalidations != 1 {
+		t.Errorf("snapshot() = %+v", s)
+	}
+}
+
+func TestDiskPageStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gddo-pages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newRenderCache(1<<20, newDiskPageStore(dir, 1<<20))
+	c.put("example.com/a", "pkg.html 1", []byte("hello"))
+
+	// A new cache finds the page in the second tier.
+	c = newRenderCache(1<<20, newDiskPageStore(dir, 1<<20))
+	if p, ok := c.get("example.com/a", "pkg.html 1"); !ok || string(p) != "hello" {
+		t.Errorf("get() = %q, %v, want %q, true", p, ok, "hello")
+	}
+	c.invalidate("example.com/a")
+	c = newRenderCache(1<<20, newDiskPageStore(dir, 1<<20))
+	if _, ok := c.get("example.com/a", "pkg.html 1"); ok {
+		t.Errorf("get() hit after invalidate")
+	}
+	if s := c.snapshot(); s.StoreHits != 0 || s.Misses != 1 {
+		t.Errorf("snapshot() = %+v", s)
+	}
+
+	// Storing a page for a new generation removes the old generation.
+	s := newDiskPageStore(dir, 1<<20)
+	s.putPage("example.com/a", "pkg.html 1", []byte("hello"))
+	s.putPage("example.com/a", "pkg.html 2", []byte("hello"))
+	if p, _ := s.getPage("example.com/a", "pkg.html 1"); p != nil {
+		t.Errorf("getPage() for old generation = %q, want nil", p)
+	}
+
+	// The least recently modified directories are removed when the store
+	// exceeds the maximum size.
+	s = newDiskPageStore(dir, 100)
+	page := []byte(strings.Repeat("x", 40))
+	old := time.Now().Add(-time.Hour)
+	for i := 0; i < 3; i++ {
+		importPath := "example.com/" + strconv.Itoa(i)
+		if err := s.putPage(importPath, "pkg.html 1", page); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(s.pathDir(importPath), old.Add(time.Duration(i)*time.Minute), old.Add(time.Duration(i)*time.Minute))
+	}
+	if p, _ := s.getPage("example.com/0", "pkg.html 1"); p != nil {
+		t.Errorf("oldest page not removed")
+	}
+	if p, _ := s.getPage("example.com/2", "pkg.html 1"); p == nil {
+		t.Errorf("newest page removed")
+	}
+	if s.size > s.maxSize {
+		t.Errorf("size = %d, want <= %d", s.size, s.maxSize)
+	}
+}
+
+func TestExecuteCachedTemplateImporterCount(t *testing.T) {
+	defer func(c *renderCache) { pageCache = c }(pageCache)
+	pageCache = newRenderCache(1000, nil)
+	const name = "test-importers.txt"
+	templates[name] = ttemp.Must(ttemp.New("").Parse(`imported by {{.importerCount}}`))
+	defer delete(templates, name)
+
+	// The entity tag caps the importer count at 8.
+	for _, n := range []int{9, 10} {
+		resp := httptest.NewRecorder()
+		err := executeCachedTemplate(resp, "example.com/p", name, `"etag"`, n, map[string]interface{}{"importerCount": n})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body, expected := resp.Body.String(), "imported by "+strconv.Itoa(n); body != expected {
+			t.Errorf("body = %q, want %q", body, expected)
+		}
+	}
+}
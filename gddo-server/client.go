@@ -11,7 +11,6 @@ package main
 
 import (
 	"flag"
-	"log"
 	"net"
 	"net/http"
 	"time"
@@ -52,12 +51,25 @@ type transport struct {
 }
 
 func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if auth := credentials.authorization(req); auth != "" && req.Header.Get("Authorization") == "" {
+		// Do not modify the caller's request.
+		r := new(http.Request)
+		*r = *req
+		r.Header = make(http.Header, len(req.Header)+1)
+		for k, v := range req.Header {
+			r.Header[k] = v
+		}
+		r.Header.Set("Authorization", auth)
+		req = r
+	}
 	timer := time.AfterFunc(*requestTimeout, func() {
 		t.t.CancelRequest(req)
-		log.Printf("Canceled request for %s", req.URL)
+		logEvent(levelWarn, "canceled fetch", "url", req.URL.String())
 	})
 	defer timer.Stop()
+	start := time.Now()
 	resp, err := t.t.RoundTrip(req)
+	fetchDuration.observe(time.Since(start), fetchHost(req.URL.Host))
 	return resp, err
 }
 
@@ -0,0 +1,449 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/doc/comment"
+	htemp "html/template"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+// refPat matches identifier references in comments. Submatch 1 is a reference
+// in square brackets. Submatch 2 is a bare reference.
+var refPat = regexp.MustCompile(`\[([\pL_][\pL\pN_]*(?:\.[\pL_][\pL\pN_]*){0,2})\]|([\pL_][\pL\pN_]*(?:\.[\pL_][\pL\pN_]*){0,2})`)
+
+// commentLink is a link to the documentation of an identifier referenced in a
+// comment.
+type commentLink struct {
+	// Pos and End are the byte offsets of the reference in the comment,
+	// including the square brackets if any.
+	Pos int `json:"pos"`
+	End int `json:"end"`
+
+	// Name is the referenced identifier.
+	Name string `json:"name"`
+
+	// URL is the URL of the documentation for the identifier.
+	URL string `json:"url"`
+}
+
+// addRefs adds the anchors for the exported names in the declaration code.
+// The type name is prefixed to the anchors in type declarations.
+func addRefs(refs map[string]string, c doc.Code, typeName string) {
+	for _, a := range c.Annotations {
+		if a.Kind != doc.AnchorAnnotation {
+			continue
+		}
+		name := c.Text[a.Pos:a.End]
+		if typeName != "" {
+			name = typeName + "." + name
+		}
+		refs[name] = "#" + name
+	}
+}
+
+// localRefs returns the documentation URLs for the exported declarations in
+// the package.
+func (pdoc *tdoc) localRefs() map[string]string {
+	if pdoc.refs != nil {
+		return pdoc.refs
+	}
+	refs := make(map[string]string)
+	for _, v := range pdoc.Consts {
+		addRefs(refs, v.Decl, "")
+	}
+	for _, v := range pdoc.Vars {
+		addRefs(refs, v.Decl, "")
+	}
+	for _, f := range pdoc.Funcs {
+		refs[f.Name] = "#" + f.Name
+	}
+	for _, t := range pdoc.Types {
+		refs[t.Name] = "#" + t.Name
+		addRefs(refs, t.Decl, t.Name)
+		for _, v := range t.Consts {
+			addRefs(refs, v.Decl, "")
+		}
+		for _, v := range t.Vars {
+			addRefs(refs, v.Decl, "")
+		}
+		for _, f := range t.Funcs {
+			refs[f.Name] = "#" + f.Name
+		}
+		for _, m := range t.Methods {
+			refs[t.Name+"."+m.Name] = "#" + t.Name + "." + m.Name
+		}
+	}
+	for name := range refs {
+		for _, s := range strings.Split(name, ".") {
+			if !startsWithUppercase(s) {
+				delete(refs, name)
+				break
+			}
+		}
+	}
+	pdoc.refs = refs
+	return refs
+}
+
+// importPaths returns the imported packages keyed by package name.
+func (pdoc *tdoc) importPaths() map[string]string {
+	if pdoc.imports != nil {
+		return pdoc.imports
+	}
+	pdoc.imports = make(map[string]string)
+	for _, p := range pdoc.Imports {
+		name := pdoc.ImportNames[p]
+		if name == "" {
+			name = path.Base(p)
+		}
+		pdoc.imports[name] = p
+	}
+	return pdoc.imports
+}
+
+// resolveRef returns the documentation URL for the identifier reference or ""
+// if the reference is not resolved. References to packages are only resolved
+// when bracketed.
+func (pdoc *tdoc) resolveRef(ref string, bracketed bool) string {
+	if u, ok := pdoc.localRefs()[ref]; ok {
+		return u
+	}
+	parts := strings.SplitN(ref, ".", 2)
+	importPath, ok := pdoc.importPaths()[parts[0]]
+	switch {
+	case !ok:
+		return ""
+	case len(parts) == 1:
+		if bracketed {
+			return "/" + importPath
+		}
+		return ""
+	case startsWithUppercase(parts[1]):
+		return "/" + importPath + "#" + parts[1]
+	}
+	return ""
+}
+
+// findLinks returns the links for the identifier references in the text.
+// References that are part of a path or URL are ignored.
+func (pdoc *tdoc) findLinks(p []byte) []commentLink {
+	var links []commentLink
+	for _, m := range refPat.FindAllSubmatchIndex(p, -1) {
+		if (m[0] > 0 && (p[m[0]-1] == '/' || p[m[0]-1] == '.')) ||
+			(m[1] < len(p) && p[m[1]] == '/') {
+			continue
+		}
+		bracketed := m[2] >= 0
+		var name string
+		if bracketed {
+			name = string(p[m[2]:m[3]])
+		} else {
+			name = string(p[m[4]:m[5]])
+		}
+		if u := pdoc.resolveRef(name, bracketed); u != "" {
+			links = append(links, commentLink{Pos: m[0], End: m[1], Name: name, URL: u})
+		}
+	}
+	return links
+}
+
+// CommentLinks returns the links for the identifier references in the
+// comment. Preformatted blocks in the comment are ignored.
+func (pdoc *tdoc) CommentLinks(v string) []commentLink {
+	var links []commentLink
+	offset := 0
+	for _, line := range strings.SplitAfter(v, "\n") {
+		if line != "" && line[0] != ' ' && line[0] != '\t' {
+			for _, l := range pdoc.findLinks([]byte(line)) {
+				l.Pos += offset
+				l.End += offset
+				links = append(links, l)
+			}
+		}
+		offset += len(line)
+	}
+	return links
+}
+
+// linkHTML adds links for the identifier references in the text of the HTML
+// formatted comment. Text in preformatted blocks and existing links is not
+// modified.
+func (pdoc *tdoc) linkHTML(p []byte) []byte {
+	var buf bytes.Buffer
+	skip := 0
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '<')
+		if i < 0 {
+			i = len(p)
+		}
+		text := p[:i]
+		if skip > 0 {
+			buf.Write(text)
+		} else {
+			last := 0
+			for _, l := range pdoc.findLinks(text) {
+				buf.Write(text[last:l.Pos])
+				buf.WriteString(`<a href="`)
+				buf.WriteString(htemp.HTMLEscapeString(l.URL))
+				buf.WriteString(`">`)
+				buf.WriteString(l.Name)
+				buf.WriteString(`</a>`)
+				last = l.End
+			}
+			buf.Write(text[last:])
+		}
+		p = p[i:]
+
+		if len(p) == 0 {
+			break
+		}
+		j := bytes.IndexByte(p, '>')
+		if j < 0 {
+			j = len(p) - 1
+		}
+		tag := p[:j+1]
+		switch {
+		case bytes.HasPrefix(tag, []byte("<pre")), bytes.HasPrefix(tag, []byte("<a ")):
+			skip++
+		case bytes.HasPrefix(tag, []byte("</pre")), bytes.HasPrefix(tag, []byte("</a")):
+			skip--
+		}
+		buf.Write(tag)
+		p = p[j+1:]
+	}
+	return buf.Bytes()
+}
+
+// commentParser returns a parser for the doc comments of packages stored
+// before the comments were parsed by the doc package. Doc links are resolved
+// against the declarations and imports of the package.
+func (pdoc *tdoc) commentParser() *comment.Parser {
+	return &comment.Parser{
+		LookupPackage: func(name string) (string, bool) {
+			importPath, ok := pdoc.importPaths()[name]
+			return importPath, ok
+		},
+		LookupSym: func(recv, name string) bool {
+			if recv != "" {
+				name = recv + "." + name
+			}
+			_, ok := pdoc.localRefs()[name]
+			return ok
+		},
+	}
+}
+
+// addComments parses the doc comments for packages stored before the
+// comments were parsed by the doc package.
+func (pdoc *tdoc) addComments() {
+	if pdoc.Comment != nil {
+		return
+	}
+	p := pdoc.commentParser()
+	pdoc.Comment = doc.ParseComment(p, pdoc.Doc)
+	values := func(values []*doc.Value) {
+		for _, v := range values {
+			v.Comment = doc.ParseComment(p, v.Doc)
+		}
+	}
+	examples := func(examples []*doc.Example) {
+		for _, e := range examples {
+			e.Comment = doc.ParseComment(p, e.Doc)
+		}
+	}
+	funcs := func(funcs []*doc.Func) {
+		for _, f := range funcs {
+			f.Comment = doc.ParseComment(p, f.Doc)
+			examples(f.Examples)
+		}
+	}
+	values(pdoc.Consts)
+	values(pdoc.Vars)
+	funcs(pdoc.Funcs)
+	examples(pdoc.Examples)
+	for _, t := range pdoc.Types {
+		t.Comment = doc.ParseComment(p, t.Doc)
+		examples(t.Examples)
+		values(t.Consts)
+		values(t.Vars)
+		funcs(t.Funcs)
+		funcs(t.Methods)
+	}
+}
+
+// CommentHTML formats a doc comment as HTML with links for the identifiers
+// referenced in the comment.
+func (pdoc *tdoc) CommentHTML(c *doc.Comment) htemp.HTML {
+	var buf bytes.Buffer
+	writeCommentHTML(&buf, c, pdoc)
+	return htemp.HTML(buf.String())
+}
+
+// spansText returns the plain text of the spans.
+func spansText(spans []*doc.Span) string {
+	var buf bytes.Buffer
+	for _, s := range spans {
+		buf.WriteString(s.Text)
+		if s.Kind == doc.URLSpan && s.Text != s.URL {
+			buf.WriteString(" (")
+			buf.WriteString(s.URL)
+			buf.WriteString(")")
+		}
+	}
+	return buf.String()
+}
+
+// headingID returns the anchor for a heading. The anchor is compatible with
+// the anchors generated by the go/doc package.
+func headingID(spans []*doc.Span) string {
+	var buf bytes.Buffer
+	buf.WriteString("hdr-")
+	for _, r := range spansText(spans) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			buf.WriteRune(r)
+		} else {
+			buf.WriteByte('_')
+		}
+	}
+	return buf.String()
+}
+
+// writeSpansHTML writes inline text as HTML. Links for identifier references
+// in plain text are added when pdoc is not nil.
+func writeSpansHTML(buf *bytes.Buffer, spans []*doc.Span, pdoc *tdoc) {
+	for _, s := range spans {
+		switch s.Kind {
+		case doc.URLSpan, doc.DocLinkSpan:
+			buf.WriteString(`<a href="`)
+			buf.WriteString(htemp.HTMLEscapeString(s.URL))
+			buf.WriteString(`">`)
+			buf.WriteString(htemp.HTMLEscapeString(s.Text))
+			buf.WriteString(`</a>`)
+		default:
+			p := linkText([]byte(htemp.HTMLEscapeString(s.Text)))
+			if pdoc != nil {
+				p = pdoc.linkHTML(p)
+			}
+			buf.Write(p)
+		}
+	}
+}
+
+// writeCommentHTML writes the doc comment as HTML. Links for identifier
+// references are added when pdoc is not nil.
+func writeCommentHTML(buf *bytes.Buffer, c *doc.Comment, pdoc *tdoc) {
+	if c == nil {
+		return
+	}
+	for _, b := range c.Blocks {
+		switch b.Kind {
+		case doc.ParagraphBlock:
+			buf.WriteString("<p>\n")
+			writeSpansHTML(buf, b.Spans, pdoc)
+			buf.WriteString("\n</p>\n")
+		case doc.HeadingBlock:
+			id := htemp.HTMLEscapeString(headingID(b.Spans))
+			fmt.Fprintf(buf, `<h4 id="%s">`, id)
+			writeSpansHTML(buf, b.Spans, nil)
+			fmt.Fprintf(buf, ` <a class="permalink" href="#%s">&para;</a></h4>`+"\n", id)
+		case doc.CodeBlock:
+			buf.WriteString("<pre>")
+			htemp.HTMLEscape(buf, []byte(b.Code))
+			buf.WriteString("</pre>\n")
+		case doc.ListBlock:
+			tag := "ul"
+			if len(b.Items) > 0 && b.Items[0].Number != "" {
+				tag = "ol"
+			}
+			fmt.Fprintf(buf, "<%s>\n", tag)
+			for _, item := range b.Items {
+				if item.Number != "" {
+					fmt.Fprintf(buf, `<li value="%s">`, item.Number)
+				} else {
+					buf.WriteString("<li>")
+				}
+				writeSpansHTML(buf, item.Spans, pdoc)
+				buf.WriteString("</li>\n")
+			}
+			fmt.Fprintf(buf, "</%s>\n", tag)
+		}
+	}
+}
+
+// writeWrapped writes the words in text to buf as lines of at most width
+// characters, not counting the indentation. The first line is indented with
+// first and the remaining lines with indent.
+func writeWrapped(buf *bytes.Buffer, text, first, indent string, width int) {
+	n := 0
+	for _, word := range strings.Fields(text) {
+		switch {
+		case n == 0:
+			buf.WriteString(first)
+		case n+1+utf8.RuneCountInString(word) > width:
+			buf.WriteString("\n")
+			buf.WriteString(indent)
+			n = 0
+		default:
+			buf.WriteByte(' ')
+			n++
+		}
+		buf.WriteString(word)
+		n += utf8.RuneCountInString(word)
+	}
+	if n > 0 {
+		buf.WriteString("\n")
+	}
+}
+
+// writeCommentText writes the doc comment as text. Paragraphs are wrapped to
+// width and indented with indent. Code blocks are indented with indent and
+// preIndent.
+func writeCommentText(buf *bytes.Buffer, c *doc.Comment, indent, preIndent string, width int) {
+	if c == nil {
+		return
+	}
+	for i, b := range c.Blocks {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		switch b.Kind {
+		case doc.ParagraphBlock:
+			writeWrapped(buf, spansText(b.Spans), indent, indent, width)
+		case doc.HeadingBlock:
+			buf.WriteString(indent)
+			buf.WriteString(spansText(b.Spans))
+			buf.WriteString("\n")
+		case doc.CodeBlock:
+			for _, line := range strings.Split(strings.TrimSuffix(b.Code, "\n"), "\n") {
+				if line != "" {
+					buf.WriteString(indent)
+					buf.WriteString(preIndent)
+					buf.WriteString(line)
+				}
+				buf.WriteString("\n")
+			}
+		case doc.ListBlock:
+			for _, item := range b.Items {
+				marker := "  - "
+				if item.Number != "" {
+					marker = fmt.Sprintf("  %s. ", item.Number)
+				}
+				writeWrapped(buf, spansText(item.Spans), indent+marker,
+					indent+strings.Repeat(" ", len(marker)), width-len(marker))
+			}
+		}
+	}
+}
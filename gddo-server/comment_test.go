@@ -0,0 +1,107 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package main
+
+import (
+	"go/doc/comment"
+	"reflect"
+	"testing"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+var commentLinkPackage = &doc.Package{
+	ImportPath:  "example.com/p",
+	Imports:     []string{"bytes", "io", "gopkg.in/yaml.v1"},
+	ImportNames: map[string]string{"gopkg.in/yaml.v1": "yaml"},
+	Funcs:       []*doc.Func{{Name: "NewClient"}},
+	Types: []*doc.Type{{
+		Name:    "Client",
+		Methods: []*doc.Func{{Name: "Do"}, {Name: "close"}},
+	}},
+}
+
+var commentLinkTests = []struct {
+	comment string
+	links   []commentLink
+}{
+	{"Use NewClient to create a Client.", []commentLink{
+		{Pos: 4, End: 13, Name: "NewClient", URL: "#NewClient"},
+		{Pos: 26, End: 32, Name: "Client", URL: "#Client"},
+	}},
+	{"Client.Do reads from [io.Reader] into a bytes.Buffer.", []commentLink{
+		{Pos: 0, End: 9, Name: "Client.Do", URL: "#Client.Do"},
+		{Pos: 21, End: 32, Name: "io.Reader", URL: "/io#Reader"},
+		{Pos: 40, End: 52, Name: "bytes.Buffer", URL: "/bytes#Buffer"},
+	}},
+	{"See [yaml] and yaml.Marshal.", []commentLink{
+		{Pos: 4, End: 10, Name: "yaml", URL: "/gopkg.in/yaml.v1"},
+		{Pos: 15, End: 27, Name: "yaml.Marshal", URL: "/gopkg.in/yaml.v1#Marshal"},
+	}},
+	{"Not linked: io, Client.close, Other, http://example.com/Client.\n\tClient in code\n", nil},
+}
+
+func TestAddComments(t *testing.T) {
+	pdoc := newTDoc(&doc.Package{
+		Name:  "p",
+		Doc:   "Package p uses [T].",
+		Types: []*doc.Type{{Name: "T", Doc: "T is a type.", Methods: []*doc.Func{{Name: "M", Doc: "M is a method."}}}},
+	})
+	if pdoc.Comment == nil || pdoc.Types[0].Comment == nil || pdoc.Types[0].Methods[0].Comment == nil {
+		t.Fatal("comments not added")
+	}
+	spans := pdoc.Comment.Blocks[0].Spans
+	if len(spans) != 3 || spans[1].Kind != doc.DocLinkSpan || spans[1].URL != "#T" {
+		t.Errorf("package comment spans = %+v, want link to #T", spans)
+	}
+}
+
+func TestCommentLinks(t *testing.T) {
+	pdoc := newTDoc(commentLinkPackage)
+	for _, tt := range commentLinkTests {
+		links := pdoc.CommentLinks(tt.comment)
+		if !reflect.DeepEqual(links, tt.links) {
+			t.Errorf("CommentLinks(%q) = %+v, want %+v", tt.comment, links, tt.links)
+		}
+	}
+}
+
+func TestLinkHTML(t *testing.T) {
+	pdoc := newTDoc(commentLinkPackage)
+	const html = `<p>Use [io.Reader] and <a href="http://example.com/">Client</a>.</p><pre>c := NewClient()</pre>`
+	const expected = `<p>Use <a href="/io#Reader">io.Reader</a> and <a href="http://example.com/">Client</a>.</p><pre>c := NewClient()</pre>`
+	if got := string(pdoc.linkHTML([]byte(html))); got != expected {
+		t.Errorf("linkHTML(%q) = %q, want %q", html, got, expected)
+	}
+}
+
+const renderCommentTest = "Package p reads from an [io.Reader].\n\n# Usage\n\nSteps:\n  1. Call NewClient.\n  2. Read the [spec].\n\nExample:\n\n\tc := p.NewClient()\n\n[spec]: http://example.com/spec\n"
+
+func TestCommentHTML(t *testing.T) {
+	pdoc := newTDoc(commentLinkPackage)
+	const expected = "<p>\nPackage p reads from an <a href=\"/io#Reader\">io.Reader</a>.\n</p>\n" +
+		"<h4 id=\"hdr-Usage\">Usage <a class=\"permalink\" href=\"#hdr-Usage\">&para;</a></h4>\n" +
+		"<p>\nSteps:\n</p>\n" +
+		"<ol>\n<li value=\"1\">Call <a href=\"#NewClient\">NewClient</a>.</li>\n<li value=\"2\">Read the <a href=\"http://example.com/spec\">spec</a>.</li>\n</ol>\n" +
+		"<p>\nExample:\n</p>\n" +
+		"<pre>c := p.NewClient()\n</pre>\n"
+	if html := string(pdoc.CommentHTML(doc.ParseComment(pdoc.commentParser(), renderCommentTest))); html != expected {
+		t.Errorf("CommentHTML() = %q, want %q", html, expected)
+	}
+}
+
+func TestCommentText(t *testing.T) {
+	const expected = "    Package p reads from an io.Reader.\n\n" +
+		"    Usage\n\n" +
+		"    Steps:\n\n" +
+		"      1. Call NewClient.\n      2. Read the spec (http://example.com/spec).\n\n" +
+		"    Example:\n\n" +
+		"    \tc := p.NewClient()\n"
+	if text := commentTextFn(doc.ParseComment(&comment.Parser{}, renderCommentTest)); text != expected {
+		t.Errorf("commentTextFn() = %q, want %q", text, expected)
+	}
+}
@@ -7,15 +7,27 @@
 package main
 
 import (
-	"log"
+	"flag"
+	"os"
+	"path"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/garyburd/gddo/doc"
 	"github.com/garyburd/gosrc"
 )
 
+var (
+	mirrorConfig = flag.String("mirror_config", "", "File with lines of the form \"importPathPrefix repositoryPath [revision]\" mapping import paths to local bare git repositories used for crawling.")
+	mirrorOnly   = flag.Bool("mirror_only", false, "Crawl only the import paths in the mirror configuration.")
+
+	importResolvers = flag.String("import_resolvers", "", "File with lines of the form \"prefix vcs repoURL browseURL [lineFmt]\" for resolving vanity import paths.")
+	resolverCache   = flag.String("resolver_cache", filepath.Join(os.TempDir(), "gddo-repos"), "Directory for clones of repositories in the import resolver table.")
+)
+
 var nestedProjectPat = regexp.MustCompile(`/(?:github\.com|launchpad\.net|code\.google\.com/p|bitbucket\.org|labix\.org)/`)
 
 func exists(path string) bool {
@@ -26,25 +38,100 @@ func exists(path string) bool {
 	return b
 }
 
-// crawlDoc fetches the package documentation from the VCS and updates the database.
-func crawlDoc(source string, importPath string, pdoc *doc.Package, hasSubdirs bool, nextCrawl time.Time) (*doc.Package, error) {
-	message := []interface{}{source}
+// resolvePackageName returns the name of the package at importPath from the
+// database.
+func resolvePackageName(importPath string) (string, error) {
+	return db.PackageName(importPath)
+}
+
+// Time that the licenses of parent directories are cached.
+const dirLicenseTTL = time.Hour
+
+// Maximum number of cached directory licenses.
+const maxDirLicenses = 10000
+
+type dirLicense struct {
+	license *doc.License // nil if the directory does not have a license
+	found   time.Time
+}
+
+// dirLicenses caches the licenses of the parent directories found by
+// parentLicense. The crawls of the packages in a project share the lookups
+// of the directories between the packages and the project root.
+var dirLicenses = struct {
+	sync.Mutex
+	m map[string]dirLicense
+}{m: make(map[string]dirLicense)}
+
+// findDirLicense returns the license of the directory at importPath. The
+// license is read from the database, where it can be inherited from a parent
+// directory, or fetched if the directory is not in the database. The ok
+// result is false if the database lookup failed.
+func findDirLicense(importPath string) (l *doc.License, ok bool) {
+	now := time.Now()
+	dirLicenses.Lock()
+	dl, found := dirLicenses.m[importPath]
+	dirLicenses.Unlock()
+	if found && now.Sub(dl.found) < dirLicenseTTL {
+		return dl.license, true
+	}
+
+	pdoc, _, err := db.GetDoc(importPath)
+	switch {
+	case err != nil:
+		return nil, false
+	case pdoc != nil:
+		l = pdoc.License
+	default:
+		l, _ = doc.GetLicense(httpClient, importPath)
+	}
+
+	dirLicenses.Lock()
+	if len(dirLicenses.m) >= maxDirLicenses {
+		dirLicenses.m = make(map[string]dirLicense)
+	}
+	dirLicenses.m[importPath] = dirLicense{license: l, found: now}
+	dirLicenses.Unlock()
+	return l, true
+}
+
+// parentLicense returns the license of the closest parent directory in the
+// package's project with a license file.
+func parentLicense(pdoc *doc.Package) *doc.License {
+	root := pdoc.ProjectRoot
+	for p := pdoc.ImportPath; strings.HasPrefix(p, root+"/"); {
+		p = path.Dir(p)
+		l, ok := findDirLicense(p)
+		if !ok {
+			return nil
+		}
+		if l != nil {
+			return l
+		}
+	}
+	return nil
+}
+
+// crawlDoc fetches the package documentation from the VCS and updates the
+// database. The trace is nil for crawls that are not made for a request.
+func crawlDoc(tr *trace, source string, importPath string, pdoc *doc.Package, hasSubdirs bool, nextCrawl time.Time) (*doc.Package, error) {
+	lvl := levelInfo
+	fields := []interface{}{"source", source, "path", importPath}
 	defer func() {
-		message = append(message, importPath)
-		log.Println(message...)
+		tr.log(lvl, "crawl", fields...)
 	}()
 
 	if !nextCrawl.IsZero() {
 		d := time.Since(nextCrawl) / time.Hour
 		if d > 0 {
-			message = append(message, "late:", int64(d))
+			fields = append(fields, "late_hours", int64(d))
 		}
 	}
 
 	etag := ""
 	if pdoc != nil {
 		etag = pdoc.Etag
-		message = append(message, "etag:", etag)
+		fields = append(fields, "etag", etag)
 	}
 
 	start := time.Now()
@@ -60,18 +147,25 @@ func crawlDoc(source string, importPath string, pdoc *doc.Package, hasSubdirs bo
 	} else if m := nestedProjectPat.FindStringIndex(importPath); m != nil && exists(importPath[m[0]+1:]) {
 		pdoc = nil
 		err = gosrc.NotFoundError{Message: "Copy of other project."}
-	} else if blocked, e := db.IsBlocked(importPath); blocked && e == nil {
+	} else if blocked, e := tr.database().IsBlocked(importPath); blocked && e == nil {
 		pdoc = nil
 		err = gosrc.NotFoundError{Message: "Blocked."}
 	} else {
 		var pdocNew *doc.Package
-		pdocNew, err = doc.Get(httpClient, importPath, etag)
-		message = append(message, "fetch:", int64(time.Since(start)/time.Millisecond))
+		pdocNew, err = doc.Get(httpClient, importPath, etag, resolvePackageName)
+		tr.timeStage("fetch", start)
+		fields = append(fields, "fetch_ms", int64(time.Since(start)/time.Millisecond))
 		if err == nil && pdocNew.Name == "" && !hasSubdirs {
 			pdoc = nil
 			err = gosrc.NotFoundError{Message: "No Go files or subdirs"}
 		} else if err != gosrc.ErrNotModified {
 			pdoc = pdocNew
+			if err == nil && pdoc.License == nil {
+				pdoc.License = parentLicense(pdoc)
+			}
+			if err == nil {
+				pdoc.Private = credentials.isPrivate(importPath)
+			}
 		}
 	}
 
@@ -86,22 +180,39 @@ func crawlDoc(source string, importPath string, pdoc *doc.Package, hasSubdirs bo
 
 	switch {
 	case err == nil:
-		message = append(message, "put:", pdoc.Etag)
-		if err := db.Put(pdoc, nextCrawl, false); err != nil {
-			log.Printf("ERROR db.Put(%q): %v", importPath, err)
+		fields = append(fields, "result", "put", "new_etag", pdoc.Etag)
+		crawlResults.inc(source, "put")
+		if err := tr.database().Put(pdoc, nextCrawl, false); err != nil {
+			tr.log(levelError, "db.Put", "path", importPath, "error", err)
+		}
+		invalidatePage(importPath)
+	case err == gosrc.ErrNotModified && pdoc.Private != credentials.isPrivate(importPath):
+		// The credentials configuration changed since the package was
+		// stored. Put the package again to update the index.
+		fields = append(fields, "result", "put")
+		crawlResults.inc(source, "put")
+		pdoc.Private = credentials.isPrivate(importPath)
+		if err := tr.database().Put(pdoc, nextCrawl, false); err != nil {
+			tr.log(levelError, "db.Put", "path", importPath, "error", err)
 		}
+		invalidatePage(importPath)
 	case err == gosrc.ErrNotModified:
-		message = append(message, "touch")
-		if err := db.SetNextCrawlEtag(pdoc.ProjectRoot, pdoc.Etag, nextCrawl); err != nil {
-			log.Printf("ERROR db.SetNextCrawl(%q): %v", importPath, err)
+		fields = append(fields, "result", "touch")
+		crawlResults.inc(source, "touch")
+		if err := tr.database().SetNextCrawlEtag(pdoc.ProjectRoot, pdoc.Etag, nextCrawl); err != nil {
+			tr.log(levelError, "db.SetNextCrawlEtag", "path", importPath, "error", err)
 		}
 	case gosrc.IsNotFound(err):
-		message = append(message, "notfound:", err)
-		if err := db.Delete(importPath); err != nil {
-			log.Printf("ERROR db.Delete(%q): %v", importPath, err)
+		fields = append(fields, "result", "notfound", "reason", err)
+		crawlResults.inc(source, "notfound")
+		if err := tr.database().Delete(importPath); err != nil {
+			tr.log(levelError, "db.Delete", "path", importPath, "error", err)
 		}
+		invalidatePage(importPath)
 	default:
-		message = append(message, "ERROR:", err)
+		lvl = levelError
+		fields = append(fields, "result", "error", "error", err)
+		crawlResults.inc(source, "error")
 		return nil, err
 	}
 
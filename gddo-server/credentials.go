@@ -0,0 +1,134 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/garyburd/gddo/config"
+)
+
+var (
+	credentialsFile = flag.String("credentials", "", "File with credentials for fetching private repositories.")
+	accessToken     = flag.String("access_token", "", "Requests with the header \"Authorization: Bearer <token>\" can view private packages.")
+)
+
+// credentialStore holds the credentials added to requests for private
+// repositories and the import path prefixes of the private packages.
+type credentialStore struct {
+	// auth maps host and path prefixes to Authorization header values.
+	auth map[string]string
+
+	// private is the set of import path prefixes for private packages.
+	private map[string]bool
+}
+
+// parseCredentials parses a credential file. Each line in the file is blank,
+// a comment starting with #, or one of the directives:
+//
+//	prefix basic user password   HTTP basic authentication
+//	prefix token token          Authorization: token <token>
+//	prefix bearer token         Authorization: Bearer <token>
+//	prefix private              packages with import path prefix are private
+//
+// The prefix for the authentication directives is matched against the host
+// and path of the request URL. Credentials are only sent over HTTPS.
+func parseCredentials(r io.Reader, name string) (*credentialStore, error) {
+	cs := &credentialStore{auth: make(map[string]string), private: make(map[string]bool)}
+	err := config.Read(r, name, func(l *config.Line) error {
+		fields := l.Fields
+		if len(fields) < 2 {
+			return l.Errorf("expected prefix and directive")
+		}
+		prefix, args := strings.TrimSuffix(fields[0], "/"), fields[2:]
+		switch fields[1] {
+		case "basic":
+			if len(args) != 2 {
+				return l.Errorf("basic directive requires user and password")
+			}
+			cs.auth[prefix] = "Basic " + base64.StdEncoding.EncodeToString([]byte(args[0]+":"+args[1]))
+		case "token", "bearer":
+			if len(args) != 1 {
+				return l.Errorf("%s directive requires token", fields[1])
+			}
+			scheme := "token "
+			if fields[1] == "bearer" {
+				scheme = "Bearer "
+			}
+			cs.auth[prefix] = scheme + args[0]
+		case "private":
+			if len(args) != 0 {
+				return l.Errorf("private directive does not take arguments")
+			}
+			cs.private[prefix] = true
+		default:
+			return l.Errorf("unknown directive %q", fields[1])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// credentials is the credential store used by the HTTP client and the
+// crawler.
+var credentials = &credentialStore{}
+
+func loadCredentials(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cs, err := parseCredentials(f, name)
+	if err != nil {
+		return err
+	}
+	credentials = cs
+	return nil
+}
+
+// hasPathPrefix returns true if s is equal to prefix or if s starts with
+// prefix followed by a slash.
+func hasPathPrefix(s, prefix string) bool {
+	return s == prefix || strings.HasPrefix(s, prefix+"/")
+}
+
+// authorization returns the Authorization header value for the request or
+// "" if the store does not have credentials for the request. The value for
+// the longest matching prefix is returned.
+func (cs *credentialStore) authorization(req *http.Request) string {
+	if req.URL.Scheme != "https" {
+		return ""
+	}
+	s := req.URL.Host + req.URL.Path
+	var prefix, value string
+	for p, v := range cs.auth {
+		if hasPathPrefix(s, p) && len(p) > len(prefix) {
+			prefix, value = p, v
+		}
+	}
+	return value
+}
+
+// isPrivate returns true if the package with the given import path is
+// private.
+func (cs *credentialStore) isPrivate(importPath string) bool {
+	for p := range cs.private {
+		if hasPathPrefix(importPath, p) {
+			return true
+		}
+	}
+	return false
+}
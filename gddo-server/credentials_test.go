@@ -0,0 +1,98 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/garyburd/gddo/doc"
+)
+
+const testCredentials = `
+# Test credentials.
+api.github.com/repos/corp token abc
+git.corp.example basic user pass
+git.corp.example/public bearer xyz
+github.com/corp private
+`
+
+var authorizationTests = []struct {
+	url  string
+	auth string
+}{
+	{"https://api.github.com/repos/corp/secret/contents", "token abc"},
+	{"https://api.github.com/repos/corporate/x", ""},
+	{"http://api.github.com/repos/corp/secret", ""},
+	{"https://git.corp.example/x/y", "Basic dXNlcjpwYXNz"},
+	{"https://git.corp.example/public/y", "Bearer xyz"},
+	{"https://example.com/", ""},
+}
+
+func TestCredentials(t *testing.T) {
+	cs, err := parseCredentials(strings.NewReader(testCredentials), "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range authorizationTests {
+		req, err := http.NewRequest("GET", tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth := cs.authorization(req); auth != tt.auth {
+			t.Errorf("authorization(%q) = %q, want %q", tt.url, auth, tt.auth)
+		}
+	}
+
+	for importPath, private := range map[string]bool{
+		"github.com/corp":          true,
+		"github.com/corp/secret/x": true,
+		"github.com/corporate/x":   false,
+		"github.com/user/repo":     false,
+	} {
+		if cs.isPrivate(importPath) != private {
+			t.Errorf("isPrivate(%q) = %v, want %v", importPath, !private, private)
+		}
+	}
+
+	for _, s := range []string{"example.com", "example.com basic user", "example.com private x", "example.com unknown"} {
+		if _, err := parseCredentials(strings.NewReader(s), "credentials"); err == nil {
+			t.Errorf("parseCredentials(%q) did not return error", s)
+		}
+	}
+}
+
+func TestCanView(t *testing.T) {
+	defer func(token string) { *accessToken = token }(*accessToken)
+	*accessToken = "secret"
+	defer func(cs *credentialStore) { credentials = cs }(credentials)
+	credentials = &credentialStore{private: map[string]bool{"example.com/private": true}}
+
+	// The stored Private fields are stale. Access is determined by the
+	// current configuration.
+	public := &doc.Package{ImportPath: "example.com/public", Private: true}
+	private := &doc.Package{ImportPath: "example.com/private"}
+	for _, tt := range []struct {
+		auth string
+		pdoc *doc.Package
+		ok   bool
+	}{
+		{"", public, true},
+		{"", private, false},
+		{"Bearer wrong", private, false},
+		{"Bearer secret", private, true},
+	} {
+		req, _ := http.NewRequest("GET", "http://localhost/"+tt.pdoc.ImportPath, nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		if ok := canView(req, tt.pdoc); ok != tt.ok {
+			t.Errorf("canView(%q, %s) = %v, want %v", tt.auth, tt.pdoc.ImportPath, ok, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/garyburd/gosrc"
+)
+
+var hookSecret = flag.String("hook_secret", "", "Secret for verifying push webhook signatures. Webhooks are disabled if the secret is not set.")
+
+// Maximum size of a webhook payload.
+const maxHookPayloadSize = 1 << 20
+
+// hookProviders maps webhook provider names to functions that return the
+// project root for a push payload. The functions return "" for events that
+// do not change the repository.
+var hookProviders = map[string]func(req *http.Request, payload []byte) (string, error){
+	"github":    gitHubHookRoot,
+	"bitbucket": bitbucketHookRoot,
+	"generic":   genericHookRoot,
+}
+
+// bumpCrawl schedules a crawl of the packages in a project. It is a
+// variable for testing.
+var bumpCrawl = func(projectRoot string) error {
+	return db.BumpCrawl(projectRoot)
+}
+
+func gitHubHookRoot(req *http.Request, payload []byte) (string, error) {
+	if req.Header.Get("X-GitHub-Event") != "push" {
+		return "", nil
+	}
+	var p struct {
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return "", err
+	}
+	if p.Repository.FullName == "" {
+		return "", errors.New("repository name missing from payload")
+	}
+	return "github.com/" + p.Repository.FullName, nil
+}
+
+func bitbucketHookRoot(req *http.Request, payload []byte) (string, error) {
+	if req.Header.Get("X-Event-Key") != "repo:push" {
+		return "", nil
+	}
+	var p struct {
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return "", err
+	}
+	if p.Repository.FullName == "" {
+		return "", errors.New("repository name missing from payload")
+	}
+	return "bitbucket.org/" + p.Repository.FullName, nil
+}
+
+func genericHookRoot(req *http.Request, payload []byte) (string, error) {
+	var p struct {
+		ProjectRoot string `json:"projectRoot"`
+	}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return "", err
+	}
+	if p.ProjectRoot == "" {
+		return "", errors.New("projectRoot missing from payload")
+	}
+	return p.ProjectRoot, nil
+}
+
+// verifyHookSignature checks the HMAC signature of a webhook payload. The
+// signature is the hex encoded HMAC of the payload in the
+// X-Hub-Signature-256 header with the prefix "sha256=" or in the
+// X-Hub-Signature header with the prefix "sha256=" or "sha1=". GitHub sends
+// both headers and Bitbucket sends X-Hub-Signature with SHA-256.
+func verifyHookSignature(req *http.Request, payload []byte, secret string) error {
+	var (
+		sig string
+		h   func() hash.Hash
+	)
+	s256 := req.Header.Get("X-Hub-Signature-256")
+	s := req.Header.Get("X-Hub-Signature")
+	switch {
+	case strings.HasPrefix(s256, "sha256="):
+		sig, h = s256[len("sha256="):], sha256.New
+	case strings.HasPrefix(s, "sha256="):
+		sig, h = s[len("sha256="):], sha256.New
+	case strings.HasPrefix(s, "sha1="):
+		sig, h = s[len("sha1="):], sha1.New
+	default:
+		return errors.New("signature missing")
+	}
+	expected, err := hex.DecodeString(sig)
+	if err != nil {
+		return errors.New("bad signature encoding")
+	}
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(payload)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// serveHook handles push webhooks from the provider named by the last
+// element of the request path. The packages in the pushed project are
+// scheduled for crawling.
+func serveHook(resp http.ResponseWriter, req *http.Request, payload []byte) error {
+	getRoot, ok := hookProviders[strings.TrimPrefix(req.URL.Path, "/-/hook/")]
+	if !ok || *hookSecret == "" {
+		return &httpError{status: http.StatusNotFound}
+	}
+	if req.Method != "POST" {
+		return &httpError{status: http.StatusMethodNotAllowed}
+	}
+	if err := verifyHookSignature(req, payload, *hookSecret); err != nil {
+		return &httpError{status: http.StatusForbidden, err: err}
+	}
+	projectRoot, err := getRoot(req, payload)
+	if err != nil {
+		return &httpError{status: http.StatusBadRequest, err: err}
+	}
+	if projectRoot != "" {
+		if !gosrc.IsValidRemotePath(projectRoot) {
+			return &httpError{status: http.StatusBadRequest, err: errors.New("invalid project root")}
+		}
+		requestTrace(req).log(levelInfo, "bump crawl", "root", projectRoot, "source", "hook")
+		if err := bumpCrawl(projectRoot); err != nil {
+			return err
+		}
+	}
+	data := struct {
+		ProjectRoot string `json:"projectRoot,omitempty"`
+	}{
+		projectRoot,
+	}
+	resp.Header().Set("Content-Type", jsonMIMEType)
+	return json.NewEncoder(resp).Encode(&data)
+}
+
+// hookHandler reads the webhook payload after the robot policy check and
+// passes the payload to the handler. The payload is read by the handler
+// instead of runHandler because runHandler limits the size of request
+// bodies.
+type hookHandler func(resp http.ResponseWriter, req *http.Request, payload []byte) error
+
+func (h hookHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	var (
+		payload []byte
+		err     error
+	)
+	readBody := func(resp http.ResponseWriter, req *http.Request) {
+		payload, err = ioutil.ReadAll(http.MaxBytesReader(resp, req.Body, maxHookPayloadSize))
+	}
+	runHandler(resp, req, func(resp http.ResponseWriter, req *http.Request) error {
+		if err != nil {
+			return &httpError{status: http.StatusBadRequest, err: err}
+		}
+		return h(resp, req, payload)
+	}, handleAPIError, readBody)
+}
@@ -0,0 +1,152 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testHookSecret = "secret"
+
+const gitHubPushPayload = `{
+  "ref": "refs/heads/master",
+  "repository": {
+    "name": "repo",
+    "full_name": "user/repo",
+    "html_url": "https://github.com/user/repo"
+  }
+}`
+
+const bitbucketPushPayload = `{
+  "push": {"changes": []},
+  "repository": {
+    "name": "repo",
+    "full_name": "user/repo",
+    "links": {"html": {"href": "https://bitbucket.org/user/repo"}}
+  }
+}`
+
+func signSHA256(payload string) string {
+	mac := hmac.New(sha256.New, []byte(testHookSecret))
+	mac.Write([]byte(payload))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func signSHA1(payload string) string {
+	mac := hmac.New(sha1.New, []byte(testHookSecret))
+	mac.Write([]byte(payload))
+	return "sha1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+var hookTests = []struct {
+	method   string
+	provider string
+	header   map[string]string
+	payload  string
+	status   int
+	bumped   string
+}{
+	{"POST", "github", map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": signSHA256(gitHubPushPayload)},
+		gitHubPushPayload, http.StatusOK, "github.com/user/repo"},
+	{"POST", "github", map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature": signSHA1(gitHubPushPayload)},
+		gitHubPushPayload, http.StatusOK, "github.com/user/repo"},
+	{"POST", "github", map[string]string{"X-GitHub-Event": "ping", "X-Hub-Signature-256": signSHA256(`{"zen":"ok"}`)},
+		`{"zen":"ok"}`, http.StatusOK, ""},
+	{"POST", "bitbucket", map[string]string{"X-Event-Key": "repo:push", "X-Hub-Signature": signSHA256(bitbucketPushPayload)},
+		bitbucketPushPayload, http.StatusOK, "bitbucket.org/user/repo"},
+	{"POST", "generic", map[string]string{"X-Hub-Signature-256": signSHA256(`{"projectRoot":"example.com/project"}`)},
+		`{"projectRoot":"example.com/project"}`, http.StatusOK, "example.com/project"},
+	{"POST", "generic", map[string]string{"X-Hub-Signature-256": signSHA256(`{"projectRoot":"not a path"}`)},
+		`{"projectRoot":"not a path"}`, http.StatusBadRequest, ""},
+	{"POST", "generic", map[string]string{"X-Hub-Signature-256": signSHA256(`{"projectRoot":`)},
+		`{"projectRoot":`, http.StatusBadRequest, ""},
+	{"POST", "github", map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": signSHA256("other")},
+		gitHubPushPayload, http.StatusForbidden, ""},
+	{"POST", "github", map[string]string{"X-GitHub-Event": "push"},
+		gitHubPushPayload, http.StatusForbidden, ""},
+	{"GET", "github", nil, "", http.StatusMethodNotAllowed, ""},
+	{"POST", "unknown", nil, "", http.StatusNotFound, ""},
+}
+
+func TestHook(t *testing.T) {
+	defer func(secret string, f func(string) error) {
+		*hookSecret = secret
+		bumpCrawl = f
+	}(*hookSecret, bumpCrawl)
+	*hookSecret = testHookSecret
+
+	var bumped string
+	bumpCrawl = func(projectRoot string) error {
+		bumped = projectRoot
+		return nil
+	}
+
+	for _, tt := range hookTests {
+		bumped = ""
+		req, err := http.NewRequest(tt.method, "http://localhost/-/hook/"+tt.provider, strings.NewReader(tt.payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		resp := httptest.NewRecorder()
+		hookHandler(serveHook).ServeHTTP(resp, req)
+		if resp.Code != tt.status {
+			t.Errorf("%s %s %v returned status %d, want %d", tt.method, tt.provider, tt.header, resp.Code, tt.status)
+		}
+		if bumped != tt.bumped {
+			t.Errorf("%s %s %v bumped %q, want %q", tt.method, tt.provider, tt.header, bumped, tt.bumped)
+		}
+	}
+}
+
+// readCounter counts the reads from a request body.
+type readCounter struct {
+	r io.Reader
+	n int
+}
+
+func (rc *readCounter) Read(p []byte) (int, error) {
+	rc.n++
+	return rc.r.Read(p)
+}
+
+func TestHookPolicy(t *testing.T) {
+	defer func(p *policy) { robotPolicy = p }(robotPolicy)
+	var err error
+	robotPolicy, err = parsePolicy(strings.NewReader("agent deny ^Evil\n"), "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := &readCounter{r: strings.NewReader(gitHubPushPayload)}
+	req, err := http.NewRequest("POST", "http://localhost/-/hook/github", ioutil.NopCloser(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "203.0.113.1:1234"
+	req.Header.Set("User-Agent", "Evil/1.0")
+	resp := httptest.NewRecorder()
+	hookHandler(serveHook).ServeHTTP(resp, req)
+	if resp.Code == http.StatusOK {
+		t.Errorf("denied client returned status %d", resp.Code)
+	}
+	if body.n != 0 {
+		t.Errorf("body read %d times for denied client, want 0", body.n)
+	}
+}
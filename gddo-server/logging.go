@@ -0,0 +1,218 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/gddo/database"
+)
+
+var (
+	logFormat   = flag.String("log_format", "text", "Log format: text or json.")
+	logLevel    = flag.String("log_level", "info", "Minimum level of logged events: debug, info, warn or error.")
+	slowRequest = flag.Duration("slow_request", time.Second, "Log the stage timings of requests that take longer than this duration. Zero disables the log.")
+)
+
+type level int
+
+const (
+	levelDebug level = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l level) String() string {
+	return levelNames[l]
+}
+
+// minLevel is the minimum level of logged events.
+var minLevel = levelInfo
+
+// logOutput is the destination for JSON formatted events. Text formatted
+// events are written with the standard logger.
+var logOutput io.Writer = os.Stderr
+
+func loadLogging() error {
+	switch *logFormat {
+	case "text", "json":
+	default:
+		return fmt.Errorf("unknown log format %q", *logFormat)
+	}
+	for i, name := range levelNames {
+		if name == *logLevel {
+			minLevel = level(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level %q", *logLevel)
+}
+
+// logEvent logs an event with the message and the alternating keys and
+// values in kv.
+func logEvent(lvl level, msg string, kv ...interface{}) {
+	if lvl < minLevel {
+		return
+	}
+	if *logFormat == "json" {
+		m := map[string]interface{}{
+			"time":  time.Now().UTC().Format(time.RFC3339Nano),
+			"level": lvl.String(),
+			"msg":   msg,
+		}
+		for i := 0; i+1 < len(kv); i += 2 {
+			v := kv[i+1]
+			switch x := v.(type) {
+			case error:
+				v = x.Error()
+			case fmt.Stringer:
+				v = x.String()
+			}
+			m[fmt.Sprint(kv[i])] = v
+		}
+		p, err := json.Marshal(m)
+		if err != nil {
+			p, _ = json.Marshal(map[string]interface{}{"level": "error", "msg": "log encode", "error": err.Error()})
+		}
+		logOutput.Write(append(p, '\n'))
+		return
+	}
+	var buf bytes.Buffer
+	buf.WriteString(strings.ToUpper(lvl.String()))
+	buf.WriteByte(' ')
+	buf.WriteString(msg)
+	for i := 0; i+1 < len(kv); i += 2 {
+		s := fmt.Sprint(kv[i+1])
+		if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+			s = fmt.Sprintf("%q", s)
+		}
+		fmt.Fprintf(&buf, " %v=%s", kv[i], s)
+	}
+	log.Print(buf.String())
+}
+
+// trace holds the request ID and the time spent in each stage of a request.
+// The methods are safe to call on a nil trace.
+type trace struct {
+	id    string
+	start time.Time
+
+	mu     sync.Mutex
+	stages map[string]time.Duration
+	order  []string
+}
+
+var requestIDPat = regexp.MustCompile(`^[-_.A-Za-z0-9]{1,64}$`)
+
+// newTrace returns a trace for the request. The request ID is taken from the
+// X-Request-Id header set by a proxy or generated if the header is not set.
+func newTrace(req *http.Request) *trace {
+	id := req.Header.Get("X-Request-Id")
+	if !requestIDPat.MatchString(id) {
+		p := make([]byte, 8)
+		rand.Read(p)
+		id = hex.EncodeToString(p)
+	}
+	return &trace{id: id, start: time.Now(), stages: make(map[string]time.Duration)}
+}
+
+// log logs an event with the request ID.
+func (tr *trace) log(lvl level, msg string, kv ...interface{}) {
+	if tr != nil {
+		kv = append([]interface{}{"request", tr.id}, kv...)
+	}
+	logEvent(lvl, msg, kv...)
+}
+
+// addStage adds d to the time spent in the named stage.
+func (tr *trace) addStage(name string, d time.Duration) {
+	if tr == nil {
+		return
+	}
+	tr.mu.Lock()
+	if _, ok := tr.stages[name]; !ok {
+		tr.order = append(tr.order, name)
+	}
+	tr.stages[name] += d
+	tr.mu.Unlock()
+}
+
+// timeStage adds the time since start to the named stage. Use it with defer:
+//
+//	defer tr.timeStage("render", time.Now())
+func (tr *trace) timeStage(name string, start time.Time) {
+	tr.addStage(name, time.Since(start))
+}
+
+// stageFields returns the stage timings in milliseconds as alternating keys
+// and values.
+func (tr *trace) stageFields() []interface{} {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	var kv []interface{}
+	for _, name := range tr.order {
+		kv = append(kv, name+"_ms", int64(tr.stages[name]/time.Millisecond))
+	}
+	return kv
+}
+
+// database returns the database with the time spent in Redis commands added
+// to the db stage of the trace.
+func (tr *trace) database() *database.Database {
+	p, ok := db.Pool.(timedPool)
+	if tr == nil || !ok {
+		return db
+	}
+	p.tr = tr
+	return &database.Database{Pool: p}
+}
+
+// traceKey is the request context key for the trace.
+type traceKey struct{}
+
+// withTrace returns a shallow copy of the request with the trace in the
+// request context.
+func withTrace(req *http.Request, tr *trace) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), traceKey{}, tr))
+}
+
+// requestTrace returns the trace for a request served by runHandler or nil
+// if the request does not have a trace.
+func requestTrace(req *http.Request) *trace {
+	tr, _ := req.Context().Value(traceKey{}).(*trace)
+	return tr
+}
+
+// logRequest logs the completion of a request. Requests that take longer
+// than the slow request threshold are logged at the warning level with the
+// stage timings.
+func (tr *trace) logRequest(req *http.Request, status int) {
+	d := time.Since(tr.start)
+	kv := []interface{}{"method", req.Method, "url", req.URL.String(), "status", status, "ms", int64(d / time.Millisecond)}
+	if *slowRequest > 0 && d > *slowRequest {
+		tr.log(levelWarn, "slow request", append(kv, tr.stageFields()...)...)
+		return
+	}
+	tr.log(levelDebug, "request", kv...)
+}
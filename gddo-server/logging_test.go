@@ -0,0 +1,88 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogEvent(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(format string) { *logFormat = format }(*logFormat)
+	defer func(w io.Writer) { logOutput = w }(logOutput)
+	logOutput = &buf
+
+	*logFormat = "json"
+	tr := &trace{id: "abc"}
+	tr.log(levelError, "crawl", "path", "example.com/a", "error", errors.New("not found"), "fetch_ms", 12)
+	tr.log(levelDebug, "request")
+	var m map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatalf("log output %q: %v", buf.String(), err)
+	}
+	if m["level"] != "error" || m["msg"] != "crawl" || m["request"] != "abc" || m["error"] != "not found" || m["fetch_ms"] != 12.0 {
+		t.Errorf("log output = %v", m)
+	}
+
+	*logFormat = "text"
+	buf.Reset()
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	logEvent(levelWarn, "robot", "host", "1.2.3.4", "agent", "Go http")
+	if s := buf.String(); !strings.HasSuffix(s, "WARN robot host=1.2.3.4 agent=\"Go http\"\n") {
+		t.Errorf("log output = %q", s)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	mux := http.NewServeMux()
+	var tr *trace
+	mux.Handle("/", handler(func(resp http.ResponseWriter, req *http.Request) error {
+		tr = requestTrace(req)
+		tr.addStage("db", 2*time.Millisecond)
+		tr.addStage("fetch", 5*time.Millisecond)
+		tr.addStage("db", 3*time.Millisecond)
+		return nil
+	}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/", nil)
+	req.Header.Set("X-Request-Id", "req-1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if id := resp.Header.Get("X-Request-Id"); id != "req-1" || tr == nil || tr.id != "req-1" {
+		t.Errorf("request id = %q, trace = %+v", id, tr)
+	}
+	fields := tr.stageFields()
+	expected := []interface{}{"db_ms", int64(5), "fetch_ms", int64(5)}
+	if len(fields) != len(expected) {
+		t.Fatalf("stageFields() = %v, want %v", fields, expected)
+	}
+	for i := range fields {
+		if fields[i] != expected[i] {
+			t.Errorf("stageFields() = %v, want %v", fields, expected)
+			break
+		}
+	}
+	if tr := requestTrace(httptest.NewRequest("GET", "/", nil)); tr != nil {
+		t.Errorf("requestTrace(request not served by handler) = %+v, want nil", tr)
+	}
+}
@@ -8,10 +8,7 @@
 package main
 
 import (
-	"archive/zip"
-	"bytes"
 	"crypto/md5"
-	"encoding/gob"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -21,10 +18,10 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
-	"regexp"
 	"runtime/debug"
 	"sort"
 	"strconv"
@@ -71,7 +68,7 @@ type crawlResult struct {
 
 // getDoc gets the package documentation from the database or from the version
 // control system as needed.
-func getDoc(path string, requestType int) (*doc.Package, []database.Package, error) {
+func getDoc(tr *trace, path string, requestType int) (*doc.Package, []database.Package, error) {
 	if path == "-" {
 		// A hack in the database package uses the path "-" to represent the
 		// next document to crawl. Block "-" here so that requests to /- always
@@ -79,7 +76,7 @@ func getDoc(path string, requestType int) (*doc.Package, []database.Package, err
 		return nil, nil, nil
 	}
 
-	pdoc, pkgs, nextCrawl, err := db.Get(path)
+	pdoc, pkgs, nextCrawl, err := tr.database().Get(path)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -97,7 +94,7 @@ func getDoc(path string, requestType int) (*doc.Package, []database.Package, err
 	if needsCrawl {
 		c := make(chan crawlResult, 1)
 		go func() {
-			pdoc, err := crawlDoc("web  ", path, pdoc, len(pkgs) > 0, nextCrawl)
+			pdoc, err := crawlDoc(tr, "web", path, pdoc, len(pkgs) > 0, nextCrawl)
 			c <- crawlResult{pdoc, err}
 		}()
 		var err error
@@ -116,11 +113,11 @@ func getDoc(path string, requestType int) (*doc.Package, []database.Package, err
 		}
 		if err != nil {
 			if pdoc != nil {
-				log.Printf("Serving %q from database after error: %v", path, err)
+				tr.log(levelWarn, "serving from database after error", "path", path, "error", err)
 				err = nil
 			} else if err == errUpdateTimeout {
 				// Handle timeout on packages never seeen before as not found.
-				log.Printf("Serving %q as not found after timeout", path)
+				tr.log(levelWarn, "serving as not found after timeout", "path", path)
 				err = &httpError{status: http.StatusNotFound}
 			}
 		}
@@ -135,27 +132,6 @@ func templateExt(req *http.Request) string {
 	return ".html"
 }
 
-var (
-	robotPat = regexp.MustCompile(`(:?\+https?://)|(?:\Wbot\W)|(?:^Python-urllib)|(?:^Go )|(?:^Java/)`)
-)
-
-func isRobot(req *http.Request) bool {
-	if robotPat.MatchString(req.Header.Get("User-Agent")) {
-		return true
-	}
-	host := httputil.StripPort(req.RemoteAddr)
-	n, err := db.IncrementCounter(host, 1)
-	if err != nil {
-		log.Printf("error incrementing counter for %s,  %v\n", host, err)
-		return false
-	}
-	if n > *robot {
-		log.Printf("robot %.2f %s %s", n, host, req.Header.Get("User-Agent"))
-		return true
-	}
-	return false
-}
-
 func popularLinkReferral(req *http.Request) bool {
 	return strings.HasSuffix(req.Header.Get("Referer"), "//"+req.Host+"/")
 }
@@ -192,6 +168,52 @@ func httpEtag(pdoc *doc.Package, pkgs []database.Package, importerCount int) str
 	return fmt.Sprintf("\"%x\"", b)
 }
 
+// hasSource returns true if the source for the named file is stored with the
+// package.
+func hasSource(pdoc *doc.Package, name string) bool {
+	for _, f := range pdoc.Source {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// declPos returns the position of the declaration with the given
+// documentation anchor.
+func declPos(pdoc *doc.Package, id string) (doc.Pos, bool) {
+	for _, f := range pdoc.Funcs {
+		if f.Name == id {
+			return f.Pos, true
+		}
+	}
+	for _, t := range pdoc.Types {
+		if t.Name == id {
+			return t.Pos, true
+		}
+		for _, f := range t.Funcs {
+			if f.Name == id {
+				return f.Pos, true
+			}
+		}
+		for _, m := range t.Methods {
+			if t.Name+"."+m.Name == id {
+				return m.Pos, true
+			}
+		}
+	}
+	return doc.Pos{}, false
+}
+
+// serveImports renders the imports view of a package with the imported
+// packages that the request can view.
+func serveImports(resp http.ResponseWriter, req *http.Request, pdoc *doc.Package, pkgs []database.Package) error {
+	return executeTemplate(resp, "imports.html", http.StatusOK, nil, map[string]interface{}{
+		"pkgs": filterPackages(req, pkgs),
+		"pdoc": newTDoc(pdoc),
+	})
+}
+
 func servePackage(resp http.ResponseWriter, req *http.Request) error {
 	p := path.Clean(req.URL.Path)
 	if strings.HasPrefix(p, "/pkg/") {
@@ -213,7 +235,7 @@ func servePackage(resp http.ResponseWriter, req *http.Request) error {
 	}
 
 	importPath := strings.TrimPrefix(req.URL.Path, "/")
-	pdoc, pkgs, err := getDoc(importPath, requestType)
+	pdoc, pkgs, err := getDoc(requestTrace(req), importPath, requestType)
 	if err != nil {
 		return err
 	}
@@ -231,9 +253,15 @@ func servePackage(resp http.ResponseWriter, req *http.Request) error {
 			ProjectRoot: pdocChild.ProjectRoot,
 			ProjectURL:  pdocChild.ProjectURL,
 			ImportPath:  importPath,
+			Private:     pdocChild.Private,
 		}
 	}
 
+	if ok, err := checkView(resp, req, pdoc); !ok {
+		return err
+	}
+	pkgs = filterPackages(req, pkgs)
+
 	switch {
 	case len(req.Form) == 0:
 		importerCount, err := db.ImporterCount(importPath)
@@ -254,7 +282,7 @@ func servePackage(resp http.ResponseWriter, req *http.Request) error {
 			len(pdoc.Errors) == 0 &&
 			!popularLinkReferral(req) {
 			if err := db.IncrementPopularScore(pdoc.ImportPath); err != nil {
-				log.Print("ERROR db.IncrementPopularScore(%s): %v", pdoc.ImportPath, err)
+				requestTrace(req).log(levelError, "db.IncrementPopularScore", "path", pdoc.ImportPath, "error", err)
 			}
 		}
 
@@ -267,20 +295,26 @@ func servePackage(resp http.ResponseWriter, req *http.Request) error {
 		}
 		template += templateExt(req)
 
-		if srcFiles[importPath+"/_sourceMap"] != nil {
+		if len(pdoc.Source) > 0 {
+			// Link to the source viewer instead of the VCS.
 			for _, f := range pdoc.Files {
-				if srcFiles[importPath+"/"+f.Name] != nil {
-					f.URL = fmt.Sprintf("/%s?file=%s", importPath, f.Name)
-					pdoc.LineFmt = "%s#L%d"
+				if hasSource(pdoc, f.Name) {
+					f.URL = fmt.Sprintf("/%s?file=%s", importPath, url.QueryEscape(f.Name))
 				}
 			}
+			pdoc.LineFmt = "%s#" + lineAnchorFmt(pdoc.LineFmt)
 		}
 
-		return executeTemplate(resp, template, status, http.Header{"Etag": {etag}}, map[string]interface{}{
+		defer requestTrace(req).timeStage("render", time.Now())
+		data := map[string]interface{}{
 			"pkgs":          pkgs,
 			"pdoc":          newTDoc(pdoc),
 			"importerCount": importerCount,
-		})
+		}
+		if status == http.StatusOK {
+			return executeCachedTemplate(resp, importPath, template, etag, importerCount, data)
+		}
+		return executeTemplate(resp, template, status, http.Header{"Etag": {etag}}, data)
 	case isView(req, "imports"):
 		if pdoc.Name == "" {
 			break
@@ -289,10 +323,7 @@ func servePackage(resp http.ResponseWriter, req *http.Request) error {
 		if err != nil {
 			return err
 		}
-		return executeTemplate(resp, "imports.html", http.StatusOK, nil, map[string]interface{}{
-			"pkgs": pkgs,
-			"pdoc": newTDoc(pdoc),
-		})
+		return serveImports(resp, req, pdoc, pkgs)
 	case isView(req, "tools"):
 		proto := "http"
 		if req.Host == "godoc.org" {
@@ -303,59 +334,46 @@ func servePackage(resp http.ResponseWriter, req *http.Request) error {
 			"pdoc": newTDoc(pdoc),
 		})
 	case isView(req, "redir"):
-		if srcFiles == nil {
+		pos, ok := declPos(pdoc, req.Form.Get("redir"))
+		if !ok || pos.Line == 0 || int(pos.File) >= len(pdoc.Files) {
 			break
 		}
-		f := srcFiles[importPath+"/_sourceMap"]
-		if f == nil {
+		if !hasSource(pdoc, pdoc.Files[pos.File].Name) {
 			break
 		}
-		rc, err := f.Open()
-		if err != nil {
-			return err
-		}
-		defer rc.Close()
-		var sourceMap map[string]string
-		if err := gob.NewDecoder(rc).Decode(&sourceMap); err != nil {
-			return err
-		}
-		id := req.Form.Get("redir")
-		fname := sourceMap[id]
-		if fname == "" {
-			break
-		}
-		http.Redirect(resp, req, fmt.Sprintf("?file=%s#%s", fname, id), 301)
+		http.Redirect(resp, req, newTDoc(pdoc).SourceURL(pos), 301)
 		return nil
-	case isView(req, "file"):
-		if srcFiles == nil {
+	case isView(req, "refs"):
+		tpdoc := newTDoc(pdoc)
+		d := tpdoc.Decl(req.Form.Get("refs"))
+		if d == nil {
 			break
 		}
+		return executeTemplate(resp, "refs.html", http.StatusOK, nil, map[string]interface{}{
+			"decl": d,
+			"pdoc": tpdoc,
+		})
+	case isView(req, "file"):
 		fname := req.Form.Get("file")
-		f := srcFiles[importPath+"/"+fname]
-		if f == nil {
-			break
-		}
-		r, err := f.Open()
-		if err != nil {
-			return err
+		var src *doc.SourceFile
+		for _, f := range pdoc.Source {
+			if f.Name == fname {
+				src = f
+			}
 		}
-		defer r.Close()
-		src := make([]byte, f.UncompressedSize64)
-		if n, err := io.ReadFull(r, src); err != nil {
-			return err
-		} else {
-			src = src[:n]
+		if src == nil {
+			break
 		}
-		var url string
+		var browseURL string
 		for _, f := range pdoc.Files {
 			if f.Name == fname {
-				url = f.URL
+				browseURL = f.URL
 			}
 		}
 		return executeTemplate(resp, "file.html", http.StatusOK, nil, map[string]interface{}{
 			"fname": fname,
-			"url":   url,
-			"src":   template.HTML(src),
+			"url":   browseURL,
+			"src":   src,
 			"pdoc":  newTDoc(pdoc),
 		})
 	case isView(req, "importers"):
@@ -366,6 +384,7 @@ func servePackage(resp http.ResponseWriter, req *http.Request) error {
 		if err != nil {
 			return err
 		}
+		pkgs = filterPackages(req, pkgs)
 		template := "importers.html"
 		if requestType == robotRequest {
 			// Hide back links from robots.
@@ -384,6 +403,7 @@ func servePackage(resp http.ResponseWriter, req *http.Request) error {
 		if err != nil {
 			return err
 		}
+		pkgs, edges = filterGraph(req, pkgs, edges)
 		b, err := renderGraph(pdoc, pkgs, edges)
 		if err != nil {
 			return err
@@ -425,13 +445,16 @@ func servePackage(resp http.ResponseWriter, req *http.Request) error {
 
 func serveRefresh(resp http.ResponseWriter, req *http.Request) error {
 	path := req.Form.Get("path")
+	if !canAccess(requestUser(req), path) {
+		return denyView(resp, req)
+	}
 	_, pkgs, _, err := db.Get(path)
 	if err != nil {
 		return err
 	}
 	c := make(chan error, 1)
 	go func() {
-		_, err := crawlDoc("rfrsh", path, nil, len(pkgs) > 0, time.Time{})
+		_, err := crawlDoc(requestTrace(req), "rfrsh", path, nil, len(pkgs) > 0, time.Time{})
 		c <- err
 	}()
 	select {
@@ -471,6 +494,7 @@ func serveIndex(resp http.ResponseWriter, req *http.Request) error {
 	if err != nil {
 		return err
 	}
+	pkgs = filterPackages(req, pkgs)
 	return executeTemplate(resp, "index.html", http.StatusOK, nil, map[string]interface{}{
 		"pkgs": pkgs,
 	})
@@ -553,6 +577,7 @@ func serveHome(resp http.ResponseWriter, req *http.Request) error {
 		if err != nil {
 			return err
 		}
+		pkgs = filterPackages(req, pkgs)
 
 		return executeTemplate(resp, "home"+templateExt(req), http.StatusOK, nil,
 			map[string]interface{}{"Popular": pkgs})
@@ -563,20 +588,87 @@ func serveHome(resp http.ResponseWriter, req *http.Request) error {
 	}
 
 	if gosrc.IsValidRemotePath(q) || (strings.Contains(q, "/") && gosrc.IsGoRepoPath(q)) {
-		pdoc, pkgs, err := getDoc(q, queryRequest)
+		pdoc, pkgs, err := getDoc(requestTrace(req), q, queryRequest)
 		if err == nil && (pdoc != nil || len(pkgs) > 0) {
 			http.Redirect(resp, req, "/"+q, 302)
 			return nil
 		}
 	}
 
-	pkgs, err := db.Query(q)
+	offset, limit := searchPage(req, searchPageSize)
+	sr, err := db.Query(q, offset, limit, searchAccess(requestUser(req)))
 	if err != nil {
 		return err
 	}
+	n := len(sr.Results)
+
+	data := map[string]interface{}{"q": q, "pkgs": filterSearchResults(req, sr.Results), "facets": sr.Facets, "total": sr.Total, "corrected": sr.Corrected}
+	if n > 0 {
+		data["first"] = offset + 1
+		data["last"] = offset + n
+	}
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		data["prev"] = strconv.Itoa(prev)
+	}
+	if offset+n < sr.Total {
+		data["next"] = strconv.Itoa(offset + n)
+	}
+	return executeTemplate(resp, "results"+templateExt(req), http.StatusOK, nil, data)
+}
+
+const (
+	// Number of results on a search results page.
+	searchPageSize = 100
+
+	// Maximum number of results returned by the search API.
+	maxSearchLimit = 1000
+)
+
+// Maximum number of completions returned by serveComplete.
+const maxCompletions = 10
+
+// serveComplete returns the packages with a name or import path starting
+// with the q parameter for autocompletion.
+func serveComplete(resp http.ResponseWriter, req *http.Request) error {
+	pkgs, err := db.Complete(req.Form.Get("q"), maxCompletions)
+	if err != nil {
+		return err
+	}
+	pkgs = filterPackages(req, pkgs)
+	data := struct {
+		Results []database.Package `json:"results"`
+	}{
+		pkgs,
+	}
+	if data.Results == nil {
+		data.Results = []database.Package{}
+	}
+	resp.Header().Set("Content-Type", jsonMIMEType)
+	if len(acl) == 0 {
+		resp.Header().Set("Cache-Control", "public, max-age=300")
+	}
+	return json.NewEncoder(resp).Encode(&data)
+}
 
-	return executeTemplate(resp, "results"+templateExt(req), http.StatusOK, nil,
-		map[string]interface{}{"q": q, "pkgs": pkgs})
+// searchPage returns the offset and limit for a page of search results from
+// the offset and limit request parameters.
+func searchPage(req *http.Request, defaultLimit int) (offset, limit int) {
+	offset, _ = strconv.Atoi(req.Form.Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	limit = defaultLimit
+	if n, err := strconv.Atoi(req.Form.Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+	return offset, limit
 }
 
 func serveAbout(resp http.ResponseWriter, req *http.Request) error {
@@ -590,27 +682,38 @@ func serveBot(resp http.ResponseWriter, req *http.Request) error {
 
 func logError(req *http.Request, err error, rv interface{}) {
 	if err != nil {
-		var buf bytes.Buffer
-		fmt.Fprintf(&buf, "Error serving %s: %v\n", req.URL, err)
+		kv := []interface{}{"url", req.URL.String(), "error", err}
 		if rv != nil {
-			fmt.Fprintln(&buf, rv)
-			buf.Write(debug.Stack())
+			kv = append(kv, "panic", fmt.Sprint(rv), "stack", string(debug.Stack()))
 		}
-		log.Print(buf.String())
+		requestTrace(req).log(levelError, "serving", kv...)
 	}
 }
 
 func serveAPISearch(resp http.ResponseWriter, req *http.Request) error {
 	q := strings.TrimSpace(req.Form.Get("q"))
-	pkgs, err := db.Query(q)
+	offset, limit := searchPage(req, searchPageSize)
+	sr, err := db.Query(q, offset, limit, searchAccess(requestUser(req)))
 	if err != nil {
 		return err
 	}
 
-	var data struct {
-		Results []database.Package `json:"results"`
+	data := struct {
+		Total     int                     `json:"total"`
+		Offset    int                     `json:"offset"`
+		Results   []database.SearchResult `json:"results"`
+		Facets    []database.Facet        `json:"facets,omitempty"`
+		Corrected string                  `json:"corrected,omitempty"`
+	}{
+		Total:     sr.Total,
+		Offset:    offset,
+		Results:   filterSearchResults(req, sr.Results),
+		Facets:    sr.Facets,
+		Corrected: sr.Corrected,
+	}
+	if data.Results == nil {
+		data.Results = []database.SearchResult{}
 	}
-	data.Results = pkgs
 	resp.Header().Set("Content-Type", jsonMIMEType)
 	return json.NewEncoder(resp).Encode(&data)
 }
@@ -620,6 +723,7 @@ func serveAPIPackages(resp http.ResponseWriter, req *http.Request) error {
 	if err != nil {
 		return err
 	}
+	pkgs = filterPackages(req, pkgs)
 	data := struct {
 		Results []database.Package `json:"results"`
 	}{
@@ -635,6 +739,7 @@ func serveAPIImporters(resp http.ResponseWriter, req *http.Request) error {
 	if err != nil {
 		return err
 	}
+	pkgs = filterPackages(req, pkgs)
 	data := struct {
 		Results []database.Package `json:"results"`
 	}{
@@ -646,11 +751,11 @@ func serveAPIImporters(resp http.ResponseWriter, req *http.Request) error {
 
 func serveAPIImports(resp http.ResponseWriter, req *http.Request) error {
 	importPath := strings.TrimPrefix(req.URL.Path, "/imports/")
-	pdoc, _, err := getDoc(importPath, robotRequest)
+	pdoc, _, err := getDoc(requestTrace(req), importPath, robotRequest)
 	if err != nil {
 		return err
 	}
-	if pdoc == nil || pdoc.Name == "" {
+	if pdoc == nil || pdoc.Name == "" || !canView(req, pdoc) {
 		return &httpError{status: http.StatusNotFound}
 	}
 	imports, err := db.Packages(pdoc.Imports)
@@ -661,6 +766,8 @@ func serveAPIImports(resp http.ResponseWriter, req *http.Request) error {
 	if err != nil {
 		return err
 	}
+	imports = filterPackages(req, imports)
+	testImports = filterPackages(req, testImports)
 	data := struct {
 		Imports     []database.Package `json:"imports"`
 		TestImports []database.Package `json:"testImports"`
@@ -672,12 +779,224 @@ func serveAPIImports(resp http.ResponseWriter, req *http.Request) error {
 	return json.NewEncoder(resp).Encode(&data)
 }
 
+type apiPos struct {
+	File string `json:"file"`
+	Line int    `json:"line"`
+	URL  string `json:"url,omitempty"`
+}
+
+func newAPIPos(pdoc *doc.Package, pos doc.Pos) apiPos {
+	f := pdoc.Files[pos.File]
+	p := apiPos{File: f.Name, Line: int(pos.Line)}
+	if pdoc.LineFmt != "" && f.URL != "" {
+		p.URL = fmt.Sprintf(pdoc.LineFmt, f.URL, pos.Line)
+	}
+	return p
+}
+
+func serveAPIRefs(resp http.ResponseWriter, req *http.Request) error {
+	importPath := strings.TrimPrefix(req.URL.Path, "/refs/")
+	pdoc, _, err := getDoc(requestTrace(req), importPath, robotRequest)
+	if err != nil {
+		return err
+	}
+	if pdoc == nil || pdoc.Name == "" || !canView(req, pdoc) {
+		return &httpError{status: http.StatusNotFound}
+	}
+	d := newTDoc(pdoc).Decl(req.Form.Get("id"))
+	if d == nil {
+		return &httpError{status: http.StatusNotFound}
+	}
+	data := struct {
+		Name       string   `json:"name"`
+		Definition apiPos   `json:"definition"`
+		References []apiPos `json:"references"`
+	}{
+		Name:       d.Name,
+		Definition: newAPIPos(pdoc, d.Pos),
+		References: make([]apiPos, len(d.Refs)),
+	}
+	for i, pos := range d.Refs {
+		data.References[i] = newAPIPos(pdoc, pos)
+	}
+	resp.Header().Set("Content-Type", jsonMIMEType)
+	return json.NewEncoder(resp).Encode(&data)
+}
+
+type apiSpan struct {
+	Text string `json:"text"`
+	URL  string `json:"url,omitempty"`
+}
+
+type apiListItem struct {
+	Number string    `json:"number,omitempty"`
+	Spans  []apiSpan `json:"spans"`
+}
+
+type apiBlock struct {
+	Kind  string        `json:"kind"`
+	Spans []apiSpan     `json:"spans,omitempty"`
+	Code  string        `json:"code,omitempty"`
+	Items []apiListItem `json:"items,omitempty"`
+}
+
+type apiComment struct {
+	Text   string        `json:"text"`
+	Links  []commentLink `json:"links,omitempty"`
+	Blocks []apiBlock    `json:"blocks,omitempty"`
+}
+
+type apiLicense struct {
+	ID    string  `json:"id,omitempty"`
+	Name  string  `json:"name"`
+	Path  string  `json:"path,omitempty"`
+	File  string  `json:"file"`
+	URL   string  `json:"url,omitempty"`
+	Score float64 `json:"score"`
+}
+
+type apiDecl struct {
+	Name string     `json:"name,omitempty"`
+	Decl string     `json:"decl"`
+	Doc  apiComment `json:"doc"`
+}
+
+type apiType struct {
+	apiDecl
+	Consts  []apiDecl `json:"consts,omitempty"`
+	Vars    []apiDecl `json:"vars,omitempty"`
+	Funcs   []apiDecl `json:"funcs,omitempty"`
+	Methods []apiDecl `json:"methods,omitempty"`
+}
+
+// newAPISpans converts inline text to API spans. Identifier references in
+// plain text are split into separate spans with the URL set.
+func newAPISpans(pdoc *tdoc, spans []*doc.Span) []apiSpan {
+	var result []apiSpan
+	for _, s := range spans {
+		switch s.Kind {
+		case doc.URLSpan, doc.DocLinkSpan:
+			result = append(result, apiSpan{Text: s.Text, URL: s.URL})
+		default:
+			last := 0
+			for _, l := range pdoc.findLinks([]byte(s.Text)) {
+				if l.Pos > last {
+					result = append(result, apiSpan{Text: s.Text[last:l.Pos]})
+				}
+				result = append(result, apiSpan{Text: l.Name, URL: l.URL})
+				last = l.End
+			}
+			if last < len(s.Text) {
+				result = append(result, apiSpan{Text: s.Text[last:]})
+			}
+		}
+	}
+	return result
+}
+
+var apiBlockKinds = map[doc.BlockKind]string{
+	doc.ParagraphBlock: "paragraph",
+	doc.HeadingBlock:   "heading",
+	doc.CodeBlock:      "code",
+	doc.ListBlock:      "list",
+}
+
+func newAPIComment(pdoc *tdoc, text string, c *doc.Comment) apiComment {
+	result := apiComment{Text: text, Links: pdoc.CommentLinks(text)}
+	for _, b := range c.Blocks {
+		block := apiBlock{Kind: apiBlockKinds[b.Kind], Spans: newAPISpans(pdoc, b.Spans), Code: b.Code}
+		for _, item := range b.Items {
+			block.Items = append(block.Items, apiListItem{Number: item.Number, Spans: newAPISpans(pdoc, item.Spans)})
+		}
+		result.Blocks = append(result.Blocks, block)
+	}
+	return result
+}
+
+func newAPILicense(l *doc.License) *apiLicense {
+	if l == nil {
+		return nil
+	}
+	return &apiLicense{ID: l.ID, Name: l.Name(), Path: l.ImportPath, File: l.File, URL: l.URL, Score: l.Score}
+}
+
+func newAPIValues(pdoc *tdoc, values []*doc.Value) []apiDecl {
+	var result []apiDecl
+	for _, v := range values {
+		result = append(result, apiDecl{Decl: v.Decl.Text, Doc: newAPIComment(pdoc, v.Doc, v.Comment)})
+	}
+	return result
+}
+
+func newAPIFuncs(pdoc *tdoc, funcs []*doc.Func) []apiDecl {
+	var result []apiDecl
+	for _, f := range funcs {
+		result = append(result, apiDecl{Name: f.Name, Decl: f.Decl.Text, Doc: newAPIComment(pdoc, f.Doc, f.Comment)})
+	}
+	return result
+}
+
+func serveAPIDoc(resp http.ResponseWriter, req *http.Request) error {
+	importPath := strings.TrimPrefix(req.URL.Path, "/doc/")
+	pdoc, _, err := getDoc(requestTrace(req), importPath, robotRequest)
+	if err != nil {
+		return err
+	}
+	if pdoc == nil || pdoc.Name == "" || !canView(req, pdoc) {
+		return &httpError{status: http.StatusNotFound}
+	}
+	tpdoc := newTDoc(pdoc)
+	data := struct {
+		Path     string      `json:"path"`
+		Name     string      `json:"name"`
+		Synopsis string      `json:"synopsis"`
+		Doc      apiComment  `json:"doc"`
+		License  *apiLicense `json:"license,omitempty"`
+		Consts   []apiDecl   `json:"consts,omitempty"`
+		Vars     []apiDecl   `json:"vars,omitempty"`
+		Funcs    []apiDecl   `json:"funcs,omitempty"`
+		Types    []apiType   `json:"types,omitempty"`
+	}{
+		Path:     pdoc.ImportPath,
+		Name:     pdoc.Name,
+		Synopsis: pdoc.Synopsis,
+		Doc:      newAPIComment(tpdoc, pdoc.Doc, pdoc.Comment),
+		License:  newAPILicense(pdoc.License),
+		Consts:   newAPIValues(tpdoc, pdoc.Consts),
+		Vars:     newAPIValues(tpdoc, pdoc.Vars),
+		Funcs:    newAPIFuncs(tpdoc, pdoc.Funcs),
+	}
+	for _, t := range pdoc.Types {
+		data.Types = append(data.Types, apiType{
+			apiDecl: apiDecl{Name: t.Name, Decl: t.Decl.Text, Doc: newAPIComment(tpdoc, t.Doc, t.Comment)},
+			Consts:  newAPIValues(tpdoc, t.Consts),
+			Vars:    newAPIValues(tpdoc, t.Vars),
+			Funcs:   newAPIFuncs(tpdoc, t.Funcs),
+			Methods: newAPIFuncs(tpdoc, t.Methods),
+		})
+	}
+	resp.Header().Set("Content-Type", jsonMIMEType)
+	return json.NewEncoder(resp).Encode(&data)
+}
+
 func serveAPIHome(resp http.ResponseWriter, req *http.Request) error {
 	return &httpError{status: http.StatusNotFound}
 }
 
+// runHandler runs the handler function fn after checking the robot policy.
+// If readBody is not nil, then readBody is called after the policy check to
+// read the request body. Otherwise, the request body is limited to 2048
+// bytes and the form is parsed.
 func runHandler(resp http.ResponseWriter, req *http.Request,
-	fn func(resp http.ResponseWriter, req *http.Request) error, errfn httputil.Error) {
+	fn func(resp http.ResponseWriter, req *http.Request) error, errfn httputil.Error,
+	readBody func(resp http.ResponseWriter, req *http.Request)) {
+	tr := newTrace(req)
+	req = withTrace(req, tr)
+	rec := &statusRecorder{ResponseWriter: resp, status: http.StatusOK}
+	resp = rec
+	resp.Header().Set("X-Request-Id", tr.id)
+	defer func() { tr.logRequest(req, rec.status) }()
+
 	defer func() {
 		if rv := recover(); rv != nil {
 			err := errors.New("handler panic")
@@ -686,12 +1005,22 @@ func runHandler(resp http.ResponseWriter, req *http.Request,
 		}
 	}()
 
+	req = withPeerAddr(req)
 	if s := req.Header.Get("X-Real-Ip"); s != "" && httputil.StripPort(req.RemoteAddr) == "127.0.0.1" {
 		req.RemoteAddr = s
 	}
 
-	req.Body = http.MaxBytesReader(resp, req.Body, 2048)
-	req.ParseForm()
+	if !checkPolicy(resp, req) {
+		return
+	}
+	req = withUser(req)
+
+	if readBody != nil {
+		readBody(resp, req)
+	} else {
+		req.Body = http.MaxBytesReader(resp, req.Body, 2048)
+		req.ParseForm()
+	}
 	var rb httputil.ResponseBuffer
 	err := fn(&rb, req)
 	if err == nil {
@@ -710,13 +1039,13 @@ func runHandler(resp http.ResponseWriter, req *http.Request,
 type handler func(resp http.ResponseWriter, req *http.Request) error
 
 func (h handler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	runHandler(resp, req, h, handleError)
+	runHandler(resp, req, h, handleError, nil)
 }
 
 type apiHandler func(resp http.ResponseWriter, req *http.Request) error
 
 func (h apiHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	runHandler(resp, req, h, handleAPIError)
+	runHandler(resp, req, h, handleAPIError, nil)
 }
 
 func handleError(resp http.ResponseWriter, req *http.Request, status int, err error) {
@@ -775,7 +1104,6 @@ func defaultBase(path string) string {
 var (
 	db                 *database.Database
 	statusImageHandler http.Handler
-	srcFiles           = make(map[string]*zip.File)
 )
 
 var (
@@ -785,25 +1113,15 @@ var (
 	firstGetTimeout = flag.Duration("first_get_timeout", 5*time.Second, "Time to wait for first fetch of package from the VCS.")
 	maxAge          = flag.Duration("max_age", 24*time.Hour, "Update package documents older than this age.")
 	httpAddr        = flag.String("http", ":8080", "Listen for HTTP connections on this address")
-	srcZip          = flag.String("srcZip", "", "")
 	sidebarEnabled  = flag.Bool("sidebar", false, "Enable package page sidebar.")
 )
 
 func main() {
 	flag.Parse()
-	log.Printf("Starting server, os.Args=%s", strings.Join(os.Args, " "))
-
-	if *srcZip != "" {
-		r, err := zip.OpenReader(*srcZip)
-		if err != nil {
-			log.Fatal(err)
-		}
-		for _, f := range r.File {
-			if strings.HasPrefix(f.Name, "root/") {
-				srcFiles[f.Name[len("root/"):]] = f
-			}
-		}
+	if err := loadLogging(); err != nil {
+		log.Fatal(err)
 	}
+	log.Printf("Starting server, os.Args=%s", strings.Join(os.Args, " "))
 
 	if err := parseHTMLTemplates([][]string{
 		{"about.html", "common.html", "layout.html"},
@@ -818,6 +1136,7 @@ func main() {
 		{"index.html", "common.html", "layout.html"},
 		{"notfound.html", "common.html", "layout.html"},
 		{"pkg.html", "common.html", "layout.html"},
+		{"refs.html", "common.html", "layout.html"},
 		{"results.html", "common.html", "layout.html"},
 		{"tools.html", "common.html", "layout.html"},
 		{"std.html", "common.html", "layout.html"},
@@ -838,12 +1157,55 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if *credentialsFile != "" {
+		if err := loadCredentials(*credentialsFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := loadAuth(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadPageCache(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadPolicy(); err != nil {
+		log.Fatal(err)
+	}
+	if *mirrorConfig != "" {
+		if err := doc.LoadMirrors(*mirrorConfig, *mirrorOnly); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *importResolvers != "" {
+		rs, err := doc.LoadResolvers(*importResolvers, *resolverCache)
+		if err != nil {
+			log.Fatal(err)
+		}
+		addResolverBrowsePatterns(rs)
+	}
+
 	var err error
 	db, err = database.New()
 	if err != nil {
 		log.Fatalf("Error opening database: %v", err)
 	}
+	db.Pool = timedPool{pool: db.Pool}
+
+	if changed, err := db.SearchDictChanged(); err != nil {
+		logEvent(levelError, "db.SearchDictChanged", "error", err)
+	} else if changed {
+		logEvent(levelWarn, "search dictionary changed; run gddo-admin reindex to update the search index")
+	}
+
+	go func() {
+		if err := db.InitSearchRanks(); err != nil {
+			logEvent(levelError, "db.InitSearchRanks", "error", err)
+		}
+	}()
 
+	if err := addUpdateTasks(); err != nil {
+		log.Fatal(err)
+	}
 	go runBackgroundTasks()
 
 	cssFiles := []string{"third_party/bootstrap/css/bootstrap.min.css", "site.css"}
@@ -870,6 +1232,8 @@ func main() {
 	apiMux.Handle("/packages", apiHandler(serveAPIPackages))
 	apiMux.Handle("/importers/", apiHandler(serveAPIImporters))
 	apiMux.Handle("/imports/", apiHandler(serveAPIImports))
+	apiMux.Handle("/refs/", apiHandler(serveAPIRefs))
+	apiMux.Handle("/doc/", apiHandler(serveAPIDoc))
 	apiMux.Handle("/", apiHandler(serveAPIHome))
 
 	mux := http.NewServeMux()
@@ -885,6 +1249,15 @@ func main() {
 	mux.Handle("/-/subrepo", handler(serveGoSubrepoIndex))
 	mux.Handle("/-/index", handler(serveIndex))
 	mux.Handle("/-/refresh", handler(serveRefresh))
+	mux.Handle("/-/complete", apiHandler(serveComplete))
+	mux.Handle("/-/hook/", hookHandler(serveHook))
+	mux.Handle("/-/metrics", handler(serveMetrics))
+	mux.Handle("/-/talkers", handler(serveTalkers))
+	mux.Handle("/-/login", handler(serveLogin))
+	if a, ok := auth.(*oidcAuth); ok {
+		mux.Handle("/-/oidc/callback", handler(a.serveCallback))
+		mux.Handle("/-/logout", handler(a.serveLogout))
+	}
 	mux.Handle("/a/index", http.RedirectHandler("/-/index", 301))
 	mux.Handle("/about", http.RedirectHandler("/-/about", 301))
 	mux.Handle("/favicon.ico", staticServer.FileHandler("favicon.ico"))
@@ -898,7 +1271,7 @@ func main() {
 
 	cacheBusters.Handler = mux
 
-	if err := http.ListenAndServe(*httpAddr, hostMux{{"api.", apiMux}, {"", mux}}); err != nil {
+	if err := http.ListenAndServe(*httpAddr, hostMux{{"api.", instrumentedMux{"api", apiMux}}, {"", instrumentedMux{"www", mux}}}); err != nil {
 		log.Fatal(err)
 	}
 }
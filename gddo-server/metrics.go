@@ -0,0 +1,350 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// metric is a metric family written in the Prometheus text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+// metrics is the list of metrics served by serveMetrics.
+var metrics []metric
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelString returns the label set for the label names and values.
+func labelString(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, `%s="%s"`, name, labelEscaper.Replace(values[i]))
+	}
+	for i := 0; i < len(extra); i += 2 {
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, `%s="%s"`, extra[i], extra[i+1])
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// labeled holds the values of a metric family by label values.
+type labeled struct {
+	name, help, typ string
+	labels          []string
+
+	mu     sync.Mutex
+	values map[string]interface{} // joined label values -> value
+}
+
+func (l *labeled) get(values []string, newValue func() interface{}) interface{} {
+	if len(values) != len(l.labels) {
+		panic("metrics: wrong number of label values for " + l.name)
+	}
+	key := strings.Join(values, "\x00")
+	v := l.values[key]
+	if v == nil {
+		v = newValue()
+		l.values[key] = v
+	}
+	return v
+}
+
+// each calls f for the values in label order. The lock must be held.
+func (l *labeled) each(w io.Writer, f func(values []string, v interface{})) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", l.name, l.help, l.name, l.typ)
+	keys := make([]string, 0, len(l.values))
+	for key := range l.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var values []string
+		if len(l.labels) > 0 {
+			values = strings.Split(key, "\x00")
+		}
+		f(values, l.values[key])
+	}
+}
+
+// counterVec is a counter partitioned by labels.
+type counterVec struct {
+	labeled
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{labeled{name: name, help: help, typ: "counter", labels: labels, values: make(map[string]interface{})}}
+	metrics = append(metrics, c)
+	return c
+}
+
+func (c *counterVec) add(delta float64, values ...string) {
+	c.mu.Lock()
+	p := c.get(values, func() interface{} { return new(float64) }).(*float64)
+	*p += delta
+	c.mu.Unlock()
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.add(1, values...)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.each(w, func(values []string, v interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labelString(c.labels, values), formatFloat(*v.(*float64)))
+	})
+}
+
+// Default histogram buckets in seconds.
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogramVec is a histogram partitioned by labels.
+type histogramVec struct {
+	labeled
+	buckets []float64
+}
+
+type histogram struct {
+	counts []int64 // count in each bucket, not cumulative
+	count  int64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{labeled{name: name, help: help, typ: "histogram", labels: labels, values: make(map[string]interface{})}, buckets}
+	metrics = append(metrics, h)
+	return h
+}
+
+func (h *histogramVec) observe(d time.Duration, values ...string) {
+	v := d.Seconds()
+	h.mu.Lock()
+	x := h.get(values, func() interface{} { return &histogram{counts: make([]int64, len(h.buckets))} }).(*histogram)
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		x.counts[i]++
+	}
+	x.count++
+	x.sum += v
+	h.mu.Unlock()
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.each(w, func(values []string, v interface{}) {
+		x := v.(*histogram)
+		n := int64(0)
+		for i, b := range h.buckets {
+			n += x.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, values, "le", formatFloat(b)), n)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, values, "le", "+Inf"), x.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelString(h.labels, values), formatFloat(x.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelString(h.labels, values), x.count)
+	})
+}
+
+// funcMetric is a gauge or counter with values computed when the metrics are
+// served.
+type funcMetric struct {
+	name, help, typ string
+	labels          []string
+	fn              func() (map[string]float64, error) // label value -> metric value
+}
+
+// newGaugeFunc adds a gauge with at most one label. The function returns the
+// values keyed by label value or by "" if the gauge does not have a label.
+func newGaugeFunc(name, help string, fn func() (map[string]float64, error), labels ...string) *funcMetric {
+	g := &funcMetric{name: name, help: help, typ: "gauge", labels: labels, fn: fn}
+	metrics = append(metrics, g)
+	return g
+}
+
+// newCounterFunc adds a counter with at most one label. The function returns
+// the values keyed by label value or by "" if the counter does not have a
+// label. The values must not decrease.
+func newCounterFunc(name, help string, fn func() (map[string]float64, error), labels ...string) *funcMetric {
+	c := &funcMetric{name: name, help: help, typ: "counter", labels: labels, fn: fn}
+	metrics = append(metrics, c)
+	return c
+}
+
+func (g *funcMetric) write(w io.Writer) {
+	m, err := g.fn()
+	if err != nil {
+		logEvent(levelError, "metric", "name", g.name, "error", err)
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", g.name, g.help, g.name, g.typ)
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var values []string
+		if len(g.labels) > 0 {
+			values = []string{key}
+		}
+		fmt.Fprintf(w, "%s%s %s\n", g.name, labelString(g.labels, values), formatFloat(m[key]))
+	}
+}
+
+var (
+	httpRequests   = newCounterVec("gddo_http_requests_total", "HTTP requests by host, handler pattern and status.", "host", "handler", "status")
+	httpDuration   = newHistogramVec("gddo_http_request_duration_seconds", "HTTP request latencies by host and handler pattern.", defaultBuckets, "host", "handler")
+	crawlResults   = newCounterVec("gddo_crawl_results_total", "Package crawls by source and result.", "source", "result")
+	fetchDuration  = newHistogramVec("gddo_fetch_duration_seconds", "Durations of HTTP requests to version control hosts. Hosts other than the known hosts are labeled other.", defaultBuckets, "host")
+	redisDuration  = newHistogramVec("gddo_redis_command_duration_seconds", "Redis command latencies by command.", defaultBuckets, "command")
+	taskRuns       = newCounterVec("gddo_background_task_runs_total", "Background task runs.", "task")
+	taskErrors     = newCounterVec("gddo_background_task_errors_total", "Background task errors.", "task")
+	crawlQueueSize = newGaugeFunc("gddo_crawl_queue_size", "Number of packages waiting to be crawled by queue.", crawlQueueSizes, "queue")
+	pageCacheCount = newCounterFunc("gddo_page_cache_lookups_total", "Rendered page cache lookups and removals by result.", pageCacheLookups, "result")
+)
+
+// fetchHosts is the set of hosts used as label values for fetchDuration.
+// Requests to other hosts are labeled "other" so that the number of series
+// does not grow with the hosts named in import paths.
+var fetchHosts = map[string]bool{
+	"api.github.com":            true,
+	"bitbucket.org":             true,
+	"api.bitbucket.org":         true,
+	"code.google.com":           true,
+	"github.com":                true,
+	"gitlab.com":                true,
+	"go.googlesource.com":       true,
+	"golang.org":                true,
+	"gopkg.in":                  true,
+	"launchpad.net":             true,
+	"raw.githubusercontent.com": true,
+}
+
+// fetchHost returns the fetchDuration label value for a request host.
+func fetchHost(host string) string {
+	if fetchHosts[host] {
+		return host
+	}
+	return "other"
+}
+
+func crawlQueueSizes() (map[string]float64, error) {
+	newCrawl, overdue, err := db.CrawlQueueSizes()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]float64{"newCrawl": float64(newCrawl), "nextCrawl": float64(overdue)}, nil
+}
+
+func pageCacheLookups() (map[string]float64, error) {
+	if pageCache == nil {
+		return nil, nil
+	}
+	s := pageCache.snapshot()
+	return map[string]float64{
+		"memory_hit":   float64(s.MemoryHits),
+		"store_hit":    float64(s.StoreHits),
+		"miss":         float64(s.Misses),
+		"eviction":     float64(s.Evictions),
+		"invalidation": float64(s.Invalidations),
+	}, nil
+}
+
+// serveMetrics writes the metrics in the Prometheus text format.
+func serveMetrics(resp http.ResponseWriter, req *http.Request) error {
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	resp.Header().Set("Cache-Control", "no-cache")
+	for _, m := range metrics {
+		m.write(resp)
+	}
+	return nil
+}
+
+// statusRecorder records the status of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// instrumentedMux counts requests and request latencies by the pattern of
+// the handler in a mux.
+type instrumentedMux struct {
+	host string
+	mux  *http.ServeMux
+}
+
+func (m instrumentedMux) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	h, pattern := m.mux.Handler(req)
+	rec := &statusRecorder{ResponseWriter: resp, status: http.StatusOK}
+	h.ServeHTTP(rec, req)
+	httpRequests.inc(m.host, pattern, strconv.Itoa(rec.status))
+	httpDuration.observe(time.Since(start), m.host, pattern)
+}
+
+// timedPool records the latencies of the commands on the pool's connections.
+// The latencies are also added to the db stage of the trace if the trace is
+// not nil.
+type timedPool struct {
+	pool interface {
+		Get() redis.Conn
+	}
+	tr *trace
+}
+
+func (p timedPool) Get() redis.Conn {
+	return timedConn{p.pool.Get(), p.tr}
+}
+
+type timedConn struct {
+	redis.Conn
+	tr *trace
+}
+
+func (c timedConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	reply, err := c.Conn.Do(cmd, args...)
+	if cmd == "" {
+		// Flush of pipelined commands.
+		cmd = "PIPELINE"
+	}
+	d := time.Since(start)
+	redisDuration.observe(d, strings.ToUpper(cmd))
+	c.tr.addStage("db", d)
+	return reply, err
+}
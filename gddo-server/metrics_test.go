@@ -0,0 +1,95 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	c := &counterVec{labeled{name: "test_total", help: "Test counter.", typ: "counter", labels: []string{"a", "b"}, values: make(map[string]interface{})}}
+	c.inc("x", `q"uote`)
+	c.inc("x", `q"uote`)
+	c.add(0.5, "w", "v")
+
+	h := &histogramVec{labeled{name: "test_seconds", help: "Test histogram.", typ: "histogram", labels: []string{"a"}, values: make(map[string]interface{})}, []float64{.1, 1}}
+	h.observe(50*time.Millisecond, "x")
+	h.observe(500*time.Millisecond, "x")
+	h.observe(5*time.Second, "x")
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	h.write(&buf)
+	expected := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{a="w",b="v"} 0.5
+test_total{a="x",b="q\"uote"} 2
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{a="x",le="0.1"} 1
+test_seconds_bucket{a="x",le="1"} 2
+test_seconds_bucket{a="x",le="+Inf"} 3
+test_seconds_sum{a="x"} 5.55
+test_seconds_count{a="x"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("metrics =\n%s\nwant\n%s", buf.String(), expected)
+	}
+}
+
+func TestInstrumentedMux(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/-/test/", http.HandlerFunc(http.NotFound))
+	server := httptest.NewServer(instrumentedMux{"test", mux})
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/-/test/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	var buf bytes.Buffer
+	httpRequests.write(&buf)
+	if s := `gddo_http_requests_total{host="test",handler="/-/test/",status="404"} 1`; !strings.Contains(buf.String(), s) {
+		t.Errorf("metrics do not contain %s:\n%s", s, buf.String())
+	}
+}
+
+func TestFuncMetricFormat(t *testing.T) {
+	c := &funcMetric{name: "test_total", help: "Test counter.", typ: "counter", labels: []string{"result"}, fn: func() (map[string]float64, error) {
+		return map[string]float64{"hit": 2, "miss": 1}, nil
+	}}
+	var buf bytes.Buffer
+	c.write(&buf)
+	expected := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{result="hit"} 2
+test_total{result="miss"} 1
+`
+	if buf.String() != expected {
+		t.Errorf("metrics =\n%s\nwant\n%s", buf.String(), expected)
+	}
+}
+
+func TestFetchHost(t *testing.T) {
+	for host, expected := range map[string]string{
+		"github.com":          "github.com",
+		"api.github.com":      "api.github.com",
+		"example.com":         "other",
+		"github.com.evil.org": "other",
+	} {
+		if actual := fetchHost(host); actual != expected {
+			t.Errorf("fetchHost(%q) = %q, want %q", host, actual, expected)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	oidcIssuer       = flag.String("oidc_issuer", "", "OpenID Connect issuer URL for oidc authentication.")
+	oidcClientID     = flag.String("oidc_client_id", "", "OpenID Connect client ID.")
+	oidcClientSecret = flag.String("oidc_client_secret", "", "OpenID Connect client secret.")
+	oidcRedirectURL  = flag.String("oidc_redirect_url", "", "OpenID Connect redirect URL. The path must be /-/oidc/callback.")
+	oidcGroupsClaim  = flag.String("oidc_groups_claim", "groups", "ID token claim with the user's groups.")
+	sessionSecret    = flag.String("session_secret", "", "Secret for signing session cookies. A random secret is used if not set.")
+	sessionMaxAge    = flag.Duration("session_max_age", 12*time.Hour, "Maximum age of a login session.")
+)
+
+const (
+	sessionCookie = "gddo_session"
+	stateCookie   = "gddo_oidc_state"
+
+	// Minimum time between fetches of the issuer's signing keys.
+	minKeysInterval = time.Minute
+)
+
+// oidcAuth authenticates users with an OpenID Connect provider. Users log in
+// with the authorization code flow and are remembered with a signed session
+// cookie. API clients can authenticate with an ID token in the header
+// "Authorization: Bearer <token>".
+type oidcAuth struct {
+	issuer, clientID, clientSecret, redirectURL, groupsClaim string
+
+	authEndpoint, tokenEndpoint, jwksURI string
+
+	secret []byte
+	maxAge time.Duration
+
+	mu          sync.Mutex
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+}
+
+func newOIDCAuth() (*oidcAuth, error) {
+	if *oidcIssuer == "" || *oidcClientID == "" || *oidcRedirectURL == "" {
+		return nil, errors.New("oidc authentication requires oidc_issuer, oidc_client_id and oidc_redirect_url")
+	}
+	a := &oidcAuth{
+		issuer:       strings.TrimSuffix(*oidcIssuer, "/"),
+		clientID:     *oidcClientID,
+		clientSecret: *oidcClientSecret,
+		redirectURL:  *oidcRedirectURL,
+		groupsClaim:  *oidcGroupsClaim,
+		secret:       []byte(*sessionSecret),
+		maxAge:       *sessionMaxAge,
+	}
+	if len(a.secret) == 0 {
+		a.secret = make([]byte, 32)
+		if _, err := rand.Read(a.secret); err != nil {
+			return nil, err
+		}
+	}
+
+	var config struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := getJSON(a.issuer+"/.well-known/openid-configuration", &config); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(config.Issuer, "/") != a.issuer {
+		return nil, fmt.Errorf("oidc: issuer %q does not match %q", config.Issuer, a.issuer)
+	}
+	a.authEndpoint = config.AuthorizationEndpoint
+	a.tokenEndpoint = config.TokenEndpoint
+	a.jwksURI = config.JWKSURI
+	return a, nil
+}
+
+func getJSON(url string, v interface{}) error {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (a *oidcAuth) user(req *http.Request) *user {
+	const prefix = "Bearer "
+	if s := req.Header.Get("Authorization"); strings.HasPrefix(s, prefix) {
+		u, err := a.verify(s[len(prefix):], time.Now())
+		if err != nil {
+			return nil
+		}
+		return u
+	}
+	c, err := req.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	var s session
+	if !a.decode(c.Value, &s) || time.Now().Unix() > s.Expires {
+		return nil
+	}
+	return &user{name: s.Name, groups: s.Groups}
+}
+
+// challenge redirects the user to the provider to log in. The page to return
+// to after login is saved with the state in a cookie.
+func (a *oidcAuth) challenge(resp http.ResponseWriter, req *http.Request) error {
+	next := req.URL.RequestURI()
+	if req.URL.Path == "/-/login" {
+		next = req.Form.Get("next")
+	}
+	p := make([]byte, 16)
+	if _, err := rand.Read(p); err != nil {
+		return err
+	}
+	state := hex.EncodeToString(p)
+	http.SetCookie(resp, &http.Cookie{
+		Name:     stateCookie,
+		Value:    a.encode(&loginState{State: state, Next: safeRedirect(next)}),
+		Path:     "/-/oidc/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(a.redirectURL, "https:"),
+	})
+	http.Redirect(resp, req, a.authEndpoint+"?"+url.Values{
+		"response_type": {"code"},
+		"client_id":     {a.clientID},
+		"redirect_uri":  {a.redirectURL},
+		"scope":         {"openid profile email"},
+		"state":         {state},
+	}.Encode(), 302)
+	return nil
+}
+
+// serveCallback exchanges the authorization code from the provider for an
+// ID token and starts a session for the user.
+func (a *oidcAuth) serveCallback(resp http.ResponseWriter, req *http.Request) error {
+	c, err := req.Cookie(stateCookie)
+	if err != nil {
+		return &httpError{status: http.StatusBadRequest, err: err}
+	}
+	var ls loginState
+	if !a.decode(c.Value, &ls) || ls.State != req.Form.Get("state") {
+		return &httpError{status: http.StatusBadRequest, err: errors.New("oidc: bad state")}
+	}
+	if s := req.Form.Get("error"); s != "" {
+		return &httpError{status: http.StatusForbidden, err: fmt.Errorf("oidc: %s", s)}
+	}
+
+	r, err := httpClient.PostForm(a.tokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {req.Form.Get("code")},
+		"redirect_uri":  {a.redirectURL},
+		"client_id":     {a.clientID},
+		"client_secret": {a.clientSecret},
+	})
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != 200 {
+		return &httpError{status: http.StatusForbidden, err: fmt.Errorf("oidc: token endpoint returned %s", r.Status)}
+	}
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&token); err != nil {
+		return err
+	}
+	u, err := a.verify(token.IDToken, time.Now())
+	if err != nil {
+		return &httpError{status: http.StatusForbidden, err: err}
+	}
+
+	secure := strings.HasPrefix(a.redirectURL, "https:")
+	http.SetCookie(resp, &http.Cookie{Name: stateCookie, Path: "/-/oidc/", MaxAge: -1})
+	http.SetCookie(resp, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    a.encode(&session{Name: u.name, Groups: u.groups, Expires: time.Now().Add(a.maxAge).Unix()}),
+		Path:     "/",
+		MaxAge:   int(a.maxAge / time.Second),
+		HttpOnly: true,
+		Secure:   secure,
+	})
+	http.Redirect(resp, req, ls.Next, 302)
+	return nil
+}
+
+// serveLogout ends the user's session.
+func (a *oidcAuth) serveLogout(resp http.ResponseWriter, req *http.Request) error {
+	http.SetCookie(resp, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	http.Redirect(resp, req, "/", 302)
+	return nil
+}
+
+// session is the value of the session cookie.
+type session struct {
+	Name    string   `json:"n"`
+	Groups  []string `json:"g,omitempty"`
+	Expires int64    `json:"e"`
+}
+
+// loginState is the value of the state cookie.
+type loginState struct {
+	State string `json:"s"`
+	Next  string `json:"n"`
+}
+
+// encode returns v encoded as JSON and signed with the session secret.
+func (a *oidcAuth) encode(v interface{}) string {
+	p, _ := json.Marshal(v)
+	s := base64.URLEncoding.EncodeToString(p)
+	return s + "." + base64.URLEncoding.EncodeToString(a.sign(s))
+}
+
+// decode verifies the signature on a value returned by encode and decodes
+// the value to v.
+func (a *oidcAuth) decode(s string, v interface{}) bool {
+	i := strings.LastIndex(s, ".")
+	if i < 0 {
+		return false
+	}
+	sig, err := base64.URLEncoding.DecodeString(s[i+1:])
+	if err != nil || !hmac.Equal(sig, a.sign(s[:i])) {
+		return false
+	}
+	p, err := base64.URLEncoding.DecodeString(s[:i])
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(p, v) == nil
+}
+
+func (a *oidcAuth) sign(s string) []byte {
+	h := hmac.New(sha256.New, a.secret)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// decodeSegment decodes a base64 URL encoded JWT segment without padding.
+func decodeSegment(s string) ([]byte, error) {
+	if n := len(s) % 4; n != 0 {
+		s += strings.Repeat("=", 4-n)
+	}
+	return base64.URLEncoding.DecodeString(s)
+}
+
+// audience is the aud claim in an ID token. The claim is a string or an
+// array of strings.
+type audience []string
+
+func (aud *audience) UnmarshalJSON(p []byte) error {
+	var s string
+	if json.Unmarshal(p, &s) == nil {
+		*aud = audience{s}
+		return nil
+	}
+	return json.Unmarshal(p, (*[]string)(aud))
+}
+
+// verify verifies an RS256 signed ID token and returns the user identified
+// by the token.
+func (a *oidcAuth) verify(token string, now time.Time) (*user, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("oidc: malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	p, err := decodeSegment(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(p, &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("oidc: algorithm %q not supported", header.Alg)
+	}
+	key, err := a.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, h[:], sig); err != nil {
+		return nil, err
+	}
+
+	p, err = decodeSegment(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]json.RawMessage
+	if err := json.Unmarshal(p, &claims); err != nil {
+		return nil, err
+	}
+	var std struct {
+		Issuer   string   `json:"iss"`
+		Audience audience `json:"aud"`
+		Expires  int64    `json:"exp"`
+		Subject  string   `json:"sub"`
+		Email    string   `json:"email"`
+	}
+	if err := json.Unmarshal(p, &std); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(std.Issuer, "/") != a.issuer {
+		return nil, fmt.Errorf("oidc: token issuer %q not trusted", std.Issuer)
+	}
+	found := false
+	for _, aud := range std.Audience {
+		found = found || aud == a.clientID
+	}
+	if !found {
+		return nil, errors.New("oidc: token not issued for this client")
+	}
+	if now.Unix() > std.Expires {
+		return nil, errors.New("oidc: token expired")
+	}
+
+	u := &user{name: std.Email}
+	if u.name == "" {
+		u.name = std.Subject
+	}
+	if raw, ok := claims[a.groupsClaim]; ok {
+		if err := json.Unmarshal(raw, &u.groups); err != nil {
+			return nil, fmt.Errorf("oidc: bad %s claim: %v", a.groupsClaim, err)
+		}
+	}
+	return u, nil
+}
+
+// key returns the issuer's signing key with the given ID. The keys are
+// fetched again when the ID is not known to handle key rotation.
+func (a *oidcAuth) key(kid string) (*rsa.PublicKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if key := a.keys[kid]; key != nil {
+		return key, nil
+	}
+	if time.Since(a.keysFetched) < minKeysInterval {
+		return nil, fmt.Errorf("oidc: unknown key %q", kid)
+	}
+	a.keysFetched = time.Now()
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(a.jwksURI, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := decodeSegment(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := decodeSegment(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	a.keys = keys
+	if key := a.keys[kid]; key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("oidc: unknown key %q", kid)
+}
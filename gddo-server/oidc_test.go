@@ -0,0 +1,114 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func encodeSegment(p []byte) string {
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(p), "=")
+}
+
+func signToken(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	s := encodeSegment(header) + "." + encodeSegment(payload)
+	h := sha256.Sum256([]byte(s))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s + "." + encodeSegment(sig)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &oidcAuth{
+		issuer:      "https://accounts.example.com",
+		clientID:    "gddo",
+		groupsClaim: "groups",
+		keys:        map[string]*rsa.PublicKey{"k1": &key.PublicKey},
+		keysFetched: time.Now(),
+	}
+	now := time.Unix(1400000000, 0)
+	claims := func(m map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":    "https://accounts.example.com",
+			"aud":    "gddo",
+			"exp":    now.Unix() + 60,
+			"sub":    "1234",
+			"email":  "alice@example.com",
+			"groups": []string{"dev"},
+		}
+		for k, v := range m {
+			c[k] = v
+		}
+		return c
+	}
+
+	u, err := a.verify(signToken(t, key, "k1", claims(nil)), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (&user{name: "alice@example.com", groups: []string{"dev"}}); !reflect.DeepEqual(u, expected) {
+		t.Errorf("verify() = %+v, want %+v", u, expected)
+	}
+	if _, err := a.verify(signToken(t, key, "k1", claims(map[string]interface{}{"aud": []string{"other", "gddo"}})), now); err != nil {
+		t.Errorf("verify() with audience array returned %v", err)
+	}
+
+	for name, token := range map[string]string{
+		"wrong key":      signToken(t, other, "k1", claims(nil)),
+		"unknown key":    signToken(t, key, "k2", claims(nil)),
+		"wrong issuer":   signToken(t, key, "k1", claims(map[string]interface{}{"iss": "https://evil.example.com"})),
+		"wrong audience": signToken(t, key, "k1", claims(map[string]interface{}{"aud": "other"})),
+		"expired":        signToken(t, key, "k1", claims(map[string]interface{}{"exp": now.Unix() - 1})),
+		"malformed":      "abc.def",
+	} {
+		if _, err := a.verify(token, now); err == nil {
+			t.Errorf("verify() with %s token did not return error", name)
+		}
+	}
+}
+
+func TestSessionCookie(t *testing.T) {
+	a := &oidcAuth{secret: []byte("secret")}
+	in := session{Name: "alice", Groups: []string{"dev"}, Expires: 1400000000}
+	s := a.encode(&in)
+
+	var out session
+	if !a.decode(s, &out) || !reflect.DeepEqual(in, out) {
+		t.Errorf("decode(encode(%+v)) = %+v", in, out)
+	}
+
+	b := &oidcAuth{secret: []byte("other")}
+	if b.decode(s, &out) {
+		t.Errorf("decode() accepted value signed with another secret")
+	}
+	i := strings.Index(s, ".")
+	forged := a.encode(&session{Name: "mallory"})
+	if a.decode(forged[:strings.Index(forged, ".")]+s[i:], &out) {
+		t.Errorf("decode() accepted forged value")
+	}
+}
@@ -0,0 +1,535 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/gddo/config"
+	"github.com/garyburd/gddo/httputil"
+)
+
+var robotPolicyFile = flag.String("robot_policy", "", "File with user agent rules, address allowlists and rate limits for clients.")
+
+// HTTP status for rate limited requests.
+const statusTooManyRequests = 429
+
+var robotPat = regexp.MustCompile(`(:?\+https?://)|(?:\Wbot\W)|(?:^Python-urllib)|(?:^Go )|(?:^Java/)`)
+
+// agentAction is the action for requests with a matching user agent. The
+// user agent is set by the client, so the actions classify requests and do
+// not exempt requests from the rate limits.
+type agentAction int
+
+const (
+	// The client is a robot.
+	agentRobot agentAction = iota
+
+	// The client is a known crawler. Crawlers are robots. Crawlers are not
+	// rate limited if the reverse DNS name of the address is verified to
+	// be in an allowed domain.
+	agentCrawler
+
+	// The client is not a robot.
+	agentAllow
+
+	// Requests from the client are denied.
+	agentDeny
+)
+
+var agentActions = map[string]agentAction{
+	"robot":   agentRobot,
+	"crawler": agentCrawler,
+	"allow":   agentAllow,
+	"deny":    agentDeny,
+}
+
+type agentRule struct {
+	action agentAction
+	pat    *regexp.Regexp
+}
+
+// rateLimit is a token bucket rate limit.
+type rateLimit struct {
+	rate  float64 // tokens per second
+	burst float64
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// policy classifies clients as robots and limits the rate of requests from
+// client addresses and subnets.
+type policy struct {
+	agents []agentRule
+	allow  []*net.IPNet
+
+	// Domains with a leading dot. Crawler addresses with a verified reverse
+	// DNS name in a domain are not rate limited.
+	allowDomains []string
+
+	// Request counter threshold for robots. The -robot flag is used if zero.
+	robotThreshold float64
+
+	ipLimit, subnetLimit     *rateLimit
+	subnetBits4, subnetBits6 int
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+
+	dnsMu    sync.Mutex
+	verified map[string]verifiedAddr // address -> verification result
+}
+
+type verifiedAddr struct {
+	ok      bool
+	checked time.Time
+}
+
+func newPolicy() *policy {
+	return &policy{
+		agents:      []agentRule{{agentRobot, robotPat}},
+		subnetBits4: 24,
+		subnetBits6: 64,
+		buckets:     make(map[string]*bucket),
+		verified:    make(map[string]verifiedAddr),
+	}
+}
+
+// robotPolicy is the policy used by the server.
+var robotPolicy = newPolicy()
+
+func parseRate(s string) (float64, error) {
+	i := strings.Index(s, "/")
+	if i < 0 {
+		return 0, fmt.Errorf("rate %q must have the form n/s, n/m or n/h", s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad rate %q", s)
+	}
+	switch s[i+1:] {
+	case "s":
+		return n, nil
+	case "m":
+		return n / 60, nil
+	case "h":
+		return n / 3600, nil
+	}
+	return 0, fmt.Errorf("bad rate unit in %q", s)
+}
+
+func parseRateLimit(rate, burst string) (*rateLimit, error) {
+	r, err := parseRate(rate)
+	if err != nil {
+		return nil, err
+	}
+	b, err := strconv.ParseFloat(burst, 64)
+	if err != nil || b < 1 {
+		return nil, fmt.Errorf("bad burst %q", burst)
+	}
+	return &rateLimit{rate: r, burst: b}, nil
+}
+
+// parsePolicy parses a robot policy. Each line in the policy is blank, a
+// comment starting with #, or one of the directives:
+//
+//	agent robot|crawler|allow|deny regexp   user agent rule
+//	allow address|cidr                      do not rate limit or count address
+//	allow .domain                           do not rate limit verified crawlers
+//	limit ip rate burst                     token bucket per address
+//	limit subnet bits4/bits6 rate burst     token bucket per subnet
+//	robot threshold                         request counter threshold
+//
+// Rates have the form n/s, n/m or n/h. The first agent rule matching the user
+// agent classifies the request. Clients without a matching rule are robots
+// if the decaying request counter for the address exceeds the threshold. The
+// built-in robot user agent rule is used if the policy does not have agent
+// rules. Only the allowlisted addresses and the crawlers with a reverse DNS
+// name in an allowed domain that resolves back to the address are exempt
+// from the rate limits.
+func parsePolicy(r io.Reader, name string) (*policy, error) {
+	p := newPolicy()
+	p.agents = nil
+	err := config.Read(r, name, func(l *config.Line) error {
+		fields := l.Fields
+		var err error
+		switch {
+		case fields[0] == "agent" && len(fields) >= 3:
+			action, ok := agentActions[fields[1]]
+			if !ok {
+				return l.Errorf("unknown agent action %q", fields[1])
+			}
+			var pat *regexp.Regexp
+			pat, err = regexp.Compile(strings.Join(fields[2:], " "))
+			p.agents = append(p.agents, agentRule{action, pat})
+		case fields[0] == "allow" && len(fields) == 2 && strings.HasPrefix(fields[1], "."):
+			if len(fields[1]) == 1 {
+				err = fmt.Errorf("empty domain")
+				break
+			}
+			p.allowDomains = append(p.allowDomains, strings.ToLower(fields[1]))
+		case fields[0] == "allow" && len(fields) == 2:
+			s := fields[1]
+			if !strings.Contains(s, "/") {
+				if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+					s += "/32"
+				} else {
+					s += "/128"
+				}
+			}
+			var n *net.IPNet
+			_, n, err = net.ParseCIDR(s)
+			p.allow = append(p.allow, n)
+		case fields[0] == "limit" && len(fields) == 4 && fields[1] == "ip":
+			p.ipLimit, err = parseRateLimit(fields[2], fields[3])
+		case fields[0] == "limit" && len(fields) == 5 && fields[1] == "subnet":
+			bits := strings.Split(fields[2], "/")
+			if len(bits) != 2 {
+				err = fmt.Errorf("subnet prefix lengths %q must have the form bits4/bits6", fields[2])
+				break
+			}
+			if p.subnetBits4, err = strconv.Atoi(bits[0]); err != nil || p.subnetBits4 < 0 || p.subnetBits4 > 32 {
+				err = fmt.Errorf("bad IPv4 prefix length %q", bits[0])
+				break
+			}
+			if p.subnetBits6, err = strconv.Atoi(bits[1]); err != nil || p.subnetBits6 < 0 || p.subnetBits6 > 128 {
+				err = fmt.Errorf("bad IPv6 prefix length %q", bits[1])
+				break
+			}
+			p.subnetLimit, err = parseRateLimit(fields[3], fields[4])
+		case fields[0] == "robot" && len(fields) == 2:
+			p.robotThreshold, err = strconv.ParseFloat(fields[1], 64)
+		default:
+			err = fmt.Errorf("unknown directive %q", strings.Join(fields, " "))
+		}
+		if err != nil {
+			return l.Errorf("%v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p.agents == nil {
+		p.agents = []agentRule{{agentRobot, robotPat}}
+	}
+	return p, nil
+}
+
+func loadPolicy() error {
+	if *robotPolicyFile == "" {
+		return nil
+	}
+	f, err := os.Open(*robotPolicyFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	p, err := parsePolicy(f, *robotPolicyFile)
+	if err != nil {
+		return err
+	}
+	robotPolicy = p
+	return nil
+}
+
+// agentAction returns the action for the first rule matching the user agent
+// or -1 if no rule matches.
+func (p *policy) agentAction(ua string) agentAction {
+	for _, rule := range p.agents {
+		if rule.pat.MatchString(ua) {
+			return rule.action
+		}
+	}
+	return -1
+}
+
+// allowed returns true if the address is in the allowlist.
+func (p *policy) allowed(ip net.IP) bool {
+	for _, n := range p.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Time that reverse DNS verification results are cached.
+const verifiedAddrTTL = time.Hour
+
+// Number of cached reverse DNS verification results before the cache is
+// cleared.
+const maxVerifiedAddrs = 10000
+
+// DNS lookup functions. Tests replace the functions.
+var (
+	lookupAddr = net.LookupAddr
+	lookupHost = net.LookupHost
+)
+
+// verifiedDomain returns true if a reverse DNS name of the address is in an
+// allowed domain and the name resolves to the address.
+func (p *policy) verifiedDomain(ip net.IP) bool {
+	if len(p.allowDomains) == 0 {
+		return false
+	}
+	key := ip.String()
+	now := time.Now()
+	p.dnsMu.Lock()
+	v, ok := p.verified[key]
+	p.dnsMu.Unlock()
+	if ok && now.Sub(v.checked) < verifiedAddrTTL {
+		return v.ok
+	}
+
+	v = verifiedAddr{checked: now}
+	names, _ := lookupAddr(key)
+	for _, name := range names {
+		name = "." + strings.ToLower(strings.TrimSuffix(name, "."))
+		inDomain := false
+		for _, d := range p.allowDomains {
+			if strings.HasSuffix(name, d) {
+				inDomain = true
+				break
+			}
+		}
+		if !inDomain {
+			continue
+		}
+		addrs, _ := lookupHost(name[1:])
+		for _, a := range addrs {
+			if x := net.ParseIP(a); x != nil && x.Equal(ip) {
+				v.ok = true
+			}
+		}
+		if v.ok {
+			break
+		}
+	}
+
+	p.dnsMu.Lock()
+	if len(p.verified) >= maxVerifiedAddrs {
+		p.verified = make(map[string]verifiedAddr)
+	}
+	p.verified[key] = v
+	p.dnsMu.Unlock()
+	return v.ok
+}
+
+// exempt returns true if requests from the address with the user agent
+// action are not rate limited.
+func (p *policy) exempt(ip net.IP, action agentAction) bool {
+	return p.allowed(ip) || (action == agentCrawler && p.verifiedDomain(ip))
+}
+
+func requestIP(req *http.Request) net.IP {
+	return net.ParseIP(httputil.StripPort(req.RemoteAddr))
+}
+
+// isRobot returns true if the request is from a robot. Requests that do not
+// match a user agent rule or the allowlist are counted by address.
+func (p *policy) isRobot(req *http.Request) bool {
+	switch p.agentAction(req.Header.Get("User-Agent")) {
+	case agentRobot, agentCrawler, agentDeny:
+		return true
+	case agentAllow:
+		return false
+	}
+	if p.allowed(requestIP(req)) {
+		return false
+	}
+	host := httputil.StripPort(req.RemoteAddr)
+	n, err := db.IncrementCounter(host, 1)
+	if err != nil {
+		requestTrace(req).log(levelError, "increment counter", "host", host, "error", err)
+		return false
+	}
+	threshold := p.robotThreshold
+	if threshold == 0 {
+		threshold = *robot
+	}
+	if n > threshold {
+		requestTrace(req).log(levelInfo, "robot", "count", n, "host", host, "agent", req.Header.Get("User-Agent"))
+		return true
+	}
+	return false
+}
+
+func isRobot(req *http.Request) bool {
+	return robotPolicy.isRobot(req)
+}
+
+// subnet returns the subnet of the address used for the subnet rate limit.
+func (p *policy) subnet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(p.subnetBits4, 32)), Mask: net.CIDRMask(p.subnetBits4, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(p.subnetBits6, 128)), Mask: net.CIDRMask(p.subnetBits6, 128)}).String()
+}
+
+// refill adds the tokens accumulated since the last request to the bucket
+// for key and returns the bucket and the time to wait for a token. The lock
+// must be held.
+func (p *policy) refill(key string, l *rateLimit, now time.Time) (*bucket, time.Duration) {
+	b := p.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: l.burst, last: now}
+		p.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return b, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	return b, 0
+}
+
+// sweep removes the buckets that are full. The lock must be held.
+func (p *policy) sweep(now time.Time) {
+	for key, b := range p.buckets {
+		l := p.ipLimit
+		if strings.Contains(key, "/") {
+			l = p.subnetLimit
+		}
+		if l == nil || b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(p.buckets, key)
+		}
+	}
+	p.lastSweep = now
+}
+
+// check returns an HTTP status and a retry time if the request is denied or
+// rate limited. The status is zero if the request is allowed.
+func (p *policy) check(req *http.Request, now time.Time) (int, time.Duration) {
+	action := p.agentAction(req.Header.Get("User-Agent"))
+	if action == agentDeny {
+		return http.StatusForbidden, 0
+	}
+	if p.ipLimit == nil && p.subnetLimit == nil {
+		return 0, 0
+	}
+	ip := requestIP(req)
+	if ip == nil || p.exempt(ip, action) {
+		return 0, 0
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now.Sub(p.lastSweep) > time.Minute {
+		p.sweep(now)
+	}
+	// Take a token from each bucket only if all buckets have a token.
+	var buckets []*bucket
+	var wait time.Duration
+	for _, x := range []struct {
+		key string
+		l   *rateLimit
+	}{
+		{ip.String(), p.ipLimit},
+		{p.subnet(ip), p.subnetLimit},
+	} {
+		if x.l == nil {
+			continue
+		}
+		b, w := p.refill(x.key, x.l, now)
+		buckets = append(buckets, b)
+		if w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		return statusTooManyRequests, wait
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return 0, 0
+}
+
+// limitedCount returns the number of addresses and subnets with an empty
+// bucket.
+func (p *policy) limitedCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, b := range p.buckets {
+		if b.tokens < 1 {
+			n++
+		}
+	}
+	return n
+}
+
+var rateLimited = newCounterVec("gddo_rate_limited_total", "Requests denied by the robot policy by status.", "status")
+
+// checkPolicy writes an error response and returns false if the request is
+// denied or rate limited by the robot policy.
+func checkPolicy(resp http.ResponseWriter, req *http.Request) bool {
+	status, wait := robotPolicy.check(req, time.Now())
+	if status == 0 {
+		return true
+	}
+	rateLimited.inc(strconv.Itoa(status))
+	requestTrace(req).log(levelDebug, "robot policy", "status", status, "host", req.RemoteAddr, "agent", req.Header.Get("User-Agent"))
+	if wait > 0 {
+		resp.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	}
+	resp.Header().Set("Content-Type", textMIMEType)
+	resp.WriteHeader(status)
+	if status == statusTooManyRequests {
+		io.WriteString(resp, "Too Many Requests")
+	} else {
+		io.WriteString(resp, http.StatusText(status))
+	}
+	return false
+}
+
+// Number of clients in the talkers status view.
+const maxTalkers = 50
+
+// serveTalkers shows the clients with the most requests by the decaying
+// request counter. The view is available to allowlisted addresses and
+// members of the admin group.
+func serveTalkers(resp http.ResponseWriter, req *http.Request) error {
+	if !isAdmin(req) && !robotPolicy.allowed(requestIP(req)) {
+		return &httpError{status: http.StatusNotFound}
+	}
+	counters, err := db.TopCounters(maxTalkers)
+	if err != nil {
+		return err
+	}
+	threshold := robotPolicy.robotThreshold
+	if threshold == 0 {
+		threshold = *robot
+	}
+	resp.Header().Set("Content-Type", textMIMEType)
+	resp.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprintf(resp, "Robot threshold: %g\nRate limited addresses and subnets: %d\n\n", threshold, robotPolicy.limitedCount())
+	for _, c := range counters {
+		robot := ""
+		if c.Value > threshold {
+			robot = "robot"
+		}
+		fmt.Fprintf(resp, "%10.1f %-40s %s\n", c.Value, c.Key, robot)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPolicy = `
+# Test policy.
+agent deny    ^BadBot
+agent crawler Googlebot
+agent allow   ^gddo-tools/
+agent robot   (?:\Wbot\W)|(?:^Go )
+allow 10.0.0.0/8
+allow 192.0.2.1
+allow .googlebot.com
+limit ip 1/s 2
+limit subnet 24/64 10/m 3
+robot 50
+`
+
+func newPolicyRequest(addr, agent string) *http.Request {
+	return &http.Request{RemoteAddr: addr, Header: http.Header{"User-Agent": {agent}}}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	defer func(a func(string) ([]string, error), h func(string) ([]string, error)) {
+		lookupAddr, lookupHost = a, h
+	}(lookupAddr, lookupHost)
+	lookupAddr = func(addr string) ([]string, error) {
+		return map[string][]string{
+			"66.249.66.1":  {"crawl-66-249-66-1.googlebot.com."},
+			"198.51.101.1": {"crawl.googlebot.com.evil.example.", "fake.googlebot.com."},
+		}[addr], nil
+	}
+	lookupHost = func(host string) ([]string, error) {
+		return map[string][]string{
+			"crawl-66-249-66-1.googlebot.com": {"66.249.66.1"},
+			"fake.googlebot.com":              {"66.249.66.2"},
+		}[host], nil
+	}
+
+	p, err := parsePolicy(strings.NewReader(testPolicy), "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.robotThreshold != 50 || p.subnetBits4 != 24 || p.subnetBits6 != 64 || len(p.agents) != 4 || len(p.allow) != 2 || len(p.allowDomains) != 1 {
+		t.Fatalf("parsePolicy() = %+v", p)
+	}
+
+	now := time.Unix(1400000000, 0)
+	for _, tt := range []struct {
+		addr, agent string
+		status      int
+	}{
+		{"198.51.100.1:1234", "BadBot/1.0", http.StatusForbidden},
+		{"66.249.66.1:1234", "Mozilla/5.0 (compatible; Googlebot/2.1)", 0},
+		{"10.1.2.3:1234", "Mozilla/5.0", 0},
+		{"192.0.2.1:1234", "Mozilla/5.0", 0},
+	} {
+		for i := 0; i < 5; i++ {
+			if status, _ := p.check(newPolicyRequest(tt.addr, tt.agent), now); status != tt.status {
+				t.Errorf("check(%s, %s) = %d, want %d", tt.addr, tt.agent, status, tt.status)
+				break
+			}
+		}
+	}
+
+	// User agent rules do not exempt requests from the limits. Crawlers
+	// without a verified reverse DNS name are limited.
+	for _, tt := range []struct {
+		addr, agent string
+	}{
+		{"198.51.101.1:1234", "Mozilla/5.0 (compatible; Googlebot/2.1)"},
+		{"198.51.102.1:1234", "gddo-tools/1.0"},
+	} {
+		var status int
+		for i := 0; i < 3; i++ {
+			status, _ = p.check(newPolicyRequest(tt.addr, tt.agent), now)
+		}
+		if status != statusTooManyRequests {
+			t.Errorf("check(%s, %s) = %d, want %d", tt.addr, tt.agent, status, statusTooManyRequests)
+		}
+	}
+
+	// The address bucket allows a burst of 2 and then 1 request per second.
+	req := newPolicyRequest("203.0.113.1:1234", "Mozilla/5.0")
+	for i, expected := range []int{0, 0, statusTooManyRequests} {
+		if status, _ := p.check(req, now); status != expected {
+			t.Errorf("request %d: check() = %d, want %d", i, status, expected)
+		}
+	}
+	if status, wait := p.check(req, now.Add(500*time.Millisecond)); status != statusTooManyRequests || wait != 500*time.Millisecond {
+		t.Errorf("check() after 500ms = %d, %v, want %d, 500ms", status, wait, statusTooManyRequests)
+	}
+	if status, _ := p.check(req, now.Add(time.Second)); status != 0 {
+		t.Errorf("check() after 1s = %d, want 0", status)
+	}
+
+	// The subnet bucket allows a burst of 3 for the subnet.
+	if status, wait := p.check(newPolicyRequest("203.0.113.2:1234", "Mozilla/5.0"), now.Add(time.Second)); status != statusTooManyRequests || wait <= 0 {
+		t.Errorf("check() for other address in subnet = %d, %v, want %d", status, wait, statusTooManyRequests)
+	}
+	if status, _ := p.check(newPolicyRequest("203.0.114.1:1234", "Mozilla/5.0"), now.Add(time.Second)); status != 0 {
+		t.Errorf("check() for address in other subnet = %d, want 0", status)
+	}
+
+	for _, s := range []string{
+		"agent block Foo",
+		"agent robot (",
+		"allow 10.0.0.0/33",
+		"allow .",
+		"limit ip 10 5",
+		"limit ip 10/d 5",
+		"limit subnet 24 10/s 5",
+		"limit subnet 33/64 10/s 5",
+		"throttle 10",
+	} {
+		if _, err := parsePolicy(strings.NewReader(s), "policy"); err == nil {
+			t.Errorf("parsePolicy(%q) did not return error", s)
+		}
+	}
+}
+
+func TestCheckPolicy(t *testing.T) {
+	defer func(p *policy) { robotPolicy = p }(robotPolicy)
+	var err error
+	robotPolicy, err = parsePolicy(strings.NewReader("limit ip 1/m 1\n"), "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := newPolicyRequest("203.0.113.1:1234", "Mozilla/5.0")
+	if resp := httptest.NewRecorder(); !checkPolicy(resp, req) {
+		t.Fatalf("first request denied with status %d", resp.Code)
+	}
+	resp := httptest.NewRecorder()
+	if checkPolicy(resp, req) {
+		t.Fatalf("second request allowed")
+	}
+	if resp.Code != statusTooManyRequests || resp.HeaderMap.Get("Retry-After") != "60" {
+		t.Errorf("response = %d, Retry-After %q, want %d, 60", resp.Code, resp.HeaderMap.Get("Retry-After"), statusTooManyRequests)
+	}
+}
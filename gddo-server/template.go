@@ -10,7 +10,6 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	godoc "go/doc"
 	htemp "html/template"
 	"io"
 	"net/http"
@@ -20,9 +19,13 @@ import (
 	"reflect"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	ttemp "text/template"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/garyburd/gddo/database"
 	"github.com/garyburd/gddo/doc"
 	"github.com/garyburd/gddo/httputil"
 	"github.com/garyburd/gosrc"
@@ -33,6 +36,9 @@ var cacheBusters httputil.CacheBusters
 type tdoc struct {
 	*doc.Package
 	allExamples []*texample
+	decls       map[string]*doc.Decl
+	refs        map[string]string // documentation URL by exported name
+	imports     map[string]string // import path by package name
 }
 
 type texample struct {
@@ -43,24 +49,141 @@ type texample struct {
 }
 
 func newTDoc(pdoc *doc.Package) *tdoc {
-	return &tdoc{Package: pdoc}
+	tpdoc := &tdoc{Package: pdoc}
+	tpdoc.addComments()
+	return tpdoc
 }
 
-func (pdoc *tdoc) SourceLink(pos doc.Pos, text, anchor string) htemp.HTML {
+func (pdoc *tdoc) SourceLink(pos doc.Pos, text string) htemp.HTML {
 	text = htemp.HTMLEscapeString(text)
 	if pos.Line == 0 || pdoc.LineFmt == "" || pdoc.Files[pos.File].URL == "" {
 		return htemp.HTML(text)
 	}
-	var u string
-	if anchor != "" && strings.HasPrefix(pdoc.Files[pos.File].URL, "/") {
-		u = fmt.Sprintf("%s#%s", pdoc.Files[pos.File].URL, anchor)
-	} else {
-		u = fmt.Sprintf(pdoc.LineFmt, pdoc.Files[pos.File].URL, pos.Line)
-	}
+	u := fmt.Sprintf(pdoc.LineFmt, pdoc.Files[pos.File].URL, pos.Line)
 	u = htemp.HTMLEscapeString(u)
 	return htemp.HTML(fmt.Sprintf(`<a title="View Source" href="%s">%s</a>`, u, text))
 }
 
+// lineAnchorFmt returns the format for the line anchors in the source viewer.
+// The format matches the fragment in the VCS line format so that line links
+// work the same on the VCS and in the source viewer.
+func lineAnchorFmt(lineFmt string) string {
+	if i := strings.Index(lineFmt, "#"); i >= 0 && strings.Contains(lineFmt[i:], "%d") {
+		return lineFmt[i+1:]
+	}
+	return "L%d"
+}
+
+// SourceCode formats a source file as HTML with an anchor for each line.
+func (pdoc *tdoc) SourceCode(f *doc.SourceFile) htemp.HTML {
+	anchorFmt := lineAnchorFmt(pdoc.LineFmt)
+	width := len(strconv.Itoa(strings.Count(f.Code.Text, "\n") + 1))
+	line := 0
+	var buf bytes.Buffer
+	writeLine := func() {
+		line++
+		id := htemp.HTMLEscapeString(fmt.Sprintf(anchorFmt, line))
+		fmt.Fprintf(&buf, `<a class="ln" id="%s" href="#%s">%*d</a>  `, id, id, width, line)
+	}
+	writeLine()
+	writeCode(&buf, f.Code, nil, pdoc, func(p []byte) {
+		for {
+			i := bytes.IndexByte(p, '\n')
+			if i < 0 {
+				htemp.HTMLEscape(&buf, p)
+				return
+			}
+			htemp.HTMLEscape(&buf, p[:i+1])
+			p = p[i+1:]
+			writeLine()
+		}
+	})
+	return htemp.HTML(buf.String())
+}
+
+// ReadmeHTML returns the HTML for a README file. The HTML is sanitized when
+// the package is built.
+func (pdoc *tdoc) ReadmeHTML(r *doc.Readme) htemp.HTML {
+	return htemp.HTML(r.HTML)
+}
+
+// Decl returns the source declaration with the given name or nil if the
+// declaration is not found.
+func (pdoc *tdoc) Decl(name string) *doc.Decl {
+	if pdoc.decls == nil {
+		pdoc.decls = make(map[string]*doc.Decl)
+		for _, d := range pdoc.Decls {
+			pdoc.decls[d.Name] = d
+		}
+	}
+	return pdoc.decls[name]
+}
+
+// SourceURL returns the URL for pos in the source viewer.
+func (pdoc *tdoc) SourceURL(pos doc.Pos) string {
+	return fmt.Sprintf("/%s?file=%s#"+lineAnchorFmt(pdoc.LineFmt),
+		pdoc.ImportPath, url.QueryEscape(pdoc.Files[pos.File].Name), pos.Line)
+}
+
+// SourceLine returns the text of the source line at pos.
+func (pdoc *tdoc) SourceLine(pos doc.Pos) string {
+	name := pdoc.Files[pos.File].Name
+	for _, f := range pdoc.Source {
+		if f.Name == name {
+			lines := strings.SplitN(f.Code.Text, "\n", int(pos.Line)+1)
+			if int(pos.Line) <= len(lines) {
+				return strings.TrimSpace(lines[pos.Line-1])
+			}
+		}
+	}
+	return ""
+}
+
+// DocAnchor returns the anchor for the declaration in the package
+// documentation or "" if the declaration is not documented.
+func (pdoc *tdoc) DocAnchor(d *doc.Decl) string {
+	for _, name := range strings.Split(d.Name, ".") {
+		if !startsWithUppercase(name) {
+			return ""
+		}
+	}
+	return d.Name
+}
+
+// TypeRefName returns the name of the type qualified with the package name
+// for types outside of the package.
+func (pdoc *tdoc) TypeRefName(ref *doc.TypeRef) string {
+	if ref.ImportPath == pdoc.ImportPath {
+		return ref.Name
+	}
+	name := pdoc.ImportNames[ref.ImportPath]
+	if name == "" {
+		name = path.Base(ref.ImportPath)
+	}
+	return name + "." + ref.Name
+}
+
+// TypeRefURL returns the URL for the documentation of the type or the type's
+// member. The empty string is returned if the type is not documented.
+func (pdoc *tdoc) TypeRefURL(ref *doc.TypeRef, member string) string {
+	if !startsWithUppercase(ref.Name) {
+		return ""
+	}
+	frag := ref.Name
+	if member != "" {
+		frag += "." + member
+	}
+	if ref.ImportPath == pdoc.ImportPath {
+		return "#" + frag
+	}
+	return "/" + ref.ImportPath + "#" + frag
+}
+
+func startsWithUppercase(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return unicode.IsUpper(r)
+}
+
 func (pdoc *tdoc) PageName() string {
 	if pdoc.Name != "" && !pdoc.IsCmd {
 		return pdoc.Name
@@ -224,8 +347,38 @@ func importPathFn(path string) htemp.HTML {
 	return htemp.HTML(path)
 }
 
+// snippetFn formats a search result snippet with the matched words in bold.
+func snippetFn(s *database.Snippet) htemp.HTML {
+	var buf bytes.Buffer
+	last := 0
+	for _, h := range s.Highlights {
+		buf.WriteString(htemp.HTMLEscapeString(s.Text[last:h[0]]))
+		buf.WriteString("<b>")
+		buf.WriteString(htemp.HTMLEscapeString(s.Text[h[0]:h[1]]))
+		buf.WriteString("</b>")
+		last = h[1]
+	}
+	buf.WriteString(htemp.HTMLEscapeString(s.Text[last:]))
+	return htemp.HTML(buf.String())
+}
+
+// snippetTextFn formats a search result snippet with the matched words
+// enclosed in asterisks.
+func snippetTextFn(s *database.Snippet) string {
+	var buf bytes.Buffer
+	last := 0
+	for _, h := range s.Highlights {
+		buf.WriteString(s.Text[last:h[0]])
+		buf.WriteString("*")
+		buf.WriteString(s.Text[h[0]:h[1]])
+		buf.WriteString("*")
+		last = h[1]
+	}
+	buf.WriteString(s.Text[last:])
+	return buf.String()
+}
+
 var (
-	h3Pat      = regexp.MustCompile(`<h3 id="([^"]+)">([^<]+)</h3>`)
 	rfcPat     = regexp.MustCompile(`RFC\s+(\d{3,4})`)
 	packagePat = regexp.MustCompile(`\s+package\s+([-a-z0-9]\S+)`)
 )
@@ -247,21 +400,9 @@ func replaceAll(src []byte, re *regexp.Regexp, replace func(out, src []byte, m [
 	return append(out, src...)
 }
 
-// commentFn formats a source code comment as HTML.
-func commentFn(v string) htemp.HTML {
-	var buf bytes.Buffer
-	godoc.ToHTML(&buf, v, nil)
-	p := buf.Bytes()
-	p = replaceAll(p, h3Pat, func(out, src []byte, m []int) []byte {
-		out = append(out, `<h4 id="`...)
-		out = append(out, src[m[2]:m[3]]...)
-		out = append(out, `">`...)
-		out = append(out, src[m[4]:m[5]]...)
-		out = append(out, ` <a class="permalink" href="#`...)
-		out = append(out, src[m[2]:m[3]]...)
-		out = append(out, `">&para</a></h4>`...)
-		return out
-	})
+// linkText adds links for RFC numbers and package import paths to HTML
+// escaped comment text.
+func linkText(p []byte) []byte {
 	p = replaceAll(p, rfcPat, func(out, src []byte, m []int) []byte {
 		out = append(out, `<a href="http://tools.ietf.org/html/rfc`...)
 		out = append(out, src[m[2]:m[3]]...)
@@ -284,32 +425,45 @@ func commentFn(v string) htemp.HTML {
 		out = append(out, src[m[2]+len(path):m[1]]...)
 		return out
 	})
-	return htemp.HTML(p)
+	return p
 }
 
-// commentTextFn formats a source code comment as text.
-func commentTextFn(v string) string {
+// commentFn formats a doc comment as HTML.
+func commentFn(c *doc.Comment) htemp.HTML {
+	var buf bytes.Buffer
+	writeCommentHTML(&buf, c, nil)
+	return htemp.HTML(buf.String())
+}
+
+// commentTextFn formats a doc comment as text.
+func commentTextFn(c *doc.Comment) string {
 	const indent = "    "
 	var buf bytes.Buffer
-	godoc.ToText(&buf, v, indent, "\t", 80-2*len(indent))
-	p := buf.Bytes()
-	return string(p)
+	writeCommentText(&buf, c, indent, "\t", 80-2*len(indent))
+	return buf.String()
 }
 
 var period = []byte{'.'}
 
 func codeFn(c doc.Code, typ *doc.Type) htemp.HTML {
 	var buf bytes.Buffer
+	writeCode(&buf, c, typ, nil, func(p []byte) { htemp.HTMLEscape(&buf, p) })
+	return htemp.HTML(buf.String())
+}
+
+// writeCode writes the annotated code to buf. Links to source declarations are
+// resolved using pdoc. The text function writes plain text to buf.
+func writeCode(buf *bytes.Buffer, c doc.Code, typ *doc.Type, pdoc *tdoc, text func([]byte)) {
 	last := 0
 	src := []byte(c.Text)
 	for _, a := range c.Annotations {
-		htemp.HTMLEscape(&buf, src[last:a.Pos])
+		text(src[last:a.Pos])
 		switch a.Kind {
 		case doc.PackageLinkAnnotation:
 			buf.WriteString(`<a href="`)
 			buf.WriteString(formatPathFrag(c.Paths[a.PathIndex], ""))
 			buf.WriteString(`">`)
-			htemp.HTMLEscape(&buf, src[a.Pos:a.End])
+			text(src[a.Pos:a.End])
 			buf.WriteString(`</a>`)
 		case doc.LinkAnnotation, doc.BuiltinAnnotation:
 			var p string
@@ -323,29 +477,55 @@ func codeFn(c doc.Code, typ *doc.Type) htemp.HTML {
 			buf.WriteString(`<a href="`)
 			buf.WriteString(formatPathFrag(p, string(n)))
 			buf.WriteString(`">`)
-			htemp.HTMLEscape(&buf, src[a.Pos:a.End])
+			text(src[a.Pos:a.End])
+			buf.WriteString(`</a>`)
+		case doc.DeclAnnotation, doc.ReferenceAnnotation:
+			var d *doc.Decl
+			if pdoc != nil {
+				d = pdoc.Decl(c.Paths[a.PathIndex])
+			}
+			if d == nil {
+				text(src[a.Pos:a.End])
+				break
+			}
+			if a.Kind == doc.DeclAnnotation {
+				buf.WriteString(`<a title="Find references" href="`)
+				htemp.HTMLEscape(buf, []byte("?refs="+url.QueryEscape(d.Name)))
+			} else {
+				buf.WriteString(`<a title="Go to definition" href="`)
+				htemp.HTMLEscape(buf, []byte(pdoc.SourceURL(d.Pos)))
+			}
+			buf.WriteString(`">`)
+			text(src[a.Pos:a.End])
 			buf.WriteString(`</a>`)
 		case doc.CommentAnnotation:
 			buf.WriteString(`<span class="com">`)
-			htemp.HTMLEscape(&buf, src[a.Pos:a.End])
+			text(src[a.Pos:a.End])
+			buf.WriteString(`</span>`)
+		case doc.KeywordAnnotation:
+			buf.WriteString(`<span class="kwd">`)
+			text(src[a.Pos:a.End])
+			buf.WriteString(`</span>`)
+		case doc.StringAnnotation:
+			buf.WriteString(`<span class="str">`)
+			text(src[a.Pos:a.End])
 			buf.WriteString(`</span>`)
 		case doc.AnchorAnnotation:
 			buf.WriteString(`<span id="`)
 			if typ != nil {
-				htemp.HTMLEscape(&buf, []byte(typ.Name))
+				htemp.HTMLEscape(buf, []byte(typ.Name))
 				buf.WriteByte('.')
 			}
-			htemp.HTMLEscape(&buf, src[a.Pos:a.End])
+			htemp.HTMLEscape(buf, src[a.Pos:a.End])
 			buf.WriteString(`">`)
-			htemp.HTMLEscape(&buf, src[a.Pos:a.End])
+			text(src[a.Pos:a.End])
 			buf.WriteString(`</span>`)
 		default:
-			htemp.HTMLEscape(&buf, src[a.Pos:a.End])
+			text(src[a.Pos:a.End])
 		}
 		last = int(a.End)
 	}
-	htemp.HTMLEscape(&buf, src[last:])
-	return htemp.HTML(buf.String())
+	text(src[last:])
 }
 
 var gaAccount string
@@ -415,6 +595,7 @@ func parseHTMLTemplates(sets [][]string) error {
 			"map":               mapFn,
 			"noteTitle":         noteTitleFn,
 			"relativePath":      relativePathFn,
+			"snippet":           snippetFn,
 			"sidebarEnabled":    func() bool { return *sidebarEnabled },
 			"staticPath":        func(p string) string { return cacheBusters.AppendQueryParam(p, "v") },
 			"templateName":      func() string { return templateName },
@@ -436,6 +617,7 @@ func parseTextTemplates(sets [][]string) error {
 		t := ttemp.New("")
 		t.Funcs(ttemp.FuncMap{
 			"comment": commentTextFn,
+			"snippet": snippetTextFn,
 		})
 		if _, err := t.ParseFiles(joinTemplateDir(*assetsDir, set)...); err != nil {
 			return err
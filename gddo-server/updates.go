@@ -0,0 +1,303 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/garyburd/gddo/config"
+	"github.com/garyburd/gosrc"
+)
+
+var (
+	updateFeeds    = flag.String("update_feeds", "", "File with lines of the form \"projectRoot feedURL\" for Atom or RSS commit feeds polled for project updates.")
+	feedInterval   = flag.Duration("feed_interval", 0, "Commit feed poller sleeps for this duration between fetches of a feed. Zero disables the poller.")
+	mirrorDir      = flag.String("mirror_dir", "", "Directory of bare git mirrors. The path of a mirror relative to the directory is the project root with an optional .git suffix.")
+	mirrorInterval = flag.Duration("mirror_interval", 0, "Mirror scanner sleeps for this duration between scans of the mirror directory. Zero disables the scanner.")
+)
+
+// updateSource is a source of recently updated projects.
+type updateSource interface {
+	// updates returns the roots of the projects updated since the state
+	// recorded in cursor and the cursor for the next call. The cursor is
+	// "" on the first call.
+	updates(cursor string) (roots []string, next string, err error)
+}
+
+// legacyUpdateKeys maps update source names to the database keys of the
+// cursors stored by earlier versions of the server.
+var legacyUpdateKeys = map[string]string{
+	"github": "gitHubUpdates",
+}
+
+// readUpdates returns a background task function that bumps the crawl of
+// the projects returned by an update source. The cursor for the source is
+// stored in the database with the given name. If the cursor is not stored,
+// then the cursor stored by an earlier version of the server is used.
+func readUpdates(name string, src updateSource) func() error {
+	return func() error {
+		key := "updates:" + name
+		var cursor string
+		if err := db.GetGob(key, &cursor); err != nil {
+			return err
+		}
+		if legacy := legacyUpdateKeys[name]; cursor == "" && legacy != "" {
+			if err := db.GetGob(legacy, &cursor); err != nil {
+				return err
+			}
+		}
+		roots, cursor, err := src.updates(cursor)
+		if err != nil {
+			return err
+		}
+		for _, root := range roots {
+			logEvent(levelInfo, "bump crawl", "root", root, "source", name)
+			if err := bumpCrawl(root); err != nil {
+				logEvent(levelError, "bump crawl", "root", root, "error", err)
+			}
+		}
+		return db.PutGob(key, cursor)
+	}
+}
+
+// gitHubSource is the GitHub public event stream.
+type gitHubSource struct{}
+
+func (gitHubSource) updates(cursor string) ([]string, string, error) {
+	next, names, err := gosrc.GetGitHubUpdates(httpClient, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	roots := make([]string, len(names))
+	for i, name := range names {
+		roots[i] = "github.com/" + name
+	}
+	return roots, next, nil
+}
+
+// feedSource is an Atom or RSS commit feed for a project. The cursor is the
+// time of the most recent entry in the feed.
+type feedSource struct {
+	projectRoot string
+	url         string
+}
+
+// commitFeed is the subset of an Atom or RSS feed used to find updates.
+type commitFeed struct {
+	// Atom
+	Entries []struct {
+		Updated string `xml:"updated"`
+	} `xml:"entry"`
+
+	// RSS
+	Items []struct {
+		PubDate string `xml:"pubDate"`
+	} `xml:"channel>item"`
+}
+
+// latest returns the time of the most recent entry in the feed.
+func (f *commitFeed) latest() (time.Time, error) {
+	var t time.Time
+	update := func(s string, layouts ...string) error {
+		s = strings.TrimSpace(s)
+		for _, layout := range layouts {
+			if x, err := time.Parse(layout, s); err == nil {
+				if x.After(t) {
+					t = x
+				}
+				return nil
+			}
+		}
+		return fmt.Errorf("bad feed time %q", s)
+	}
+	for _, e := range f.Entries {
+		if err := update(e.Updated, time.RFC3339); err != nil {
+			return t, err
+		}
+	}
+	for _, item := range f.Items {
+		if err := update(item.PubDate, time.RFC1123Z, time.RFC1123); err != nil {
+			return t, err
+		}
+	}
+	return t, nil
+}
+
+func (src *feedSource) updates(cursor string) ([]string, string, error) {
+	resp, err := httpClient.Get(src.url)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%s: status %d", src.url, resp.StatusCode)
+	}
+	var f commitFeed
+	if err := xml.NewDecoder(resp.Body).Decode(&f); err != nil {
+		return nil, "", fmt.Errorf("%s: %v", src.url, err)
+	}
+	t, err := f.latest()
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %v", src.url, err)
+	}
+	if t.IsZero() {
+		return nil, cursor, nil
+	}
+	next := t.UTC().Format(time.RFC3339)
+	if cursor == "" {
+		// Record the initial state of the feed.
+		return nil, next, nil
+	}
+	last, err := time.Parse(time.RFC3339, cursor)
+	if err != nil || t.After(last) {
+		return []string{src.projectRoot}, next, nil
+	}
+	return nil, cursor, nil
+}
+
+// mirrorSource scans a directory of bare git mirrors for repositories with
+// changed refs. The cursor is a JSON object mapping project roots to the
+// modification time of the repository refs.
+type mirrorSource struct {
+	dir string
+}
+
+// refsFiles are the files in a bare repository that change when the
+// repository is fetched.
+var refsFiles = []string{"HEAD", "FETCH_HEAD", "packed-refs", "refs"}
+
+// isBareRepo returns true if dir looks like a bare git repository.
+func isBareRepo(dir string) bool {
+	for _, name := range []string{"HEAD", "objects", "refs"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// refsTime returns the latest modification time of the refs in a bare git
+// repository.
+func refsTime(dir string) (int64, error) {
+	var t int64
+	for _, name := range refsFiles {
+		err := filepath.Walk(filepath.Join(dir, name), func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if mt := fi.ModTime().UnixNano(); mt > t {
+				t = mt
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return t, nil
+}
+
+// scan returns the modification time of the refs for each repository in
+// the mirror directory by project root.
+func (src mirrorSource) scan() (map[string]int64, error) {
+	repos := make(map[string]int64)
+	err := filepath.Walk(src.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() || !isBareRepo(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(src.dir, path)
+		if err != nil {
+			return err
+		}
+		t, err := refsTime(path)
+		if err != nil {
+			return err
+		}
+		repos[strings.TrimSuffix(filepath.ToSlash(rel), ".git")] = t
+		return filepath.SkipDir
+	})
+	return repos, err
+}
+
+func (src mirrorSource) updates(cursor string) ([]string, string, error) {
+	repos, err := src.scan()
+	if err != nil {
+		return nil, "", err
+	}
+	p, err := json.Marshal(repos)
+	if err != nil {
+		return nil, "", err
+	}
+	if cursor == "" {
+		// Record the initial state of the mirrors.
+		return nil, string(p), nil
+	}
+	var last map[string]int64
+	if err := json.Unmarshal([]byte(cursor), &last); err != nil {
+		return nil, string(p), nil
+	}
+	var roots []string
+	for root, t := range repos {
+		if t != last[root] && gosrc.IsValidRemotePath(root) {
+			roots = append(roots, root)
+		}
+	}
+	return roots, string(p), nil
+}
+
+// readFeedSources reads the commit feed configuration file.
+func readFeedSources(name string) ([]*feedSource, error) {
+	var sources []*feedSource
+	err := config.ReadFile(name, func(l *config.Line) error {
+		if len(l.Fields) != 2 || !gosrc.IsValidRemotePath(l.Fields[0]) {
+			return l.Errorf("expected project root and feed URL")
+		}
+		sources = append(sources, &feedSource{projectRoot: l.Fields[0], url: l.Fields[1]})
+		return nil
+	})
+	return sources, err
+}
+
+// addUpdateTasks adds the background tasks for the configured commit feeds
+// and mirror directory.
+func addUpdateTasks() error {
+	if *updateFeeds != "" {
+		sources, err := readFeedSources(*updateFeeds)
+		if err != nil {
+			return err
+		}
+		for _, src := range sources {
+			backgroundTasks = append(backgroundTasks, &backgroundTask{
+				name:     "Feed " + src.url,
+				fn:       readUpdates("feed:"+src.url, src),
+				interval: feedInterval,
+			})
+		}
+	}
+	if *mirrorDir != "" {
+		backgroundTasks = append(backgroundTasks, &backgroundTask{
+			name:     "Mirror updates",
+			fn:       readUpdates("mirror", mirrorSource{dir: *mirrorDir}),
+			interval: mirrorInterval,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+const atomFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <title>Recent Commits to project:master</title>
+  <updated>2014-03-02T10:00:00Z</updated>
+  <entry>
+    <title>Fix bug</title>
+    <updated>2014-03-02T10:00:00Z</updated>
+  </entry>
+  <entry>
+    <title>Add feature</title>
+    <updated>2014-03-01T09:00:00-08:00</updated>
+  </entry>
+</feed>`
+
+const rssFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0">
+  <channel>
+    <title>project commits</title>
+    <item>
+      <title>Add feature</title>
+      <pubDate>Sat, 01 Mar 2014 09:00:00 -0800</pubDate>
+    </item>
+    <item>
+      <title>Fix bug</title>
+      <pubDate>Sun, 02 Mar 2014 10:00:00 +0000</pubDate>
+    </item>
+  </channel>
+</rss>`
+
+var feedSourceTests = []struct {
+	feed   string
+	cursor string
+	roots  []string
+	next   string
+}{
+	{atomFeed, "", nil, "2014-03-02T10:00:00Z"},
+	{atomFeed, "2014-03-01T00:00:00Z", []string{"example.com/project"}, "2014-03-02T10:00:00Z"},
+	{atomFeed, "2014-03-02T10:00:00Z", nil, "2014-03-02T10:00:00Z"},
+	{rssFeed, "", nil, "2014-03-02T10:00:00Z"},
+	{rssFeed, "2014-03-01T00:00:00Z", []string{"example.com/project"}, "2014-03-02T10:00:00Z"},
+	{rssFeed, "2014-03-03T00:00:00Z", nil, "2014-03-03T00:00:00Z"},
+}
+
+func TestFeedSource(t *testing.T) {
+	var feed string
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "application/xml")
+		resp.Write([]byte(feed))
+	}))
+	defer server.Close()
+
+	src := &feedSource{projectRoot: "example.com/project", url: server.URL}
+	for _, tt := range feedSourceTests {
+		feed = tt.feed
+		roots, next, err := src.updates(tt.cursor)
+		if err != nil {
+			t.Errorf("updates(%q) returned error %v", tt.cursor, err)
+			continue
+		}
+		if !reflect.DeepEqual(roots, tt.roots) || next != tt.next {
+			t.Errorf("updates(%q) = %v, %q, want %v, %q", tt.cursor, roots, next, tt.roots, tt.next)
+		}
+	}
+}
+
+func TestMirrorSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gddo-mirrors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	past := time.Now().Add(-time.Hour)
+	for _, repo := range []string{"example.com/a.git", "example.com/b.git", "example.com/c"} {
+		for _, name := range []string{"objects", "refs/heads"} {
+			if err := os.MkdirAll(filepath.Join(dir, repo, name), 0777); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, name := range []string{"HEAD", "refs/heads/master"} {
+			p := filepath.Join(dir, repo, name)
+			if err := ioutil.WriteFile(p, []byte("ref\n"), 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+		filepath.Walk(filepath.Join(dir, repo), func(path string, fi os.FileInfo, err error) error {
+			return os.Chtimes(path, past, past)
+		})
+	}
+	// Not a repository.
+	if err := os.MkdirAll(filepath.Join(dir, "example.com/d"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	src := mirrorSource{dir: dir}
+	roots, cursor, err := src.updates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 0 {
+		t.Errorf("initial scan returned roots %v, want none", roots)
+	}
+
+	roots, cursor, err = src.updates(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 0 {
+		t.Errorf("unchanged scan returned roots %v, want none", roots)
+	}
+
+	now := time.Now()
+	for _, name := range []string{"example.com/a.git/refs/heads/master", "example.com/c/FETCH_HEAD"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("ref\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(dir, name), now, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	roots, _, err = src.updates(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(roots)
+	if expected := []string{"example.com/a", "example.com/c"}; !reflect.DeepEqual(roots, expected) {
+		t.Errorf("scan returned roots %v, want %v", roots, expected)
+	}
+}